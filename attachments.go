@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mobila/pb"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// chunks stay well below the 20 KiB limit of the pbio reader once sealed
+	blobChunkSize     = 12 << 10
+	maxAttachmentSize = 100 << 20
+	// chunks asked for at once
+	blobWindow     = 64
+	blobGCInterval = 6 * time.Hour
+)
+
+// Attachment is the file carried by a message. Its content is a blob that
+// is stored and transferred separately.
+type Attachment struct {
+	Hash      []byte `json:"hash"`
+	Size      int64  `json:"size"`
+	Name      string `json:"name"`
+	Mime      string `json:"mime"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+func (a *Attachment) manifest() []byte {
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(&pb.Attachment{
+		Hash:      a.Hash,
+		Size:      uint64(a.Size),
+		Name:      a.Name,
+		MimeType:  a.Mime,
+		ChunkSize: uint32(a.ChunkSize),
+	})
+	return data
+}
+
+func attachmentFromManifest(mimeType string, data []byte) (*Attachment, error) {
+	var m pb.Attachment
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("bad attachment manifest: %w", err)
+	}
+	if m.MimeType != mimeType {
+		return nil, fmt.Errorf("attachment is %q, message says %q", m.MimeType, mimeType)
+	}
+	if len(m.Hash) != sha256.Size || m.ChunkSize == 0 || m.ChunkSize > blobChunkSize {
+		return nil, fmt.Errorf("bad attachment manifest")
+	}
+	return &Attachment{
+		Hash:      m.Hash,
+		Size:      int64(m.Size),
+		Name:      filepath.Base(m.Name),
+		Mime:      m.MimeType,
+		ChunkSize: int(m.ChunkSize),
+	}, nil
+}
+
+// SendAttachment stores the file as a blob and posts a message carrying it.
+// The file is streamed into the store, never held in memory as a whole.
+func (s *State) SendAttachment(chatID, name string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	// all DetectContentType looks at
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	// plain text is what marks a text message
+	if mimeType == "" || mimeType == "text/plain" {
+		mimeType = http.DetectContentType(head)
+	}
+	info, err := s.Store.PutBlob(br, blobChunkSize, maxAttachmentSize)
+	if errors.Is(err, errBlobTooLarge) {
+		return fmt.Errorf("%s is larger than %d MiB", name, maxAttachmentSize>>20)
+	}
+	if err != nil {
+		return err
+	}
+	return s.postMessage(Message{ChatID: chatID, Attachment: &Attachment{
+		Hash:      info.Hash,
+		Size:      info.Size,
+		Name:      filepath.Base(name),
+		Mime:      mimeType,
+		ChunkSize: info.ChunkSize,
+	}})
+}
+
+// BlobStatus returns what we have of a blob, nil if nothing.
+func (s *State) BlobStatus(hash []byte) *BlobInfo {
+	info, err := s.Store.LoadBlobInfo(hash)
+	if err != nil {
+		fmt.Printf("error loading blob %x: %v\n", hash, err)
+	}
+	return info
+}
+
+// fetchAttachment starts fetching the blob of a received message from its
+// author or, failing that, from the peer that passed the message on.
+func (s *State) fetchAttachment(msg Message, peerID string) {
+	a := msg.Attachment
+	if a.Size > maxAttachmentSize {
+		fmt.Printf("attachment %s of %d bytes not fetched\n", a.Name, a.Size)
+		return
+	}
+	info, err := s.Store.LoadBlobInfo(a.Hash)
+	if err != nil {
+		fmt.Printf("error loading blob %x: %v\n", a.Hash, err)
+		return
+	}
+	if info != nil && info.Complete {
+		return
+	}
+	if info == nil {
+		info = &BlobInfo{Hash: a.Hash, Size: a.Size, ChunkSize: a.ChunkSize, ChatID: msg.ChatID}
+	}
+	for _, p := range []string{msg.Author, peerID} {
+		if !slices.Contains(info.Sources, p) {
+			info.Sources = append(info.Sources, p)
+		}
+	}
+	if err := s.Store.SaveBlobInfo(info); err != nil {
+		fmt.Printf("error saving blob %x: %v\n", a.Hash, err)
+		return
+	}
+
+	s.blobMu.Lock()
+	busy := len(s.downloads[hex.EncodeToString(a.Hash)]) > 0
+	s.blobMu.Unlock()
+	if busy {
+		return
+	}
+	for _, p := range info.Sources {
+		if s.requestChunks(info, p) == nil {
+			return
+		}
+	}
+}
+
+// resumeDownloads asks a peer that just connected for the rest of the blobs
+// it is a source of.
+func (s *State) resumeDownloads(peerID string) {
+	pending, err := s.Store.GetPendingBlobs()
+	if err != nil {
+		fmt.Printf("error loading pending blobs: %v\n", err)
+		return
+	}
+	for i := range pending {
+		if slices.Contains(pending[i].Sources, peerID) {
+			if err := s.requestChunks(&pending[i], peerID); err != nil {
+				fmt.Printf("error resuming blob %x: %v\n", pending[i].Hash, err)
+			}
+		}
+	}
+}
+
+// requestChunks asks the peer for the next window of missing chunks, or
+// completes the blob when none are missing.
+func (s *State) requestChunks(info *BlobInfo, peerID string) error {
+	missing, err := s.Store.MissingBlobChunks(info.Hash, info.Chunks())
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return s.completeBlob(info)
+	}
+	info.Received = info.Chunks() - len(missing)
+	if err := s.Store.SaveBlobInfo(info); err != nil {
+		return err
+	}
+	s.blobChanged(info.Hash)
+
+	req := &pb.BlobRequest{ChatId: info.ChatID, Hash: info.Hash}
+	requested := make(map[int]bool)
+	for _, i := range missing[:min(len(missing), blobWindow)] {
+		req.Chunks = append(req.Chunks, uint32(i))
+		requested[i] = true
+	}
+	s.blobMu.Lock()
+	s.downloads[hex.EncodeToString(info.Hash)] = requested
+	s.blobMu.Unlock()
+	err = s.sendSealed(peerID, &pb.DataPacket{Msg: &pb.DataPacket_BlobRequest{BlobRequest: req}})
+	if err != nil {
+		s.blobMu.Lock()
+		delete(s.downloads, hex.EncodeToString(info.Hash))
+		s.blobMu.Unlock()
+	}
+	return err
+}
+
+// completeBlob checks the assembled content against its hash. Chunks that do
+// not add up are thrown away and fetched again later.
+func (s *State) completeBlob(info *BlobInfo) error {
+	s.blobMu.Lock()
+	delete(s.downloads, hex.EncodeToString(info.Hash))
+	s.blobMu.Unlock()
+	if verr := s.Store.VerifyBlob(info); verr != nil {
+		info.Received = 0
+		if err := s.Store.SaveBlobInfo(info); err != nil {
+			return err
+		}
+		if err := s.Store.DeleteBlobChunks(info.Hash); err != nil {
+			return err
+		}
+		return verr
+	}
+	info.Complete = true
+	info.Received = 0
+	info.Sources = nil
+	if err := s.Store.SaveBlobInfo(info); err != nil {
+		return err
+	}
+	s.blobChanged(info.Hash)
+	return nil
+}
+
+func (s *State) blobChanged(hash []byte) {
+	fyne.Do(func() {
+		if s.OnBlobChanged != nil {
+			s.OnBlobChanged(hash)
+		}
+	})
+}
+
+func (s *State) receiveBlobRequest(peerID string, req *pb.BlobRequest) {
+	if !slices.Contains(s.chatMembers(req.ChatId), peerID) || !s.Store.HasBlobRef(req.Hash, req.ChatId) {
+		fmt.Printf("blob request of %s for %x in chat %s refused\n", peerID, req.Hash, req.ChatId)
+		return
+	}
+	info, err := s.Store.LoadBlobInfo(req.Hash)
+	if err != nil || info == nil || !info.Complete || len(req.Chunks) > blobWindow {
+		return
+	}
+	go func() {
+		for _, i := range req.Chunks {
+			if int(i) >= info.Chunks() {
+				return
+			}
+			data, err := s.Store.LoadBlobChunk(req.Hash, int(i))
+			if err != nil {
+				fmt.Printf("error loading chunk %d of %x: %v\n", i, req.Hash, err)
+				return
+			}
+			chunk := &pb.BlobChunk{Hash: req.Hash, Index: i, Data: data}
+			if err := s.sendSealed(peerID, &pb.DataPacket{Msg: &pb.DataPacket_BlobChunk{BlobChunk: chunk}}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (s *State) receiveBlobChunk(peerID string, c *pb.BlobChunk) {
+	key := hex.EncodeToString(c.Hash)
+	index := int(c.Index)
+	s.blobMu.Lock()
+	outstanding := s.downloads[key][index]
+	s.blobMu.Unlock()
+	// duplicates and chunks we did not ask for must not shrink the window
+	if !outstanding {
+		return
+	}
+	info, err := s.Store.LoadBlobInfo(c.Hash)
+	if err != nil || info == nil || info.Complete {
+		return
+	}
+	if index >= info.Chunks() || len(c.Data) != info.chunkLen(index) {
+		fmt.Printf("bad chunk %d of %x from %s\n", index, c.Hash, peerID)
+		return
+	}
+	if err := s.Store.SaveBlobChunk(c.Hash, index, c.Data); err != nil {
+		fmt.Printf("error saving chunk %d of %x: %v\n", index, c.Hash, err)
+		return
+	}
+
+	s.blobMu.Lock()
+	requested := s.downloads[key]
+	done := requested[index] && len(requested) == 1
+	delete(requested, index)
+	s.blobMu.Unlock()
+	if done {
+		go func() {
+			if err := s.requestChunks(info, peerID); err != nil {
+				fmt.Printf("error fetching blob %x: %v\n", c.Hash, err)
+			}
+		}()
+	}
+}
+
+// runBlobGC removes the blobs no message carries any more.
+func (s *State) runBlobGC() {
+	for {
+		n, err := s.Store.CollectBlobs(time.Now())
+		if err != nil {
+			fmt.Printf("error collecting blobs: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("%d unreferenced blobs removed\n", n)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(blobGCInterval):
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/malgo"
+)
+
+const (
+	// a source starts playing once this much is buffered
+	prebufferSamples = playbackRate * 60 / 1000 * playbackChannels
+	// anything beyond this is latency, the oldest samples are dropped
+	maxBufferedSamples = playbackRate * 500 / 1000 * playbackChannels
+	sinkPeriod         = 10 * time.Millisecond
+)
+
+type mixerSource struct {
+	samples []int16
+	volume  float32
+	playing bool
+}
+
+// AudioMixer sums the decoded audio of all call participants, 48 kHz
+// interleaved stereo, applying a volume per peer.
+type AudioMixer struct {
+	mu      sync.Mutex
+	sources map[string]*mixerSource
+	volumes map[string]float32
+}
+
+func NewAudioMixer() *AudioMixer {
+	return &AudioMixer{
+		sources: make(map[string]*mixerSource),
+		volumes: make(map[string]float32),
+	}
+}
+
+// Push queues decoded samples of a peer.
+func (m *AudioMixer) Push(peerID string, pcm []int16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src, ok := m.sources[peerID]
+	if !ok {
+		src = &mixerSource{volume: 1}
+		if v, ok := m.volumes[peerID]; ok {
+			src.volume = v
+		}
+		m.sources[peerID] = src
+	}
+	src.samples = append(src.samples, pcm...)
+	if over := len(src.samples) - maxBufferedSamples; over > 0 {
+		src.samples = src.samples[over:]
+	}
+}
+
+func (m *AudioMixer) Remove(peerID string) {
+	m.mu.Lock()
+	delete(m.sources, peerID)
+	m.mu.Unlock()
+}
+
+// SetVolume takes a factor from 0 (muted) upward; it survives the peer rejoining.
+func (m *AudioMixer) SetVolume(peerID string, volume float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.volumes[peerID] = volume
+	if src, ok := m.sources[peerID]; ok {
+		src.volume = volume
+	}
+}
+
+// Mix fills out with the sum of all sources, silence where nothing is buffered.
+func (m *AudioMixer) Mix(out []int16) {
+	acc := make([]float32, len(out))
+	m.mu.Lock()
+	for _, src := range m.sources {
+		if !src.playing {
+			if len(src.samples) < prebufferSamples {
+				continue
+			}
+			src.playing = true
+		}
+		n := min(len(out), len(src.samples))
+		for i := 0; i < n; i++ {
+			acc[i] += float32(src.samples[i]) * src.volume
+		}
+		src.samples = src.samples[n:]
+		if n < len(out) {
+			// underrun, wait for the prebuffer again
+			src.playing = false
+		}
+	}
+	m.mu.Unlock()
+	for i, v := range acc {
+		out[i] = int16(max(math.MinInt16, min(math.MaxInt16, v)))
+	}
+}
+
+// AudioSink pulls mixed audio at the playback rate.
+type AudioSink interface {
+	Start(mixer *AudioMixer) error
+	Close() error
+}
+
+// NewAudioSink picks the backend from MOBILA_AUDIO_SINK: empty for the default
+// output device, "null" to discard audio, "file:<path>" to write raw
+// 48 kHz s16le stereo PCM.
+func NewAudioSink() AudioSink {
+	spec := os.Getenv("MOBILA_AUDIO_SINK")
+	switch {
+	case spec == "null":
+		return &pacedSink{w: io.Discard}
+	case strings.HasPrefix(spec, "file:"):
+		return &pacedSink{path: strings.TrimPrefix(spec, "file:")}
+	default:
+		return &malgoSink{}
+	}
+}
+
+type malgoSink struct {
+	ctx    *malgo.AllocatedContext
+	device *malgo.Device
+}
+
+func (s *malgoSink) Start(mixer *AudioMixer) error {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return err
+	}
+	cfg := malgo.DefaultDeviceConfig(malgo.Playback)
+	cfg.Playback.Format = malgo.FormatS16
+	cfg.Playback.Channels = playbackChannels
+	cfg.SampleRate = playbackRate
+	var pcm []int16
+	device, err := malgo.InitDevice(ctx.Context, cfg, malgo.DeviceCallbacks{
+		Data: func(out, _ []byte, frames uint32) {
+			n := int(frames) * playbackChannels
+			if cap(pcm) < n {
+				pcm = make([]int16, n)
+			}
+			pcm = pcm[:n]
+			mixer.Mix(pcm)
+			for i, v := range pcm {
+				binary.LittleEndian.PutUint16(out[2*i:], uint16(v))
+			}
+		},
+	})
+	if err != nil {
+		ctx.Uninit()
+		ctx.Free()
+		return err
+	}
+	if err := device.Start(); err != nil {
+		device.Uninit()
+		ctx.Uninit()
+		ctx.Free()
+		return err
+	}
+	s.ctx, s.device = ctx, device
+	return nil
+}
+
+func (s *malgoSink) Close() error {
+	if s.device != nil {
+		s.device.Uninit()
+		s.ctx.Uninit()
+		s.ctx.Free()
+		s.device, s.ctx = nil, nil
+	}
+	return nil
+}
+
+// pacedSink pulls from the mixer on a timer instead of a sound card clock,
+// for machines without audio output.
+type pacedSink struct {
+	w    io.Writer
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (s *pacedSink) Start(mixer *AudioMixer) error {
+	var file *os.File
+	if s.path != "" {
+		var err error
+		file, err = os.Create(s.path)
+		if err != nil {
+			return err
+		}
+		s.w = file
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if file != nil {
+			defer file.Close()
+		}
+		ticker := time.NewTicker(sinkPeriod)
+		defer ticker.Stop()
+		pcm := make([]int16, int(playbackRate*sinkPeriod/time.Second)*playbackChannels)
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			mixer.Mix(pcm)
+			if err := binary.Write(s.w, binary.LittleEndian, pcm); err != nil {
+				fmt.Printf("error writing audio: %v\n", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *pacedSink) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// repeatFrames repeats the interleaved stereo frames until there are n samples.
+func repeatFrames(n int, frames ...int16) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = frames[i%len(frames)]
+	}
+	return pcm
+}
+
+func TestMixerThroughFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.pcm")
+	t.Setenv("MOBILA_AUDIO_SINK", "file:"+path)
+
+	// what the sink writes in 100 ms, well past the prebuffer
+	n := playbackRate / 10 * playbackChannels
+	mixer := NewAudioMixer()
+	mixer.SetVolume("quiet", 0.5)
+	mixer.SetVolume("muted", 0)
+	mixer.Push("quiet", repeatFrames(n, 10000, -10000, 10000, 2000))
+	mixer.Push("loud", repeatFrames(n, 30000, -30000, 1000, -4000))
+	mixer.Push("muted", repeatFrames(n, 20000, 20000, 20000, 20000))
+
+	sink := NewAudioSink()
+	if err := sink.Start(mixer); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if fi, err := os.Stat(path); err == nil && fi.Size() >= int64(2*n) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sink wrote too little")
+		}
+		time.Sleep(sinkPeriod)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int16{
+		math.MaxInt16, math.MinInt16, // both peers together are too loud either way
+		6000, -3000, // the quiet peer at half volume
+	}
+	for i := 0; i < n; i++ {
+		got := int16(binary.LittleEndian.Uint16(data[2*i:]))
+		if got != want[i%len(want)] {
+			t.Fatalf("sample %d is %d, want %d", i, got, want[i%len(want)])
+		}
+	}
+	// the peers ran dry, what follows is silence
+	for i := n; 2*i+1 < len(data); i++ {
+		if got := int16(binary.LittleEndian.Uint16(data[2*i:])); got != 0 {
+			t.Fatalf("sample %d after the end is %d", i, got)
+		}
+	}
+}
+
+func TestMixerWaitsForPrebuffer(t *testing.T) {
+	mixer := NewAudioMixer()
+	out := make([]int16, 2*playbackChannels)
+	mixer.Push("peer", repeatFrames(prebufferSamples-1, 1000))
+	mixer.Mix(out)
+	if out[0] != 0 {
+		t.Fatalf("played %d before the prebuffer was full", out[0])
+	}
+	mixer.Push("peer", []int16{1000})
+	mixer.Mix(out)
+	if out[0] != 1000 {
+		t.Fatalf("got %d once the prebuffer was full", out[0])
+	}
+}
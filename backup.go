@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A backup is one file holding the identity, contacts, chats and their
+// history and blobs:
+//
+//	backupMagic
+//	uint32 length, BackupHeader as JSON
+//	uint32 length, sealed chunk    repeated, the last one is marked
+//
+// The chunks carry store entries, key and value each prefixed with their
+// uint32 length. They are sealed with ChaCha20-Poly1305 under a key derived
+// from the backup password; the nonce counts the chunks and marks the last
+// one and the header is authenticated with every chunk, so a changed,
+// reordered or cut off file does not restore.
+//
+// Sessions, sender keys, queues and the search index are left out. A
+// restored node makes new end-to-end keys and its peers start new sessions.
+
+const (
+	backupMagic     = "mobila backup\n"
+	backupVersion   = 1
+	backupChunkSize = 64 << 10
+	// no chunk of ours comes near this
+	maxBackupChunk = 16 << 20
+)
+
+var (
+	ErrBackupCorrupt = errors.New("backup is damaged or was changed")
+	ErrNoBackupKey   = errors.New("backup has no identity key")
+)
+
+// what a backup holds, by key prefix
+var backupPrefixes = []string{
+	nodeKeyPath,
+	"boot:",
+	"contact:",
+	"chat:",
+	"member:",
+	"memberop:",
+	"msg:",
+	"msgid:",
+	"edit:",
+	"tomb:",
+	"rcpt:",
+	"react:",
+	"blob:",
+	"blobchunk:",
+	"blobref:",
+}
+
+type BackupHeader struct {
+	Version int       `json:"version"`
+	Schema  int       `json:"schema"`
+	Created time.Time `json:"created"`
+	Salt    []byte    `json:"salt"`
+	KDF     KDFParams `json:"kdf"`
+}
+
+func (h *BackupHeader) aead(password string) (cipher.AEAD, error) {
+	return chacha20poly1305.New(argon2.IDKey([]byte(password), h.Salt, h.KDF.Time, h.KDF.Memory, h.KDF.Threads, chacha20poly1305.KeySize))
+}
+
+func backupNonce(count uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce, count)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type backupWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	ad    []byte
+	buf   []byte
+	count uint64
+}
+
+func (bw *backupWriter) add(key, value []byte) error {
+	bw.buf = appendField(bw.buf, key)
+	bw.buf = appendField(bw.buf, value)
+	if len(bw.buf) >= backupChunkSize {
+		return bw.flush(false)
+	}
+	return nil
+}
+
+func (bw *backupWriter) flush(last bool) error {
+	sealed := bw.aead.Seal(nil, backupNonce(bw.count, last), bw.buf, bw.ad)
+	if _, err := bw.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(sealed); err != nil {
+		return err
+	}
+	bw.count++
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// ExportBackup writes the profile to w, encrypted with a key derived from
+// password.
+func (s *Store) ExportBackup(w io.Writer, password string) error {
+	if password == "" {
+		return errors.New("a backup needs a password")
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	header := BackupHeader{Version: backupVersion, Schema: version, Created: time.Now(), Salt: make([]byte, 16), KDF: defaultKDF}
+	if _, err := rand.Read(header.Salt); err != nil {
+		return err
+	}
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	ad := append([]byte(backupMagic), headerData...)
+	if _, err := w.Write(appendField([]byte(backupMagic), headerData)); err != nil {
+		return err
+	}
+	aead, err := header.aead(password)
+	if err != nil {
+		return err
+	}
+	bw := &backupWriter{w: w, aead: aead, ad: ad}
+
+	err = s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, prefix := range backupPrefixes {
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if err := bw.add(it.Item().Key(), value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.flush(true)
+}
+
+type backupReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	ad    []byte
+	buf   []byte
+	count uint64
+	done  bool
+}
+
+func newBackupReader(r io.Reader, password string) (*backupReader, *BackupHeader, error) {
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != backupMagic {
+		return nil, nil, fmt.Errorf("not a mobila backup")
+	}
+	headerData, err := readField(r, 1<<16)
+	if err != nil {
+		return nil, nil, ErrBackupCorrupt
+	}
+	var header BackupHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, nil, ErrBackupCorrupt
+	}
+	if header.Version > backupVersion {
+		return nil, nil, fmt.Errorf("backup version %d is newer than this build", header.Version)
+	}
+	if header.Schema > latestSchemaVersion() {
+		return nil, nil, fmt.Errorf("backup schema version %d is newer than this build", header.Schema)
+	}
+	if err := header.KDF.check(); err != nil {
+		return nil, nil, err
+	}
+	aead, err := header.aead(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &backupReader{r: r, aead: aead, ad: append(magic, headerData...)}, &header, nil
+}
+
+func readField(r io.Reader, limit uint32) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > limit {
+		return nil, ErrBackupCorrupt
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func cutField(data []byte) (field, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	size := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(size) {
+		return nil, nil, false
+	}
+	return data[4 : 4+size], data[4+size:], true
+}
+
+// next returns the next entry, valid until the following call, or io.EOF
+// after the last chunk. A wrong password fails on the first chunk.
+func (br *backupReader) next() (key, value []byte, err error) {
+	for len(br.buf) == 0 {
+		if br.done {
+			if _, err := br.r.Read(make([]byte, 1)); err != io.EOF {
+				return nil, nil, ErrBackupCorrupt
+			}
+			return nil, nil, io.EOF
+		}
+		sealed, err := readField(br.r, maxBackupChunk)
+		if err != nil {
+			return nil, nil, ErrBackupCorrupt
+		}
+		br.buf, err = br.aead.Open(nil, backupNonce(br.count, false), sealed, br.ad)
+		if err != nil {
+			br.buf, err = br.aead.Open(nil, backupNonce(br.count, true), sealed, br.ad)
+			br.done = true
+		}
+		if err != nil && br.count == 0 {
+			return nil, nil, ErrWrongPassword
+		} else if err != nil {
+			return nil, nil, ErrBackupCorrupt
+		}
+		br.count++
+	}
+	key, rest, ok := cutField(br.buf)
+	if !ok {
+		return nil, nil, ErrBackupCorrupt
+	}
+	value, rest, ok = cutField(rest)
+	if !ok {
+		return nil, nil, ErrBackupCorrupt
+	}
+	br.buf = rest
+	return key, value, nil
+}
+
+// openBackup reads the whole backup into a scratch store and brings it to
+// the schema of this build. Nothing is merged before the backup checked out
+// to the end. The scratch store is encrypted with a throwaway key.
+func openBackup(r io.Reader, password string) (*Store, error) {
+	br, header, err := newBackupReader(r, password)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "mobila-restore-")
+	if err != nil {
+		return nil, err
+	}
+	opts := badger.DefaultOptions(dir)
+	opts.EncryptionKey = make([]byte, 32)
+	opts.IndexCacheSize = 100 << 20
+	if _, err := rand.Read(opts.EncryptionKey); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	b := &Store{DB: db, Path: dir}
+
+	wb := db.NewWriteBatch()
+	for {
+		key, value, err := br.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			wb.Cancel()
+			b.discard()
+			return nil, err
+		}
+		if err := wb.Set(bytes.Clone(key), bytes.Clone(value)); err != nil {
+			wb.Cancel()
+			b.discard()
+			return nil, err
+		}
+	}
+	err = wb.Flush()
+	if err == nil {
+		err = b.update(func(txn *badger.Txn) error { return setSchemaVersion(txn, header.Schema) })
+	}
+	if err == nil {
+		err = b.runMigrations(header.Schema)
+	}
+	if err != nil {
+		b.discard()
+		return nil, err
+	}
+	return b, nil
+}
+
+// discard closes and removes a scratch store.
+func (s *Store) discard() {
+	s.DB.Close()
+	os.RemoveAll(s.Path)
+}
+
+// RestoreConflict decides what stays where the profile and the backup
+// disagree. History is merged either way.
+type RestoreConflict int
+
+const (
+	// KeepProfile keeps the identity, aliases and chat names of the profile
+	KeepProfile RestoreConflict = iota
+	// TakeBackup replaces them with those of the backup
+	TakeBackup
+)
+
+// RestoreStats counts what a restore added to the profile.
+type RestoreStats struct {
+	Contacts int
+	Chats    int
+	Messages int
+	Blobs    int
+}
+
+// RestoreBackup merges the backup read from r into the store, which may be
+// fresh or hold a profile already.
+func (s *Store) RestoreBackup(r io.Reader, password string, conflict RestoreConflict) (*RestoreStats, error) {
+	b, err := openBackup(r, password)
+	if err != nil {
+		return nil, err
+	}
+	defer b.discard()
+
+	stats := &RestoreStats{}
+	ownID, err := s.restoreIdentity(b, conflict)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := b.LoadBootstrapPeers()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range peers {
+		if err := s.SaveBootstrapPeer(info); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.restoreContacts(b, conflict, stats); err != nil {
+		return nil, err
+	}
+	if err := s.restoreChats(b, ownID, conflict, stats); err != nil {
+		return nil, err
+	}
+	if err := s.restoreMessages(b, stats); err != nil {
+		return nil, err
+	}
+	if err := s.restoreBlobs(b, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// restoreIdentity returns the peer ID the profile has afterwards.
+func (s *Store) restoreIdentity(b *Store, conflict RestoreConflict) (string, error) {
+	theirs, err := b.LoadPrivateKey()
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", ErrNoBackupKey
+	} else if err != nil {
+		return "", err
+	}
+	ours, err := s.LoadPrivateKey()
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+		err = s.SavePrivateKey(theirs)
+	case err != nil:
+		return "", err
+	case !ours.Equals(theirs) && conflict == TakeBackup:
+		fmt.Println("restore replaces the identity of the profile")
+		// the end-to-end keys were signed by the old identity
+		err = s.SavePrivateKey(theirs)
+		if err == nil {
+			err = s.update(func(txn *badger.Txn) error { return txn.Delete([]byte(e2eIdentityPath)) })
+		}
+		if err == nil {
+			err = s.deletePrefix([]byte("e2e:"))
+		}
+		if err == nil {
+			err = s.deletePrefix([]byte("skey:"))
+		}
+	default:
+		theirs = ours
+	}
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.IDFromPrivateKey(theirs)
+	return id.String(), err
+}
+
+func (s *Store) restoreContacts(b *Store, conflict RestoreConflict, stats *RestoreStats) error {
+	ours, err := s.GetAllContacts()
+	if err != nil {
+		return err
+	}
+	theirs, err := b.GetAllContacts()
+	if err != nil {
+		return err
+	}
+	for id, c := range theirs {
+		if old, ok := ours[id]; ok {
+			for _, a := range old.Addresses {
+				if !slices.Contains(c.Addresses, a) {
+					c.Addresses = append(c.Addresses, a)
+				}
+			}
+			c.LastSeen = max(c.LastSeen, old.LastSeen)
+			c.Mailbox = c.Mailbox || old.Mailbox
+			if conflict == KeepProfile && old.Alias != "" {
+				c.Alias = old.Alias
+			}
+		} else {
+			stats.Contacts++
+		}
+		if err := s.AddContact(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) restoreChats(b *Store, ownID string, conflict RestoreConflict, stats *RestoreStats) error {
+	ourChats, err := s.GetChatList()
+	if err != nil {
+		return err
+	}
+	ours := make(map[string]Chat)
+	for _, c := range ourChats {
+		ours[c.ID] = c
+	}
+	theirs, err := b.GetChatList()
+	if err != nil {
+		return err
+	}
+	for _, c := range theirs {
+		added, err := s.restoreMembershipLog(b, c.ID)
+		if err != nil {
+			return err
+		}
+		old, exists := ours[c.ID]
+		switch {
+		case !exists:
+			stats.Chats++
+			if err := s.createChatHeader(c); err != nil {
+				return err
+			}
+			for _, p := range c.Peers {
+				if role := c.Roles[p]; role != RoleNone {
+					err = s.SetChatMemberRole(c.ID, p, role)
+				} else {
+					err = s.AddChatMember(c.ID, p)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			// invited peers are not among the peers yet
+			for p, role := range c.Roles {
+				if role == RoleInvited {
+					if err := s.SetChatMemberRole(c.ID, p, role); err != nil {
+						return err
+					}
+				}
+			}
+		case c.Group && added > 0:
+			if err := s.replayChatMembership(c.ID, ownID); err != nil {
+				return err
+			}
+		case !c.Group && conflict == TakeBackup && c.Name != old.Name:
+			old.Name = c.Name
+			if err := s.createChatHeader(old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreMembershipLog adds the membership changes we do not have yet.
+func (s *Store) restoreMembershipLog(b *Store, chatID string) (int, error) {
+	ours, err := s.GetMembershipChanges(chatID)
+	if err != nil {
+		return 0, err
+	}
+	theirs, err := b.GetMembershipChanges(chatID)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, c := range theirs {
+		if slices.ContainsFunc(ours, func(o MembershipChange) bool { return o.ID == c.ID }) {
+			continue
+		}
+		if err := s.AddMembershipChange(c); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// replayChatMembership rewrites the header and members of a group chat from
+// its membership log, as applyMembership does on a running node.
+func (s *Store) replayChatMembership(chatID, ownID string) error {
+	changes, err := s.GetMembershipChanges(chatID)
+	if err != nil {
+		return err
+	}
+	m := ReplayMembership(changes)
+	chat := Chat{
+		ID:      chatID,
+		Name:    m.Name,
+		Group:   true,
+		Pending: m.Members[ownID] == RoleInvited,
+		Left:    m.Members[ownID] == RoleNone,
+	}
+	if err := s.createChatHeader(chat); err != nil {
+		return err
+	}
+	if err := s.deletePrefix([]byte("member:" + chatID + ":")); err != nil {
+		return err
+	}
+	for p, role := range m.Members {
+		if role == RoleNone {
+			continue
+		}
+		if err := s.SetChatMemberRole(chatID, p, role); err != nil {
+			return err
+		}
+	}
+	// members that came with the backup never got our sender key
+	return s.DeleteOwnSenderKey(chatID)
+}
+
+// restoreMessages adds the messages and what belongs to them. Tombstones
+// win over messages and receipts and reactions merge as when they arrive.
+func (s *Store) restoreMessages(b *Store, stats *RestoreStats) error {
+	return b.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("msg:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			chatID, _, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), ":")
+			m, err := decodeMessage(it.Item(), messagePrefix(chatID), chatID)
+			if err != nil {
+				fmt.Printf("error reading message %s from backup: %v\n", it.Item().Key(), err)
+				continue
+			}
+			added, err := s.restoreMessage(m)
+			if err != nil {
+				return err
+			}
+			if added {
+				stats.Messages++
+			}
+		}
+
+		for _, prefix := range [][]byte{[]byte("edit:"), []byte("tomb:")} {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				var e MessageEdit
+				if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+					return err
+				}
+				if err := s.restoreMessageEdit(e); err != nil {
+					return err
+				}
+			}
+		}
+
+		prefix = []byte("rcpt:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			parts := strings.Split(string(it.Item().Key()[len(prefix):]), ":")
+			if len(parts) != 3 {
+				continue
+			}
+			var r Receipt
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &r) }); err != nil {
+				return err
+			}
+			if _, err := s.SetReceipt(parts[0], parts[1], parts[2], r); err != nil {
+				return err
+			}
+		}
+
+		prefix = []byte("react:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			rs := make(Reactions)
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &rs) }); err != nil {
+				return err
+			}
+			for _, authors := range rs {
+				for _, r := range authors {
+					if _, err := s.AddReaction(r); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) restoreMessage(m Message) (bool, error) {
+	old, err := s.GetMessage(m.ChatID, m.ID)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case old == nil:
+		if tomb, err := s.GetTombstone(m.ChatID, m.ID); err != nil {
+			return false, err
+		} else if tomb != nil && tomb.Author == m.Author && !m.Deleted {
+			m = m.tombstone()
+		}
+		return true, s.AddMessage(m)
+	case m.Deleted && !old.Deleted:
+		return false, s.deleteMessage(old)
+	}
+	return false, nil
+}
+
+func (s *Store) restoreMessageEdit(e MessageEdit) error {
+	if e.Delete {
+		if tomb, err := s.GetTombstone(e.ChatID, e.MessageID); err != nil || tomb != nil {
+			return err
+		}
+	} else if edits, err := s.GetMessageEdits(e.ChatID, e.MessageID); err != nil {
+		return err
+	} else if slices.ContainsFunc(edits, func(o MessageEdit) bool { return o.ID == e.ID }) {
+		return nil
+	}
+	if err := s.AddMessageEdit(e); err != nil {
+		return err
+	}
+	if !e.Delete {
+		return nil
+	}
+	target, err := s.GetMessage(e.ChatID, e.MessageID)
+	if err != nil || target == nil || target.Deleted || target.Author != e.Author {
+		return err
+	}
+	return s.deleteMessage(target)
+}
+
+// deleteMessage puts the tombstone of m in its place.
+func (s *Store) deleteMessage(m *Message) error {
+	if err := s.AddMessage(m.tombstone()); err != nil {
+		return err
+	}
+	if m.Attachment != nil {
+		return s.RemoveBlobRef(m.Attachment.Hash, m.ChatID, m.ID)
+	}
+	return nil
+}
+
+// restoreBlobs copies the blobs the profile is missing or has not finished
+// fetching.
+func (s *Store) restoreBlobs(b *Store, stats *RestoreStats) error {
+	infos, err := b.getBlobInfos()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		ours, err := s.LoadBlobInfo(info.Hash)
+		if err != nil {
+			return err
+		}
+		if ours != nil && (ours.Complete || !info.Complete) {
+			continue
+		}
+		copied := 0
+		for i := 0; i < info.Chunks(); i++ {
+			data, err := b.LoadBlobChunk(info.Hash, i)
+			if err != nil {
+				continue
+			}
+			if err := s.SaveBlobChunk(info.Hash, i, data); err != nil {
+				return err
+			}
+			copied++
+		}
+		info.Complete = copied == info.Chunks()
+		info.Received = copied
+		if info.Complete {
+			// the backup holds whatever the old profile had, check the
+			// chunks as completeBlob does and keep the blob pending if wrong
+			if err := s.VerifyBlob(&info); err != nil {
+				fmt.Printf("blob %x from the backup dropped: %v\n", info.Hash, err)
+				info.Complete = false
+				if err := s.DeleteBlobChunks(info.Hash); err != nil {
+					return err
+				}
+			} else {
+				stats.Blobs++
+			}
+			info.Received = 0
+		}
+		if err := s.SaveBlobInfo(&info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const backupPassword = "correct horse battery staple"
+
+// newProfileStore makes a store at the latest schema with a fresh identity.
+func newProfileStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	s := newTestStore(t)
+	if err := s.update(func(txn *badger.Txn) error { return setSchemaVersion(txn, latestSchemaVersion()) }); err != nil {
+		t.Fatal(err)
+	}
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePrivateKey(priv); err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, id.String()
+}
+
+// addChat stores a direct chat with the contact and n messages of its own.
+func addChat(t *testing.T, s *Store, chatID, name string, contact Contact, n int, tag string) []string {
+	t.Helper()
+	if err := s.AddContact(contact); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateNewChat(Chat{ID: chatID, Name: name, Peers: []string{contact.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	prev := ""
+	sent := time.Unix(1700000000, 0)
+	for i := range n {
+		m := Message{ID: fmt.Sprintf("%s-%d", tag, i), Prev: prev, ChatID: chatID, Author: contact.ID,
+			Text: fmt.Sprintf("%s %d %s", tag, i, strings.Repeat("x", 1000)), Sent: sent.Add(time.Duration(i) * time.Second)}
+		if err := s.AddMessage(m); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.ID)
+		prev = m.ID
+	}
+	return ids
+}
+
+func exportBackup(t *testing.T, s *Store) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := s.ExportBackup(&buf, backupPassword); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// backupChunks splits a backup into what comes before the chunks and the
+// chunks with their length prefix.
+func backupChunks(t *testing.T, data []byte) ([]byte, [][]byte) {
+	t.Helper()
+	n := len(backupMagic) + 4 + int(binary.BigEndian.Uint32(data[len(backupMagic):]))
+	head, rest := data[:n], data[n:]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		size := 4 + int(binary.BigEndian.Uint32(rest))
+		chunks = append(chunks, rest[:size])
+		rest = rest[size:]
+	}
+	return head, chunks
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src, _ := newProfileStore(t)
+	contact := Contact{ID: "12D3KooWfriend", Alias: "Friend"}
+	ids := addChat(t, src, "chat", "Friend", contact, 200, "m")
+	data := exportBackup(t, src)
+
+	dst := newTestStore(t)
+	stats, err := dst.RestoreBackup(bytes.NewReader(data), backupPassword, KeepProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Contacts != 1 || stats.Chats != 1 || stats.Messages != len(ids) {
+		t.Errorf("stats %+v", stats)
+	}
+	for _, id := range ids {
+		if m, err := dst.GetMessage("chat", id); err != nil || m == nil {
+			t.Fatalf("message %s not restored: %v", id, err)
+		}
+	}
+
+	// restoring again adds nothing
+	stats, err = dst.RestoreBackup(bytes.NewReader(data), backupPassword, KeepProfile)
+	if err != nil || stats.Contacts != 0 || stats.Chats != 0 || stats.Messages != 0 {
+		t.Errorf("second restore: %+v, %v", stats, err)
+	}
+}
+
+func TestBackupRefusesChanges(t *testing.T) {
+	src, _ := newProfileStore(t)
+	addChat(t, src, "chat", "Friend", Contact{ID: "12D3KooWfriend"}, 200, "m")
+	data := exportBackup(t, src)
+	head, chunks := backupChunks(t, data)
+	if len(chunks) < 3 {
+		t.Fatalf("backup has %d chunks, want a few", len(chunks))
+	}
+
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(append([][]byte{head}, chunks...), nil)
+	}
+	cases := []struct {
+		name     string
+		data     []byte
+		password string
+		want     error
+	}{
+		{"wrong password", data, "wrong", ErrWrongPassword},
+		{"last chunk cut off", join(chunks[:len(chunks)-1]...), backupPassword, ErrBackupCorrupt},
+		{"chunk cut short", data[:len(data)-10], backupPassword, ErrBackupCorrupt},
+		{"chunks swapped", join(append([][]byte{chunks[0], chunks[2], chunks[1]}, chunks[3:]...)...), backupPassword, ErrBackupCorrupt},
+		{"chunk changed", func() []byte {
+			changed := bytes.Clone(data)
+			changed[len(head)+len(chunks[0])+10] ^= 1
+			return changed
+		}(), backupPassword, ErrBackupCorrupt},
+		{"trailing data", append(bytes.Clone(data), chunks[1]...), backupPassword, ErrBackupCorrupt},
+	}
+	for _, c := range cases {
+		dst := newTestStore(t)
+		if _, err := dst.RestoreBackup(bytes.NewReader(c.data), c.password, KeepProfile); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		// nothing is merged from a backup that does not check out
+		if chats, err := dst.GetChatList(); err != nil || len(chats) != 0 {
+			t.Errorf("%s: chats %v restored, %v", c.name, chats, err)
+		}
+	}
+}
+
+func TestBackupMergesIntoProfile(t *testing.T) {
+	src, srcID := newProfileStore(t)
+	theirs := addChat(t, src, "chat", "Friend", Contact{ID: "12D3KooWfriend", Alias: "Friend"}, 3, "backup")
+	data := exportBackup(t, src)
+
+	for _, conflict := range []RestoreConflict{KeepProfile, TakeBackup} {
+		dst, dstID := newProfileStore(t)
+		ours := addChat(t, dst, "chat", "Buddy", Contact{ID: "12D3KooWfriend", Alias: "Buddy"}, 2, "profile")
+		stats, err := dst.RestoreBackup(bytes.NewReader(data), backupPassword, conflict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Contacts != 0 || stats.Chats != 0 || stats.Messages != len(theirs) {
+			t.Errorf("%d: stats %+v", conflict, stats)
+		}
+		// history is merged either way
+		for _, id := range append(ours, theirs...) {
+			if m, err := dst.GetMessage("chat", id); err != nil || m == nil {
+				t.Errorf("%d: message %s missing: %v", conflict, id, err)
+			}
+		}
+
+		wantID, wantName := dstID, "Buddy"
+		if conflict == TakeBackup {
+			wantID, wantName = srcID, "Friend"
+		}
+		priv, err := dst.LoadPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := peer.IDFromPrivateKey(priv); err != nil || id.String() != wantID {
+			t.Errorf("%d: identity %s, want %s", conflict, id, wantID)
+		}
+		contacts, err := dst.GetAllContacts()
+		if err != nil || contacts["12D3KooWfriend"].Alias != wantName {
+			t.Errorf("%d: contacts %v, %v", conflict, contacts, err)
+		}
+		chats, err := dst.GetChatList()
+		if err != nil || len(chats) != 1 || chats[0].Name != wantName {
+			t.Errorf("%d: chats %v, %v", conflict, chats, err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Blobs are large contents kept apart from messages, addressed by their
+// sha256 so the same file is stored once however many messages carry it.
+//
+//	blob:<hash>                    BlobInfo
+//	blobchunk:<hash>:<index>       sha256 of the chunk followed by the chunk
+//	blobref:<hash>:<chat>:<msg>    one per message carrying the blob
+//	blobtmp:<id>:<index>           chunks PutBlob wrote before the hash was known
+//
+// Blobs without references are removed by CollectBlobs.
+
+const (
+	// unreferenced blobs younger than this are kept, their message may be on its way
+	blobGracePeriod = time.Hour
+	// chunks PutBlob moves per transaction
+	blobMoveBatch = 256
+)
+
+var errBlobTooLarge = errors.New("blob is too large")
+
+// BlobInfo describes a stored blob. Incomplete ones are still being fetched
+// from Sources.
+type BlobInfo struct {
+	Hash      []byte    `json:"hash"`
+	Size      int64     `json:"size"`
+	ChunkSize int       `json:"chunk_size"`
+	Complete  bool      `json:"complete"`
+	Stored    time.Time `json:"stored"`
+	ChatID    string    `json:"chat_id,omitempty"`
+	Sources   []string  `json:"sources,omitempty"`
+	// Received counts the stored chunks of an incomplete blob
+	Received int `json:"received,omitempty"`
+}
+
+func (b *BlobInfo) Chunks() int {
+	return int((b.Size + int64(b.ChunkSize) - 1) / int64(b.ChunkSize))
+}
+
+// chunkLen is the length chunk index must have.
+func (b *BlobInfo) chunkLen(index int) int {
+	if index == b.Chunks()-1 {
+		return int(b.Size - int64(index)*int64(b.ChunkSize))
+	}
+	return b.ChunkSize
+}
+
+func blobInfoKey(hash []byte) []byte {
+	return []byte("blob:" + hex.EncodeToString(hash))
+}
+
+func blobChunkKey(hash []byte, index int) []byte {
+	return fmt.Appendf(nil, "blobchunk:%x:%08d", hash, index)
+}
+
+func blobRefKey(hash []byte, chatID, msgID string) []byte {
+	return fmt.Appendf(nil, "blobref:%x:%s:%s", hash, chatID, msgID)
+}
+
+// PutBlob stores what r holds, at most limit bytes, unless a complete blob
+// with the same content exists. The chunks are written under a temporary ID
+// while the hash is being computed and moved under the hash at the end.
+// Either way the blob counts as just stored, so CollectBlobs leaves it alone
+// until its message refers to it.
+func (s *Store) PutBlob(r io.Reader, chunkSize int, limit int64) (*BlobInfo, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	prefix := fmt.Appendf(nil, "blobtmp:%x:", id)
+	// whatever is left after an error; CollectBlobs drops it after a crash
+	defer s.deletePrefix(prefix)
+
+	h := sha256.New()
+	buf := make([]byte, chunkSize)
+	var size int64
+	chunks := 0
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if size += int64(n); size > limit {
+				return nil, errBlobTooLarge
+			}
+			h.Write(buf[:n])
+			key := fmt.Appendf(slices.Clip(prefix), "%08d", chunks)
+			err := s.update(func(txn *badger.Txn) error {
+				return txn.Set(key, chunkValue(buf[:n]))
+			})
+			if err != nil {
+				return nil, err
+			}
+			chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := s.LoadBlobInfo(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && info.Complete {
+		info.Stored = time.Now()
+		return info, s.SaveBlobInfo(info)
+	}
+	info = &BlobInfo{Hash: h.Sum(nil), Size: size, ChunkSize: chunkSize, Complete: true}
+	if err := s.moveBlobChunks(prefix, info.Hash, chunks); err != nil {
+		return nil, err
+	}
+	return info, s.SaveBlobInfo(info)
+}
+
+// moveBlobChunks puts the chunks PutBlob wrote under prefix in their place.
+func (s *Store) moveBlobChunks(prefix, hash []byte, chunks int) error {
+	for start := 0; start < chunks; start += blobMoveBatch {
+		err := s.update(func(txn *badger.Txn) error {
+			for i := start; i < min(chunks, start+blobMoveBatch); i++ {
+				key := fmt.Appendf(slices.Clip(prefix), "%08d", i)
+				item, err := txn.Get(key)
+				if err != nil {
+					return err
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(blobChunkKey(hash, i), value); err != nil {
+					return err
+				}
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) SaveBlobInfo(info *BlobInfo) error {
+	if info.Stored.IsZero() {
+		info.Stored = time.Now()
+	}
+	return s.setJSON(string(blobInfoKey(info.Hash)), info)
+}
+
+func (s *Store) LoadBlobInfo(hash []byte) (*BlobInfo, error) {
+	var info BlobInfo
+	found, err := s.getJSON(string(blobInfoKey(hash)), &info)
+	if !found {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s *Store) getBlobInfos() ([]BlobInfo, error) {
+	var infos []BlobInfo
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("blob:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var info BlobInfo
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &info) }); err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// GetPendingBlobs returns the blobs that are still being fetched.
+func (s *Store) GetPendingBlobs() ([]BlobInfo, error) {
+	infos, err := s.getBlobInfos()
+	var pending []BlobInfo
+	for _, info := range infos {
+		if !info.Complete {
+			pending = append(pending, info)
+		}
+	}
+	return pending, err
+}
+
+// chunkValue is how a chunk is stored: its sha256 followed by the chunk.
+func chunkValue(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return append(sum[:], data...)
+}
+
+func (s *Store) SaveBlobChunk(hash []byte, index int, data []byte) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set(blobChunkKey(hash, index), chunkValue(data))
+	})
+}
+
+// LoadBlobChunk returns a chunk after checking it against the hash it was
+// stored with.
+func (s *Store) LoadBlobChunk(hash []byte, index int) ([]byte, error) {
+	var data []byte
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(blobChunkKey(hash, index))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, fmt.Errorf("chunk %d of blob %x is corrupt", index, hash)
+	}
+	sum := sha256.Sum256(data[sha256.Size:])
+	if !bytes.Equal(sum[:], data[:sha256.Size]) {
+		return nil, fmt.Errorf("chunk %d of blob %x is corrupt", index, hash)
+	}
+	return data[sha256.Size:], nil
+}
+
+// MissingBlobChunks lists the chunk indices below count that are not stored.
+func (s *Store) MissingBlobChunks(hash []byte, count int) ([]int, error) {
+	have := make(map[int]bool)
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := fmt.Appendf(nil, "blobchunk:%x:", hash)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			index, err := strconv.Atoi(string(it.Item().Key()[len(prefix):]))
+			if err == nil {
+				have[index] = true
+			}
+		}
+		return nil
+	})
+	var missing []int
+	for i := 0; i < count; i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing, err
+}
+
+func (s *Store) DeleteBlobChunks(hash []byte) error {
+	return s.deletePrefix(fmt.Appendf(nil, "blobchunk:%x:", hash))
+}
+
+// ReadBlob writes the content of a complete blob to w. Every chunk is checked
+// before it is written and the whole content against the blob hash.
+func (s *Store) ReadBlob(hash []byte, w io.Writer) error {
+	info, err := s.LoadBlobInfo(hash)
+	if err != nil {
+		return err
+	}
+	if info == nil || !info.Complete {
+		return fmt.Errorf("blob %x is not complete", hash)
+	}
+	return s.readChunks(info, w)
+}
+
+// VerifyBlob checks that the stored chunks add up to the blob hash.
+func (s *Store) VerifyBlob(info *BlobInfo) error {
+	return s.readChunks(info, io.Discard)
+}
+
+func (s *Store) readChunks(info *BlobInfo, w io.Writer) error {
+	h := sha256.New()
+	for i := 0; i < info.Chunks(); i++ {
+		chunk, err := s.LoadBlobChunk(info.Hash, i)
+		if err != nil {
+			return err
+		}
+		if len(chunk) != info.chunkLen(i) {
+			return fmt.Errorf("chunk %d of blob %x has the wrong length", i, info.Hash)
+		}
+		h.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(h.Sum(nil), info.Hash) {
+		return fmt.Errorf("blob %x does not match its hash", info.Hash)
+	}
+	return nil
+}
+
+// HasBlobRef tells whether a message of the chat carries the blob.
+func (s *Store) HasBlobRef(hash []byte, chatID string) bool {
+	return s.countPrefix(fmt.Appendf(nil, "blobref:%x:%s:", hash, chatID), 1) > 0
+}
+
+// BlobRefCount returns how many messages carry the blob.
+func (s *Store) BlobRefCount(hash []byte) int {
+	return s.countPrefix(fmt.Appendf(nil, "blobref:%x:", hash), -1)
+}
+
+func (s *Store) RemoveBlobRef(hash []byte, chatID, msgID string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete(blobRefKey(hash, chatID, msgID))
+	})
+}
+
+// countPrefix counts the keys with prefix, stopping at limit unless it is negative.
+func (s *Store) countPrefix(prefix []byte, limit int) int {
+	n := 0
+	s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && n != limit; it.Next() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// CollectBlobs deletes the blobs no message refers to any more, complete or
+// not, and returns how many went.
+func (s *Store) CollectBlobs(now time.Time) (int, error) {
+	// PutBlob holds the lock while it has chunks under a temporary ID, what
+	// is there now was left by one that never finished
+	s.blobMu.Lock()
+	err := s.deletePrefix([]byte("blobtmp:"))
+	s.blobMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	infos, err := s.getBlobInfos()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range infos {
+		collected, err := s.collectBlob(infos[i].Hash, now)
+		if err != nil {
+			return n, err
+		}
+		if collected {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// collectBlob deletes the blob if it is unreferenced and past the grace
+// period. The check and the removal of its info are one transaction, the
+// chunks only go once that has committed.
+func (s *Store) collectBlob(hash []byte, now time.Time) (bool, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	collected := false
+	err := s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(blobInfoKey(hash))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var info BlobInfo
+		if err := item.Value(func(v []byte) error { return json.Unmarshal(v, &info) }); err != nil {
+			return err
+		}
+		if now.Sub(info.Stored) < blobGracePeriod {
+			return nil
+		}
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		prefix := fmt.Appendf(nil, "blobref:%x:", hash)
+		it.Seek(prefix)
+		referenced := it.ValidForPrefix(prefix)
+		it.Close()
+		if referenced {
+			return nil
+		}
+		collected = true
+		return txn.Delete(blobInfoKey(hash))
+	})
+	if err == badger.ErrConflict {
+		// the info was saved meanwhile, the next run looks again
+		return false, nil
+	}
+	if err != nil || !collected {
+		return false, err
+	}
+	return true, s.DeleteBlobChunks(hash)
+}
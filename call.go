@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"github.com/google/uuid"
+)
+
+const ringTimeout = 30 * time.Second
+
+type CallState int
+
+const (
+	CallIdle CallState = iota
+	CallRingingOut
+	CallRingingIn
+	CallConnected
+	CallEnded
+)
+
+func (cs CallState) String() string {
+	switch cs {
+	case CallIdle:
+		return "idle"
+	case CallRingingOut:
+		return "ringing"
+	case CallRingingIn:
+		return "incoming call"
+	case CallConnected:
+		return "connected"
+	case CallEnded:
+		return "ended"
+	}
+	return fmt.Sprintf("CallState(%d)", int(cs))
+}
+
+// Call is the single call this node takes part in. Members of the chat are
+// invited; OutgoingStreams only ever holds peers of the current call that
+// asked for our stream with ENTER.
+type Call struct {
+	ID     string
+	ChatID string
+	State  CallState
+	// From is the inviter of an incoming call
+	From string
+	// Reason tells why the call ended
+	Reason string
+
+	pending map[string]bool
+	joined  map[string]bool
+	timer   *time.Timer
+}
+
+func (c *Call) snapshot() Call {
+	return Call{ID: c.ID, ChatID: c.ChatID, State: c.State, From: c.From, Reason: c.Reason}
+}
+
+func (s *State) notifyCall(call Call) {
+	fyne.Do(func() {
+		if s.OnCallChanged != nil {
+			s.OnCallChanged(call)
+		}
+	})
+}
+
+func (s *State) sendCallSignal(peerID string, kind pb.CallSignal_Kind, chatID, callID string) {
+	err := s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_CallSignal{
+		CallSignal: &pb.CallSignal{Kind: kind, ChatId: chatID, CallId: callID},
+	}})
+	if err != nil {
+		fmt.Printf("error sending call signal %v to %s: %v\n", kind, peerID, err)
+	}
+}
+
+// StartCall rings every other member of the chat.
+func (s *State) StartCall(chatID string) error {
+	ownID := s.Node.Host.ID().String()
+	members := s.chatMembers(chatID)
+	if members == nil {
+		return fmt.Errorf("unknown chat %s", chatID)
+	}
+
+	s.callMu.Lock()
+	if s.Call != nil {
+		s.callMu.Unlock()
+		return fmt.Errorf("already in a call")
+	}
+	call := &Call{
+		ID:      uuid.NewString(),
+		ChatID:  chatID,
+		State:   CallRingingOut,
+		pending: make(map[string]bool),
+		joined:  make(map[string]bool),
+	}
+	for _, peerID := range members {
+		if peerID != ownID {
+			call.pending[peerID] = true
+		}
+	}
+	call.timer = time.AfterFunc(ringTimeout, func() { s.ringTimedOut(call.ID) })
+	s.Call = call
+	snap := call.snapshot()
+	s.callMu.Unlock()
+
+	for peerID := range call.pending {
+		s.sendCallSignal(peerID, pb.CallSignal_INVITE, chatID, call.ID)
+	}
+	s.notifyCall(snap)
+	return nil
+}
+
+// AcceptCall answers the ringing incoming call.
+func (s *State) AcceptCall() error {
+	s.callMu.Lock()
+	call := s.Call
+	if call == nil || call.State != CallRingingIn {
+		s.callMu.Unlock()
+		return fmt.Errorf("no incoming call")
+	}
+	call.timer.Stop()
+	call.State = CallConnected
+	call.joined[call.From] = true
+	snap := call.snapshot()
+	s.callMu.Unlock()
+
+	// everyone in the chat learns we are in, whoever else already joined
+	ownID := s.Node.Host.ID().String()
+	for _, peerID := range s.chatMembers(call.ChatID) {
+		if peerID != ownID {
+			s.sendCallSignal(peerID, pb.CallSignal_ACCEPT, call.ChatID, call.ID)
+		}
+	}
+	s.notifyCall(snap)
+	return nil
+}
+
+func (s *State) DeclineCall() {
+	s.callMu.Lock()
+	call := s.Call
+	if call == nil || call.State != CallRingingIn {
+		s.callMu.Unlock()
+		return
+	}
+	snap := s.endCallLocked("declined")
+	s.callMu.Unlock()
+
+	s.sendCallSignal(call.From, pb.CallSignal_DECLINE, call.ChatID, call.ID)
+	s.notifyCall(snap)
+}
+
+// HangUp cancels an outgoing call or leaves a connected one.
+func (s *State) HangUp() {
+	s.callMu.Lock()
+	call := s.Call
+	if call == nil {
+		s.callMu.Unlock()
+		return
+	}
+	kind := pb.CallSignal_HANGUP
+	var peers []string
+	switch call.State {
+	case CallRingingOut:
+		kind = pb.CallSignal_CANCEL
+		for peerID := range call.pending {
+			peers = append(peers, peerID)
+		}
+	case CallRingingIn:
+		kind = pb.CallSignal_DECLINE
+		peers = []string{call.From}
+	}
+	for peerID := range call.joined {
+		peers = append(peers, peerID)
+	}
+	snap := s.endCallLocked("hung up")
+	s.callMu.Unlock()
+
+	for _, peerID := range peers {
+		s.sendCallSignal(peerID, kind, call.ChatID, call.ID)
+	}
+	s.notifyCall(snap)
+}
+
+// endCallLocked moves the call to CallEnded and back to idle. callMu must be held.
+func (s *State) endCallLocked(reason string) Call {
+	call := s.Call
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+	call.State = CallEnded
+	call.Reason = reason
+	s.Call = nil
+
+	s.mu.Lock()
+	clear(s.OutgoingStreams)
+	s.mu.Unlock()
+	return call.snapshot()
+}
+
+func (s *State) ringTimedOut(callID string) {
+	s.callMu.Lock()
+	call := s.Call
+	if call == nil || call.ID != callID || (call.State != CallRingingOut && call.State != CallRingingIn) {
+		s.callMu.Unlock()
+		return
+	}
+	var peers []string
+	if call.State == CallRingingOut {
+		for peerID := range call.pending {
+			peers = append(peers, peerID)
+		}
+	}
+	snap := s.endCallLocked("no answer")
+	s.callMu.Unlock()
+
+	for _, peerID := range peers {
+		s.sendCallSignal(peerID, pb.CallSignal_CANCEL, call.ChatID, call.ID)
+	}
+	s.notifyCall(snap)
+}
+
+func (s *State) receiveCallSignal(peerID string, sig *pb.CallSignal) {
+	if !slices.Contains(s.chatMembers(sig.ChatId), peerID) {
+		fmt.Printf("call signal for chat %s from non-member %s ignored\n", sig.ChatId, peerID)
+		return
+	}
+
+	s.callMu.Lock()
+	call := s.Call
+	if sig.Kind == pb.CallSignal_INVITE {
+		switch {
+		case call == nil:
+			call = &Call{
+				ID:      sig.CallId,
+				ChatID:  sig.ChatId,
+				State:   CallRingingIn,
+				From:    peerID,
+				pending: make(map[string]bool),
+				joined:  make(map[string]bool),
+			}
+			call.timer = time.AfterFunc(ringTimeout, func() { s.ringTimedOut(call.ID) })
+			s.Call = call
+			snap := call.snapshot()
+			s.callMu.Unlock()
+			s.notifyCall(snap)
+		case call.ChatID == sig.ChatId && call.State != CallRingingIn:
+			// both called each other at once or we are already talking in this chat
+			delete(call.pending, peerID)
+			call.joined[peerID] = true
+			call.State = CallConnected
+			call.timer.Stop()
+			snap := call.snapshot()
+			s.callMu.Unlock()
+			s.sendCallSignal(peerID, pb.CallSignal_ACCEPT, sig.ChatId, call.ID)
+			s.RequestStream(peerID)
+			s.notifyCall(snap)
+		default:
+			s.callMu.Unlock()
+			s.sendCallSignal(peerID, pb.CallSignal_BUSY, sig.ChatId, sig.CallId)
+		}
+		return
+	}
+
+	if call == nil || call.ChatID != sig.ChatId {
+		s.callMu.Unlock()
+		return
+	}
+	switch sig.Kind {
+	case pb.CallSignal_ACCEPT:
+		if call.State == CallRingingIn {
+			// someone else joined the call we are still being rung for
+			call.joined[peerID] = true
+			s.callMu.Unlock()
+			return
+		}
+		delete(call.pending, peerID)
+		call.joined[peerID] = true
+		call.State = CallConnected
+		call.timer.Stop()
+		snap := call.snapshot()
+		s.callMu.Unlock()
+		s.RequestStream(peerID)
+		s.notifyCall(snap)
+	case pb.CallSignal_DECLINE, pb.CallSignal_BUSY:
+		delete(call.pending, peerID)
+		if call.State == CallRingingOut && len(call.pending) == 0 {
+			reason := "declined"
+			if sig.Kind == pb.CallSignal_BUSY {
+				reason = "busy"
+			}
+			snap := s.endCallLocked(reason)
+			s.callMu.Unlock()
+			s.notifyCall(snap)
+			return
+		}
+		s.callMu.Unlock()
+	case pb.CallSignal_CANCEL:
+		if call.State == CallRingingIn && call.From == peerID {
+			snap := s.endCallLocked("missed")
+			s.callMu.Unlock()
+			s.notifyCall(snap)
+			return
+		}
+		s.callMu.Unlock()
+	case pb.CallSignal_HANGUP:
+		delete(call.joined, peerID)
+		s.mu.Lock()
+		delete(s.OutgoingStreams, peerID)
+		s.mu.Unlock()
+		// also when the call ends with it, the stream would be left open
+		s.dropIncomingStream(peerID)
+		if call.State == CallConnected && len(call.joined) == 0 {
+			snap := s.endCallLocked("everyone left")
+			s.callMu.Unlock()
+			s.notifyCall(snap)
+			return
+		}
+		s.callMu.Unlock()
+	default:
+		s.callMu.Unlock()
+	}
+}
+
+// receiveStreamResponse adds or removes a peer of the current call from the
+// receivers of our stream.
+func (s *State) receiveStreamResponse(peerID string, resp *pb.StreamInfoResponse) {
+	s.callMu.Lock()
+	call := s.Call
+	inCall := call != nil && call.ChatID == resp.ChatId &&
+		(call.State == CallConnected || call.State == CallRingingOut)
+	if inCall && resp.Answer == pb.StreamInfoResponse_ENTER {
+		// an ENTER is as good as an ACCEPT that got lost
+		delete(call.pending, peerID)
+		call.joined[peerID] = true
+	}
+	s.callMu.Unlock()
+
+	s.mu.Lock()
+	if inCall && resp.Answer == pb.StreamInfoResponse_ENTER {
+		s.OutgoingStreams[peerID] = struct{}{}
+	} else {
+		delete(s.OutgoingStreams, peerID)
+	}
+	s.mu.Unlock()
+}
+
+func (s *State) receiveStreamInfo(peerID string, info *pb.StreamInfo) {
+	if info.Status == pb.StreamInfo_STOP {
+		s.dropIncomingStream(peerID)
+	}
+}
+
+func (s *State) dropIncomingStream(peerID string) {
+	s.mu.Lock()
+	if rs, ok := s.IncomingStreams[peerID]; ok {
+		rs.Close()
+		delete(s.IncomingStreams, peerID)
+	}
+	s.mu.Unlock()
+	s.Mixer.Remove(peerID)
+}
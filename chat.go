@@ -1,6 +1,16 @@
 package main
 
-import "time"
+import (
+	"encoding/binary"
+	"fmt"
+	"mobila/pb"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
 
 type Message struct {
 	ID     string    `json:"id"`
@@ -9,13 +19,156 @@ type Message struct {
 	Author string    `json:"author_id"`
 	Text   string    `json:"content"`
 	Sent   time.Time `json:"sent"`
+	// Merges are the other heads a message closes when several members wrote concurrently.
+	Merges []string `json:"merges,omitempty"`
+	// ReplyTo is the message this one answers
+	ReplyTo   string `json:"reply_to,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	// Attachment is set on file messages, Text is empty then
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Unverified is set on receipt when the signature does not match the author
+	Unverified bool `json:"unverified,omitempty"`
+	// Event is set on timeline entries that show a membership change instead of text
+	Event *MembershipChange `json:"-"`
+	// Receipts holds how far the message got with each member, stored apart
+	Receipts map[string]ReceiptStatus `json:"-"`
+	// Deleted messages keep only their place in the history
+	Deleted bool `json:"deleted,omitempty"`
+	// Edits are the later versions of the text, oldest first; Original is the
+	// text as first sent
+	Edits    []MessageEdit `json:"-"`
+	Original string        `json:"-"`
+	// Reactions are stored apart, one record per message
+	Reactions Reactions `json:"-"`
+}
+
+func (m *Message) ToStatic() *pb.Static {
+	st := &pb.Static{
+		ChatId:           m.ChatID,
+		MessageId:        m.ID,
+		PrevMessageId:    m.Prev,
+		Data:             []byte(m.Text),
+		AuthorId:         m.Author,
+		MimeType:         "text/plain",
+		Timestamp:        m.Sent.UnixNano(),
+		MergeMessageIds:  m.Merges,
+		Signature:        m.Signature,
+		ReplyToMessageId: m.ReplyTo,
+	}
+	if m.Attachment != nil {
+		st.MimeType = m.Attachment.Mime
+		st.Data = m.Attachment.manifest()
+	}
+	return st
+}
+
+func MessageFromStatic(st *pb.Static) (Message, error) {
+	m := Message{
+		ID:        st.MessageId,
+		Prev:      st.PrevMessageId,
+		ChatID:    st.ChatId,
+		Author:    st.AuthorId,
+		Text:      string(st.Data),
+		Sent:      time.Unix(0, st.Timestamp),
+		Merges:    st.MergeMessageIds,
+		Signature: st.Signature,
+		ReplyTo:   st.ReplyToMessageId,
+	}
+	if st.Timestamp == 0 {
+		m.Sent = time.Now()
+	}
+	if st.MimeType != "text/plain" {
+		a, err := attachmentFromManifest(st.MimeType, st.Data)
+		if err != nil {
+			return m, err
+		}
+		m.Text = ""
+		m.Attachment = a
+	}
+	return m, nil
+}
+
+// appendField adds b prefixed with its length to data that gets signed.
+func appendField(data, b []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(b)))
+	return append(data, b...)
+}
+
+// staticSignedData is what the author signs: every field of the message
+// except the signature, each prefixed with its length.
+func staticSignedData(st *pb.Static) []byte {
+	data := []byte("mobila message")
+	data = appendField(data, []byte(st.ChatId))
+	data = appendField(data, []byte(st.MessageId))
+	data = appendField(data, []byte(st.AuthorId))
+	data = appendField(data, []byte(st.PrevMessageId))
+	data = appendField(data, []byte(st.MimeType))
+	data = appendField(data, st.Data)
+	data = binary.BigEndian.AppendUint64(data, uint64(st.Timestamp))
+	for _, id := range st.MergeMessageIds {
+		data = appendField(data, []byte(id))
+	}
+	// only replies carry it so older signatures stay valid
+	if st.ReplyToMessageId != "" {
+		data = append(data, "reply"...)
+		data = appendField(data, []byte(st.ReplyToMessageId))
+	}
+	return data
+}
+
+func SignStatic(st *pb.Static, priv crypto.PrivKey) error {
+	sig, err := priv.Sign(staticSignedData(st))
+	if err != nil {
+		return err
+	}
+	st.Signature = sig
+	return nil
+}
+
+func VerifyStatic(st *pb.Static) error {
+	return verifyPeerSignature(st.AuthorId, staticSignedData(st), st.Signature)
+}
+
+// verifyPeerSignature checks sig against the key embedded in the peer ID.
+func verifyPeerSignature(peerID string, data, sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("not signed")
+	}
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return err
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(data, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bad signature by %s", peerID)
+	}
+	return nil
 }
 
 type Chat struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Group chats have a membership log, direct chats do not
+	Group bool `json:"group,omitempty"`
+	// Pending is set while we are invited to a group but have not joined
+	Pending bool `json:"pending,omitempty"`
+	// Left is set once we left or were kicked from a group
+	Left bool `json:"left,omitempty"`
+	// Messages is a window of the history, HasOlder and HasNewer tell whether
+	// more is stored on either side
 	Messages []Message `json:"-"`
+	HasOlder bool      `json:"-"`
+	HasNewer bool      `json:"-"`
 	Peers    []string  `json:"-"`
+	// Roles of the peers of a group chat
+	Roles map[string]Role `json:"-"`
 }
 
 func (c *Chat) GetMessage(mID string) *Message {
@@ -26,3 +179,66 @@ func (c *Chat) GetMessage(mID string) *Message {
 	}
 	return nil
 }
+
+// InsertMessage keeps Messages ordered by send time, ignoring duplicates
+// and messages outside the loaded window.
+func (c *Chat) InsertMessage(m Message) bool {
+	if c.GetMessage(m.ID) != nil {
+		return false
+	}
+	first, last := c.loadedRange()
+	if c.HasOlder && first != nil && m.Sent.Before(first.Sent) {
+		return false
+	}
+	if c.HasNewer && last != nil && m.Sent.After(last.Sent) {
+		return false
+	}
+	i := sort.Search(len(c.Messages), func(i int) bool {
+		return c.Messages[i].Sent.After(m.Sent)
+	})
+	c.Messages = append(c.Messages, Message{})
+	copy(c.Messages[i+1:], c.Messages[i:])
+	c.Messages[i] = m
+	return true
+}
+
+// Parents lists the messages this one directly follows.
+func (m *Message) Parents() []string {
+	var parents []string
+	if m.Prev != "" {
+		parents = append(parents, m.Prev)
+	}
+	return append(parents, m.Merges...)
+}
+
+// Heads returns the messages nobody follows yet, newest first. Unverified
+// messages are left out, as they are from the head: keys.
+func Heads(msgs []Message) []Message {
+	followed := make(map[string]bool)
+	for i := range msgs {
+		if msgs[i].Unverified {
+			continue
+		}
+		for _, p := range msgs[i].Parents() {
+			followed[p] = true
+		}
+	}
+	var heads []Message
+	for _, m := range msgs {
+		if !followed[m.ID] && !m.Unverified {
+			heads = append(heads, m)
+		}
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].Sent.After(heads[j].Sent)
+	})
+	return heads
+}
+
+// DirectChatID gives both sides of a two-person chat the same chat ID.
+func DirectChatID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(a+":"+b)).String()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	minRedialBackoff = 2 * time.Second
+	maxRedialBackoff = 5 * time.Minute
+	// a connection that lived this long resets the backoff
+	stableConnection = 1 * time.Minute
+	dialTimeout      = 1 * time.Minute
+)
+
+// superviseContacts starts a supervisor for every contact that has none yet.
+func (s *State) superviseContacts() {
+	s.mu.Lock()
+	{
+		if s.ctx != nil {
+			for peerID := range s.Contacts {
+				if _, ok := s.supervisors[peerID]; ok {
+					continue
+				}
+				ctx, cancel := context.WithCancel(s.ctx)
+				s.supervisors[peerID] = cancel
+				go s.supervise(ctx, peerID)
+			}
+		}
+	}
+	s.mu.Unlock()
+}
+
+// supervise keeps a /mobila stream to the contact open, redialing with
+// exponential backoff whenever the stream breaks.
+func (s *State) supervise(ctx context.Context, peerIDstr string) {
+	peerID, err := peer.Decode(peerIDstr)
+	if err != nil {
+		fmt.Printf("error trying to decode peer.ID from string %s\n", peerIDstr)
+		return
+	}
+	backoff := minRedialBackoff
+	for {
+		s.mu.RLock()
+		writer, connected := s.PeerStreamWriters[peerIDstr]
+		s.mu.RUnlock()
+
+		if !connected {
+			writer, err = s.dial(ctx, peerID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Printf("dialing %s failed: %v, next try in %v\n", peerIDstr, err, backoff)
+			}
+		}
+		if writer != nil {
+			connectedAt := time.Now()
+			select {
+			case <-writer.done:
+			case <-ctx.Done():
+				return
+			}
+			if time.Since(connectedAt) > stableConnection {
+				backoff = minRedialBackoff
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxRedialBackoff)
+	}
+}
+
+// dial connects to the peer and opens a protocol stream, looking the peer up
+// in the DHT when none of the known addresses work.
+func (s *State) dial(ctx context.Context, peerID peer.ID) (*Libp2pStreamWriter, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	info := peer.AddrInfo{ID: peerID, Addrs: s.knownAddrs(peerID)}
+	err := s.Node.Host.Connect(ctx, info)
+	if err != nil || len(info.Addrs) == 0 {
+		info, err = s.findPeer(ctx, peerID)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.Node.Host.Connect(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := s.Node.Host.NewStream(ctx, peerID, myProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	writer := s.registerStream(stream)
+	go s.serveStream(stream, writer)
+
+	s.rememberAddrs(peerID)
+	return writer, nil
+}
+
+// knownAddrs merges addresses stored with the contact and the peerstore.
+func (s *State) knownAddrs(peerID peer.ID) []multiaddr.Multiaddr {
+	addrs := s.Node.Host.Peerstore().Addrs(peerID)
+	s.mu.RLock()
+	contact := s.Contacts[peerID.String()]
+	s.mu.RUnlock()
+	for _, a := range contact.Addresses {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			fmt.Printf("bad stored address %q of %s: %v\n", a, contact.Alias, err)
+			continue
+		}
+		addrs = append(addrs, ma)
+	}
+	return addrs
+}
+
+func (s *State) findPeer(ctx context.Context, peerID peer.ID) (peer.AddrInfo, error) {
+	for s.Node.DHT.RoutingTable().Size() == 0 {
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return peer.AddrInfo{}, ctx.Err()
+		}
+	}
+	return s.Node.DHT.FindPeer(ctx, peerID)
+}
+
+// rememberAddrs stores the addresses that just worked with the contact.
+func (s *State) rememberAddrs(peerID peer.ID) {
+	var addrs []string
+	for _, conn := range s.Node.Host.Network().ConnsToPeer(peerID) {
+		addrs = append(addrs, conn.RemoteMultiaddr().String())
+	}
+	s.mu.Lock()
+	contact, ok := s.Contacts[peerID.String()]
+	if ok {
+		if len(addrs) > 0 {
+			contact.Addresses = addrs
+		}
+		contact.LastSeen = time.Now().Unix()
+		s.Contacts[peerID.String()] = contact
+	}
+	s.mu.Unlock()
+	if ok {
+		if err := s.Store.AddContact(contact); err != nil {
+			fmt.Printf("error saving contact %s: %v\n", contact.Alias, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// sessions kept per peer; older ones only matter for messages still in flight
+const maxSessionsPerPeer = 4
+
+var bundleSignaturePrefix = []byte("mobila prekey bundle")
+
+var ErrNoBundle = errors.New("no prekey bundle of the peer yet")
+
+// E2EIdentity holds the X25519 keys of this node. The signature by the libp2p
+// Ed25519 key ties them to the peer ID.
+type E2EIdentity struct {
+	IdentityPriv []byte `json:"identity_priv"`
+	IdentityPub  []byte `json:"identity_pub"`
+	PrekeyPriv   []byte `json:"prekey_priv"`
+	PrekeyPub    []byte `json:"prekey_pub"`
+	Signature    []byte `json:"signature"`
+}
+
+// PeerBundle is the verified prekey bundle of a peer.
+type PeerBundle struct {
+	IdentityKey []byte `json:"identity_key"`
+	Prekey      []byte `json:"prekey"`
+}
+
+type Session struct {
+	Ratchet *Ratchet `json:"ratchet"`
+	// Init is repeated on every packet until the responder answers
+	Init *SessionInit `json:"init,omitempty"`
+	// Confirmed is set once a packet of the peer decrypted in this session
+	Confirmed bool `json:"confirmed"`
+}
+
+type SessionInit struct {
+	IdentityKey  []byte `json:"identity_key"`
+	EphemeralKey []byte `json:"ephemeral_key"`
+	Prekey       []byte `json:"prekey"`
+}
+
+// PeerSessions are the sessions with one peer keyed by the ephemeral key of
+// their X3DH, Order oldest first.
+type PeerSessions struct {
+	Active   string              `json:"active"`
+	Sessions map[string]*Session `json:"sessions"`
+	Order    []string            `json:"order"`
+}
+
+func (ps *PeerSessions) add(id string, sess *Session) {
+	ps.Sessions[id] = sess
+	ps.Order = append(ps.Order, id)
+	for len(ps.Order) > maxSessionsPerPeer {
+		delete(ps.Sessions, ps.Order[0])
+		ps.Order = ps.Order[1:]
+	}
+}
+
+// E2E seals packets for one peer at a time with Double Ratchet sessions set up
+// by X3DH. Sessions and peer bundles are kept in the store.
+type E2E struct {
+	state    *State
+	mu       sync.Mutex
+	identity *E2EIdentity
+}
+
+func NewE2E(s *State) (*E2E, error) {
+	id, err := s.Store.LoadE2EIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		if id, err = newE2EIdentity(s.Store); err != nil {
+			return nil, err
+		}
+	}
+	return &E2E{state: s, identity: id}, nil
+}
+
+func newE2EIdentity(store *Store) (*E2EIdentity, error) {
+	priv, err := store.LoadPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	id := &E2EIdentity{}
+	if id.IdentityPriv, id.IdentityPub, err = newDHPair(); err != nil {
+		return nil, err
+	}
+	if id.PrekeyPriv, id.PrekeyPub, err = newDHPair(); err != nil {
+		return nil, err
+	}
+	if id.Signature, err = priv.Sign(bundleSignedData(id.IdentityPub, id.PrekeyPub)); err != nil {
+		return nil, err
+	}
+	fmt.Println("generated end-to-end encryption keys")
+	return id, store.SaveE2EIdentity(id)
+}
+
+func bundleSignedData(identityKey, prekey []byte) []byte {
+	data := slices.Clone(bundleSignaturePrefix)
+	data = append(data, identityKey...)
+	return append(data, prekey...)
+}
+
+func (e *E2E) Bundle() *pb.PrekeyBundle {
+	return &pb.PrekeyBundle{
+		IdentityKey:  e.identity.IdentityPub,
+		SignedPrekey: e.identity.PrekeyPub,
+		Signature:    e.identity.Signature,
+	}
+}
+
+// ReceiveBundle verifies the bundle against the public key in the peer ID.
+// A changed bundle means the peer lost its keys, so our sessions are dropped.
+func (e *E2E) ReceiveBundle(peerID string, b *pb.PrekeyBundle) error {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return err
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(bundleSignedData(b.IdentityKey, b.SignedPrekey), b.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bad prekey bundle signature")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store := e.state.Store
+	old, err := store.LoadPeerBundle(peerID)
+	if err != nil {
+		return err
+	}
+	if old != nil && bytes.Equal(old.IdentityKey, b.IdentityKey) && bytes.Equal(old.Prekey, b.SignedPrekey) {
+		return nil
+	}
+	if old != nil {
+		fmt.Printf("keys of %s changed, starting new sessions\n", peerID)
+		if err := store.SaveSessions(peerID, &PeerSessions{Sessions: make(map[string]*Session)}); err != nil {
+			return err
+		}
+	}
+	return store.SavePeerBundle(peerID, &PeerBundle{IdentityKey: b.IdentityKey, Prekey: b.SignedPrekey})
+}
+
+// Seal encrypts the packet for the peer, starting a session if there is none.
+func (e *E2E) Seal(peerID string, packet *pb.DataPacket) (*pb.Sealed, error) {
+	plaintext, err := proto.Marshal(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store := e.state.Store
+	ps, err := store.LoadSessions(peerID)
+	if err != nil {
+		return nil, err
+	}
+	sess := ps.Sessions[ps.Active]
+	if sess == nil {
+		bundle, err := store.LoadPeerBundle(peerID)
+		if err != nil {
+			return nil, err
+		}
+		if bundle == nil {
+			return nil, ErrNoBundle
+		}
+		secret, ephemeral, err := x3dhInitiate(e.identity.IdentityPriv, bundle.IdentityKey, bundle.Prekey)
+		if err != nil {
+			return nil, err
+		}
+		ad := append(slices.Clone(e.identity.IdentityPub), bundle.IdentityKey...)
+		r, err := NewInitiatorRatchet(secret, bundle.Prekey, ad)
+		if err != nil {
+			return nil, err
+		}
+		sess = &Session{Ratchet: r, Init: &SessionInit{
+			IdentityKey:  e.identity.IdentityPub,
+			EphemeralKey: ephemeral,
+			Prekey:       bundle.Prekey,
+		}}
+		ps.Active = hex.EncodeToString(ephemeral)
+		ps.add(ps.Active, sess)
+	}
+
+	sessionID, err := hex.DecodeString(ps.Active)
+	if err != nil {
+		return nil, err
+	}
+	h, ct, err := sess.Ratchet.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &pb.Sealed{
+		SessionId:     sessionID,
+		RatchetKey:    h.DH,
+		PreviousCount: h.PN,
+		Count:         h.N,
+		Ciphertext:    ct,
+	}
+	if sess.Init != nil && !sess.Confirmed {
+		sealed.Init = &pb.SessionInit{
+			IdentityKey:  sess.Init.IdentityKey,
+			EphemeralKey: sess.Init.EphemeralKey,
+			SignedPrekey: sess.Init.Prekey,
+		}
+	}
+	return sealed, store.SaveSessions(peerID, ps)
+}
+
+// Open decrypts a packet of the peer, answering its X3DH if it starts a session.
+func (e *E2E) Open(peerID string, sealed *pb.Sealed) (*pb.DataPacket, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store := e.state.Store
+	ps, err := store.LoadSessions(peerID)
+	if err != nil {
+		return nil, err
+	}
+	sessionID := hex.EncodeToString(sealed.SessionId)
+	sess := ps.Sessions[sessionID]
+	fresh := sess == nil
+	if fresh {
+		if sess, err = e.respond(peerID, sealed); err != nil {
+			return nil, err
+		}
+	}
+
+	h := ratchetHeader{DH: sealed.RatchetKey, PN: sealed.PreviousCount, N: sealed.Count}
+	plaintext, err := sess.Ratchet.Decrypt(h, sealed.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	sess.Confirmed = true
+	if fresh {
+		// When both sides started a session at once the one of the lower peer ID
+		// wins; a session of a peer that lost its state always replaces ours.
+		active := ps.Sessions[ps.Active]
+		keep := active != nil && !active.Confirmed && e.state.Node.Host.ID().String() < peerID
+		ps.add(sessionID, sess)
+		if !keep {
+			ps.Active = sessionID
+		}
+	}
+	if err := store.SaveSessions(peerID, ps); err != nil {
+		return nil, err
+	}
+
+	var packet pb.DataPacket
+	if err := proto.Unmarshal(plaintext, &packet); err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// respond sets up the responder side of a session the peer started.
+func (e *E2E) respond(peerID string, sealed *pb.Sealed) (*Session, error) {
+	init := sealed.Init
+	if init == nil {
+		return nil, fmt.Errorf("unknown session")
+	}
+	if !bytes.Equal(init.EphemeralKey, sealed.SessionId) {
+		return nil, fmt.Errorf("session id does not match its ephemeral key")
+	}
+	if !bytes.Equal(init.SignedPrekey, e.identity.PrekeyPub) {
+		return nil, fmt.Errorf("session started for a prekey we do not have")
+	}
+	bundle, err := e.state.Store.LoadPeerBundle(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if bundle == nil {
+		return nil, ErrNoBundle
+	}
+	if !bytes.Equal(bundle.IdentityKey, init.IdentityKey) {
+		return nil, fmt.Errorf("session started with an identity key the peer did not sign")
+	}
+	secret, err := x3dhRespond(e.identity.IdentityPriv, e.identity.PrekeyPriv, init.IdentityKey, init.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(slices.Clone(init.IdentityKey), e.identity.IdentityPub...)
+	return &Session{Ratchet: NewResponderRatchet(secret, e.identity.PrekeyPriv, e.identity.PrekeyPub, ad)}, nil
+}
+
+func (s *State) sendBundle(peerID string) {
+	err := s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_PrekeyBundle{PrekeyBundle: s.E2E.Bundle()}})
+	if err != nil {
+		fmt.Printf("error sending prekey bundle to %s: %v\n", peerID, err)
+	}
+}
+
+// sendSealed encrypts the packet end to end before handing it to the stream.
+func (s *State) sendSealed(peerID string, packet *pb.DataPacket) error {
+	s.mu.RLock()
+	_, online := s.PeerStreamWriters[peerID]
+	s.mu.RUnlock()
+	if !online {
+		return fmt.Errorf("%w to %s", errNoStream, peerID)
+	}
+	sealed, err := s.E2E.Seal(peerID, packet)
+	if err != nil {
+		return err
+	}
+	return s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_Sealed{Sealed: sealed}})
+}
+
+func (s *State) receiveSealed(peerID string, sealed *pb.Sealed) {
+	packet, err := s.E2E.Open(peerID, sealed)
+	if err != nil {
+		fmt.Printf("error decrypting packet from %s: %v\n", peerID, err)
+		return
+	}
+	switch inner := packet.Msg.(type) {
+	case *pb.DataPacket_Static:
+		if err := s.ReceiveMessage(peerID, inner.Static); err != nil {
+			fmt.Printf("error receiving message from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_SenderKey:
+		if !slices.Contains(s.chatMembers(inner.SenderKey.ChatId), peerID) {
+			fmt.Printf("sender key from non-member %s dropped\n", peerID)
+			return
+		}
+		if err := s.E2E.ReceiveSenderKey(peerID, inner.SenderKey); err != nil {
+			fmt.Printf("error receiving sender key from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_MembershipLog:
+		if err := s.receiveMembership(peerID, inner.MembershipLog); err != nil {
+			fmt.Printf("error receiving membership from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_Receipt:
+		s.receiveReceipt(peerID, inner.Receipt)
+	case *pb.DataPacket_BlobRequest:
+		s.receiveBlobRequest(peerID, inner.BlobRequest)
+	case *pb.DataPacket_BlobChunk:
+		s.receiveBlobChunk(peerID, inner.BlobChunk)
+	case *pb.DataPacket_MessageEdit:
+		if err := s.receiveMessageEdit(peerID, inner.MessageEdit); err != nil {
+			fmt.Printf("error receiving edit from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_Reaction:
+		if err := s.receiveReaction(peerID, inner.Reaction); err != nil {
+			fmt.Printf("error receiving reaction from %s: %v\n", peerID, err)
+		}
+	default:
+		fmt.Printf("unexpected sealed packet %T from %s\n", inner, peerID)
+	}
+}
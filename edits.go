@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"sort"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// MessageEdit is a later change to a message by its author. Edits are kept
+// as history; a delete leaves a tombstone in place of the message.
+type MessageEdit struct {
+	ChatID    string    `json:"chat_id"`
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Author    string    `json:"author"`
+	Delete    bool      `json:"delete,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Sent      time.Time `json:"sent"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+func (e *MessageEdit) ToProto() *pb.MessageEdit {
+	kind := pb.MessageEdit_EDIT
+	if e.Delete {
+		kind = pb.MessageEdit_DELETE
+	}
+	return &pb.MessageEdit{
+		Kind:      kind,
+		ChatId:    e.ChatID,
+		EditId:    e.ID,
+		MessageId: e.MessageID,
+		AuthorId:  e.Author,
+		Text:      e.Text,
+		Timestamp: e.Sent.UnixNano(),
+		Signature: e.Signature,
+	}
+}
+
+func MessageEditFromProto(p *pb.MessageEdit) MessageEdit {
+	return MessageEdit{
+		ChatID:    p.ChatId,
+		ID:        p.EditId,
+		MessageID: p.MessageId,
+		Author:    p.AuthorId,
+		Delete:    p.Kind == pb.MessageEdit_DELETE,
+		Text:      p.Text,
+		Sent:      time.Unix(0, p.Timestamp),
+		Signature: p.Signature,
+	}
+}
+
+func editSignedData(e *MessageEdit) []byte {
+	data := []byte("mobila edit")
+	data = appendField(data, []byte(e.ChatID))
+	data = appendField(data, []byte(e.ID))
+	data = appendField(data, []byte(e.MessageID))
+	data = appendField(data, []byte(e.Author))
+	if e.Delete {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = appendField(data, []byte(e.Text))
+	return binary.BigEndian.AppendUint64(data, uint64(e.Sent.UnixNano()))
+}
+
+func (e *MessageEdit) Sign(priv crypto.PrivKey) error {
+	sig, err := priv.Sign(editSignedData(e))
+	if err != nil {
+		return err
+	}
+	e.Signature = sig
+	return nil
+}
+
+func (e *MessageEdit) Verify() error {
+	return verifyPeerSignature(e.Author, editSignedData(e), e.Signature)
+}
+
+// tombstone is what stays of a deleted message: its place in the history.
+func (m *Message) tombstone() Message {
+	return Message{
+		ID:      m.ID,
+		Prev:    m.Prev,
+		ChatID:  m.ChatID,
+		Author:  m.Author,
+		Sent:    m.Sent,
+		Merges:  m.Merges,
+		ReplyTo: m.ReplyTo,
+		Deleted: true,
+	}
+}
+
+// applyEdits shows the latest edit of the author as the text and keeps the
+// edits as history. Edits by anyone else are ignored.
+func (m *Message) applyEdits(edits []MessageEdit) {
+	m.Edits = nil
+	for _, e := range edits {
+		if e.Author == m.Author && !e.Delete {
+			m.Edits = append(m.Edits, e)
+		}
+	}
+	sort.Slice(m.Edits, func(i, j int) bool {
+		if !m.Edits[i].Sent.Equal(m.Edits[j].Sent) {
+			return m.Edits[i].Sent.Before(m.Edits[j].Sent)
+		}
+		return m.Edits[i].ID < m.Edits[j].ID
+	})
+	if len(m.Edits) > 0 && !m.Deleted {
+		m.Original = m.Text
+		m.Text = m.Edits[len(m.Edits)-1].Text
+	}
+}
+
+func (s *State) EditMessage(chatID, msgID, text string) error {
+	return s.commitEdit(MessageEdit{ChatID: chatID, MessageID: msgID, Text: text})
+}
+
+func (s *State) DeleteMessage(chatID, msgID string) error {
+	return s.commitEdit(MessageEdit{ChatID: chatID, MessageID: msgID, Delete: true})
+}
+
+func (s *State) commitEdit(e MessageEdit) error {
+	ownID := s.Node.Host.ID().String()
+	if !slices.Contains(s.chatMembers(e.ChatID), ownID) {
+		return fmt.Errorf("not a member of chat %s", e.ChatID)
+	}
+	msg, err := s.Store.GetMessage(e.ChatID, e.MessageID)
+	if err != nil {
+		return err
+	}
+	if msg == nil || msg.Author != ownID || msg.Deleted {
+		return fmt.Errorf("message %s cannot be changed", e.MessageID)
+	}
+	e.ID = uuid.NewString()
+	e.Author = ownID
+	e.Sent = time.Now()
+	if err := e.Sign(s.Node.Host.Peerstore().PrivKey(s.Node.Host.ID())); err != nil {
+		return err
+	}
+	if err := s.applyMessageEdit(e); err != nil {
+		return err
+	}
+	return s.sendToChat(e.ChatID, &pb.DataPacket{Msg: &pb.DataPacket_MessageEdit{MessageEdit: e.ToProto()}})
+}
+
+// applyMessageEdit stores the edit. An edit of a message we do not have yet
+// is kept until it arrives; a delete blanks the stored message.
+func (s *State) applyMessageEdit(e MessageEdit) error {
+	target, err := s.Store.GetMessage(e.ChatID, e.MessageID)
+	if err != nil {
+		return err
+	}
+	if target != nil && target.Author != e.Author {
+		return fmt.Errorf("%s changed message %s of %s", e.Author, e.MessageID, target.Author)
+	}
+	if target != nil && target.Attachment != nil && !e.Delete {
+		return fmt.Errorf("attachment %s cannot be edited", e.MessageID)
+	}
+	if err := s.Store.AddMessageEdit(e); err != nil {
+		return err
+	}
+	if e.Delete && target != nil && !target.Deleted {
+		if err := s.Store.AddMessage(target.tombstone()); err != nil {
+			return err
+		}
+		if target.Attachment != nil {
+			if err := s.Store.RemoveBlobRef(target.Attachment.Hash, target.ChatID, target.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	fyne.Do(func() {
+		s.mu.Lock()
+		selected := s.SelectedChat != nil && s.SelectedChat.ID == e.ChatID
+		if selected {
+			s.Store.ReloadMessages(s.SelectedChat)
+		}
+		s.mu.Unlock()
+		if selected && s.OnMessagesUpdated != nil {
+			s.OnMessagesUpdated(e.ChatID)
+		}
+	})
+	return nil
+}
+
+func (s *State) receiveMessageEdit(peerID string, pe *pb.MessageEdit) error {
+	members := s.chatMembers(pe.ChatId)
+	if !slices.Contains(members, peerID) {
+		return fmt.Errorf("%s is not a member of chat %s", peerID, pe.ChatId)
+	}
+	e := MessageEditFromProto(pe)
+	if err := e.Verify(); err != nil {
+		return err
+	}
+	if old, err := s.Store.GetMessageEdits(e.ChatID, e.MessageID); err == nil {
+		for i := range old {
+			if old[i].ID == e.ID {
+				return nil
+			}
+		}
+	}
+	return s.applyMessageEdit(e)
+}
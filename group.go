@@ -0,0 +1,684 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"mobila/pb"
+	"slices"
+	"sort"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Role of a peer in a group chat, ordered by what it may do.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleInvited
+	RoleMember
+	RoleAdmin
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleInvited:
+		return "invited"
+	case RoleMember:
+		return "member"
+	case RoleAdmin:
+		return "admin"
+	case RoleOwner:
+		return "owner"
+	}
+	return "none"
+}
+
+func ParseRole(s string) Role {
+	for r := RoleInvited; r <= RoleOwner; r++ {
+		if r.String() == s {
+			return r
+		}
+	}
+	return RoleNone
+}
+
+func roleFromProto(r pb.MembershipChange_Role) Role {
+	switch r {
+	case pb.MembershipChange_ADMIN:
+		return RoleAdmin
+	case pb.MembershipChange_OWNER:
+		return RoleOwner
+	}
+	return RoleMember
+}
+
+// MembershipChange is the stored form of pb.MembershipChange.
+type MembershipChange struct {
+	Kind   pb.MembershipChange_Kind `json:"kind"`
+	ChatID string                   `json:"chat_id"`
+	ID     string                   `json:"id"`
+	Author string                   `json:"author"`
+	Peers  []string                 `json:"peers,omitempty"`
+	Name   string                   `json:"name,omitempty"`
+	Sent   time.Time                `json:"sent"`
+	// Role is given to Peers by SET_ROLE
+	Role      pb.MembershipChange_Role `json:"role,omitempty"`
+	Signature []byte                   `json:"signature,omitempty"`
+	// Parents are the heads of the log the change was made on
+	Parents []string `json:"parents,omitempty"`
+}
+
+func (c *MembershipChange) ToProto() *pb.MembershipChange {
+	return &pb.MembershipChange{
+		Kind:      c.Kind,
+		ChatId:    c.ChatID,
+		ChangeId:  c.ID,
+		AuthorId:  c.Author,
+		PeerIds:   c.Peers,
+		Name:      c.Name,
+		Timestamp: c.Sent.UnixNano(),
+		Role:      c.Role,
+		Signature: c.Signature,
+		ParentIds: c.Parents,
+	}
+}
+
+func MembershipChangeFromProto(p *pb.MembershipChange) MembershipChange {
+	return MembershipChange{
+		Kind:      p.Kind,
+		ChatID:    p.ChatId,
+		ID:        p.ChangeId,
+		Author:    p.AuthorId,
+		Peers:     p.PeerIds,
+		Name:      p.Name,
+		Sent:      time.Unix(0, p.Timestamp),
+		Role:      p.Role,
+		Signature: p.Signature,
+		Parents:   p.ParentIds,
+	}
+}
+
+func membershipSignedData(c *MembershipChange) []byte {
+	data := []byte("mobila membership")
+	data = appendField(data, []byte(c.ChatID))
+	data = appendField(data, []byte(c.ID))
+	data = appendField(data, []byte(c.Author))
+	data = binary.BigEndian.AppendUint32(data, uint32(c.Kind))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(c.Peers)))
+	for _, p := range c.Peers {
+		data = appendField(data, []byte(p))
+	}
+	data = appendField(data, []byte(c.Name))
+	data = binary.BigEndian.AppendUint64(data, uint64(c.Sent.UnixNano()))
+	data = binary.BigEndian.AppendUint32(data, uint32(c.Role))
+	// only changes with parents carry them so older signatures stay valid
+	if len(c.Parents) > 0 {
+		data = append(data, "parents"...)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(c.Parents)))
+		for _, p := range c.Parents {
+			data = appendField(data, []byte(p))
+		}
+	}
+	return data
+}
+
+func (c *MembershipChange) Sign(priv crypto.PrivKey) error {
+	sig, err := priv.Sign(membershipSignedData(c))
+	if err != nil {
+		return err
+	}
+	c.Signature = sig
+	return nil
+}
+
+func (c *MembershipChange) Verify() error {
+	return verifyPeerSignature(c.Author, membershipSignedData(c), c.Signature)
+}
+
+// Membership is the outcome of replaying a membership log.
+type Membership struct {
+	Name    string
+	Members map[string]Role
+	// Applied lists the changes that took effect, the rest were void
+	Applied map[string]bool
+	// Revoked lists the void changes whose author was removed or demoted
+	// before or alongside them, they are not worth keeping
+	Revoked map[string]bool
+	// Heads are the changes no other change was made on yet, a new change
+	// names them as its parents
+	Heads []string
+}
+
+func sortChanges(changes []MembershipChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		if !changes[i].Sent.Equal(changes[j].Sent) {
+			return changes[i].Sent.Before(changes[j].Sent)
+		}
+		return changes[i].ID < changes[j].ID
+	})
+}
+
+// orderChanges puts every change after its parents and concurrent changes by
+// Sent and then ID. It also returns the ancestors of each change.
+//
+// Changes without parents come from before changes had them and are chained
+// by Sent. Once the log has changes with parents, only the ones those name
+// count, so nobody can slip in a backdated change without parents. Changes
+// whose parents are unknown wait until they arrive.
+func orderChanges(changes []MembershipChange) ([]MembershipChange, map[string]map[string]bool) {
+	named := make(map[string]bool)
+	causal := false
+	for _, c := range changes {
+		for _, p := range c.Parents {
+			named[p] = true
+			causal = true
+		}
+	}
+	var legacy []MembershipChange
+	for _, c := range changes {
+		if len(c.Parents) == 0 && (!causal || named[c.ID]) {
+			legacy = append(legacy, c)
+		}
+	}
+	sortChanges(legacy)
+
+	byID := make(map[string]MembershipChange, len(changes))
+	parents := make(map[string][]string, len(changes))
+	for i, c := range legacy {
+		byID[c.ID] = c
+		if i > 0 {
+			parents[c.ID] = []string{legacy[i-1].ID}
+		}
+	}
+	for _, c := range changes {
+		if len(c.Parents) > 0 {
+			byID[c.ID] = c
+			parents[c.ID] = slices.Compact(slices.Sorted(slices.Values(c.Parents)))
+		}
+	}
+
+	waiting := make(map[string]int, len(byID))
+	children := make(map[string][]string)
+	var ready []MembershipChange
+	for id, c := range byID {
+		waiting[id] = len(parents[id])
+		for _, p := range parents[id] {
+			children[p] = append(children[p], id)
+		}
+		if waiting[id] == 0 {
+			ready = append(ready, c)
+		}
+	}
+	var order []MembershipChange
+	ancestors := make(map[string]map[string]bool, len(byID))
+	for len(ready) > 0 {
+		sortChanges(ready)
+		c := ready[0]
+		ready = ready[1:]
+		order = append(order, c)
+		anc := make(map[string]bool)
+		for _, p := range parents[c.ID] {
+			anc[p] = true
+			maps.Copy(anc, ancestors[p])
+		}
+		ancestors[c.ID] = anc
+		for _, id := range children[c.ID] {
+			if waiting[id]--; waiting[id] == 0 {
+				ready = append(ready, byID[id])
+			}
+		}
+	}
+	return order, ancestors
+}
+
+// groupChatID is the ID of the group a CREATE starts. It ties the chat to its
+// creator and that change, so no member can put another CREATE at its root.
+func groupChatID(author, createID string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte("group:"+author+":"+createID)).String()
+}
+
+// rootCreate picks the CREATE the chat ID is derived from. Groups from before
+// that have random IDs; for them it is the oldest CREATE, and
+// receiveMembership never stores a second one.
+func rootCreate(changes []MembershipChange) string {
+	var creates []MembershipChange
+	for _, c := range changes {
+		if c.Kind != pb.MembershipChange_CREATE || len(c.Parents) > 0 {
+			continue
+		}
+		if groupChatID(c.Author, c.ID) == c.ChatID {
+			return c.ID
+		}
+		creates = append(creates, c)
+	}
+	if len(creates) == 0 {
+		return ""
+	}
+	sortChanges(creates)
+	return creates[0].ID
+}
+
+// ReplayMembership applies the changes in causal order against the role
+// table built so far. A change its author had no right to make at its point
+// in the log is void, and so is one made alongside a change that removed or
+// demoted its author: the removal wins, whatever the change claims as its
+// time. Other concurrent changes are settled by their order. Every CREATE but
+// the root one is revoked, and changes made on top of one never apply.
+//
+// The creator is the owner. Admins invite, kick peers below them and rename;
+// only the owner hands out roles. When the owner leaves, the first admin, or
+// failing that the first member, by peer ID takes over.
+func ReplayMembership(changes []MembershipChange) *Membership {
+	root := rootCreate(changes)
+	var rooted []MembershipChange
+	var creates []string
+	for _, c := range changes {
+		if c.Kind == pb.MembershipChange_CREATE && c.ID != root {
+			creates = append(creates, c.ID)
+		} else {
+			rooted = append(rooted, c)
+		}
+	}
+	order, ancestors := orderChanges(rooted)
+	revoked := make(map[string]bool)
+	for {
+		m, lowered := replayChanges(order, revoked)
+		again := false
+		for _, c := range order {
+			if revoked[c.ID] {
+				continue
+			}
+			for _, id := range lowered[c.Author] {
+				switch {
+				case id == c.ID || ancestors[id][c.ID]:
+				case ancestors[c.ID][id]:
+					if !m.Applied[c.ID] {
+						m.Revoked[c.ID] = true
+					}
+				default:
+					revoked[c.ID] = true
+					again = true
+				}
+			}
+		}
+		if again {
+			continue
+		}
+		maps.Copy(m.Revoked, revoked)
+		for _, id := range creates {
+			m.Revoked[id] = true
+		}
+		named := make(map[string]bool)
+		causal := false
+		for _, c := range order {
+			if !m.Revoked[c.ID] {
+				for _, p := range c.Parents {
+					named[p] = true
+					causal = true
+				}
+			}
+		}
+		for _, c := range order {
+			if !m.Revoked[c.ID] && !named[c.ID] && (!causal || len(c.Parents) > 0) {
+				m.Heads = append(m.Heads, c.ID)
+			}
+		}
+		return m
+	}
+}
+
+// replayChanges applies the ordered changes but the skipped ones. It also
+// returns, by peer, the applied changes that lowered the peer's role.
+func replayChanges(order []MembershipChange, skip map[string]bool) (*Membership, map[string][]string) {
+	m := &Membership{Members: make(map[string]Role), Applied: make(map[string]bool), Revoked: make(map[string]bool)}
+	lowered := make(map[string][]string)
+	created := false
+	for _, c := range order {
+		if skip[c.ID] {
+			continue
+		}
+		roles := maps.Clone(m.Members)
+		author := m.Members[c.Author]
+		applied := true
+		switch {
+		case c.Kind == pb.MembershipChange_CREATE:
+			if created {
+				applied = false
+				break
+			}
+			created = true
+			m.Name = c.Name
+			m.Members[c.Author] = RoleOwner
+			for _, p := range c.Peers {
+				if p != c.Author {
+					m.Members[p] = RoleInvited
+				}
+			}
+		case !created:
+			applied = false
+		case c.Kind == pb.MembershipChange_INVITE && author >= RoleAdmin:
+			for _, p := range c.Peers {
+				if m.Members[p] == RoleNone {
+					m.Members[p] = RoleInvited
+				}
+			}
+		case c.Kind == pb.MembershipChange_JOIN && author == RoleInvited:
+			m.Members[c.Author] = RoleMember
+		case c.Kind == pb.MembershipChange_LEAVE && author != RoleNone:
+			delete(m.Members, c.Author)
+			if author == RoleOwner {
+				m.passOwnership()
+			}
+		case c.Kind == pb.MembershipChange_KICK && author >= RoleAdmin:
+			applied = false
+			for _, p := range c.Peers {
+				if target := m.Members[p]; target != RoleNone && target < author {
+					delete(m.Members, p)
+					applied = true
+				}
+			}
+		case c.Kind == pb.MembershipChange_RENAME && author >= RoleAdmin:
+			m.Name = c.Name
+		case c.Kind == pb.MembershipChange_SET_ROLE && author == RoleOwner:
+			applied = false
+			role := roleFromProto(c.Role)
+			for _, p := range c.Peers {
+				if target := m.Members[p]; target == RoleMember || target == RoleAdmin {
+					m.Members[p] = role
+					applied = true
+					if role == RoleOwner {
+						// there is one owner, the old one steps down to admin
+						m.Members[c.Author] = RoleAdmin
+						break
+					}
+				}
+			}
+		default:
+			applied = false
+		}
+		if applied {
+			m.Applied[c.ID] = true
+			for p, role := range roles {
+				if m.Members[p] < role {
+					lowered[p] = append(lowered[p], c.ID)
+				}
+			}
+		}
+	}
+	return m, lowered
+}
+
+func (m *Membership) passOwnership() {
+	peers := slices.Sorted(maps.Keys(m.Members))
+	for _, role := range []Role{RoleAdmin, RoleMember} {
+		for _, p := range peers {
+			if m.Members[p] == role {
+				m.Members[p] = RoleOwner
+				return
+			}
+		}
+	}
+}
+
+// CreateGroup starts a group chat and invites the given contacts.
+func (s *State) CreateGroup(name string, peers []string) (string, error) {
+	createID := uuid.NewString()
+	chatID := groupChatID(s.Node.Host.ID().String(), createID)
+	err := s.commitMembership(MembershipChange{
+		Kind:   pb.MembershipChange_CREATE,
+		ChatID: chatID,
+		ID:     createID,
+		Peers:  peers,
+		Name:   name,
+	})
+	return chatID, err
+}
+
+func (s *State) InviteToGroup(chatID string, peers []string) error {
+	return s.changeMembership(chatID, pb.MembershipChange_INVITE, peers, "")
+}
+
+func (s *State) JoinGroup(chatID string) error {
+	return s.changeMembership(chatID, pb.MembershipChange_JOIN, nil, "")
+}
+
+// LeaveGroup also declines an invitation.
+func (s *State) LeaveGroup(chatID string) error {
+	return s.changeMembership(chatID, pb.MembershipChange_LEAVE, nil, "")
+}
+
+func (s *State) KickFromGroup(chatID string, peers []string) error {
+	return s.changeMembership(chatID, pb.MembershipChange_KICK, peers, "")
+}
+
+func (s *State) RenameGroup(chatID, name string) error {
+	return s.changeMembership(chatID, pb.MembershipChange_RENAME, nil, name)
+}
+
+// SetGroupRole gives peers the role; OWNER hands the group over to the one peer.
+func (s *State) SetGroupRole(chatID string, peers []string, role pb.MembershipChange_Role) error {
+	return s.commitMembership(MembershipChange{
+		Kind:   pb.MembershipChange_SET_ROLE,
+		ChatID: chatID,
+		Peers:  peers,
+		Role:   role,
+	})
+}
+
+func (s *State) changeMembership(chatID string, kind pb.MembershipChange_Kind, peers []string, name string) error {
+	return s.commitMembership(MembershipChange{Kind: kind, ChatID: chatID, Peers: peers, Name: name})
+}
+
+// commitMembership signs the change, checks it against the log and sends it out.
+func (s *State) commitMembership(change MembershipChange) error {
+	chatID := change.ChatID
+	if change.ID == "" {
+		change.ID = uuid.NewString()
+	}
+	change.Author = s.Node.Host.ID().String()
+	change.Sent = time.Now()
+	changes, err := s.Store.GetMembershipChanges(chatID)
+	if err != nil {
+		return err
+	}
+	before := ReplayMembership(changes)
+	change.Parents = before.Heads
+	if err := change.Sign(s.Node.Host.Peerstore().PrivKey(s.Node.Host.ID())); err != nil {
+		return err
+	}
+	after := ReplayMembership(append(changes, change))
+	if !after.Applied[change.ID] {
+		return fmt.Errorf("%v is not allowed in chat %s", change.Kind, chatID)
+	}
+	if err := s.Store.AddMembershipChange(change); err != nil {
+		return err
+	}
+	if err := s.applyMembership(chatID, after); err != nil {
+		return err
+	}
+	s.propagateMembership(chatID, before, after, []MembershipChange{change}, append(changes, change))
+	return nil
+}
+
+// propagateMembership sends the new changes to everyone who was or is a
+// member; peers that were not members before get the whole log instead.
+func (s *State) propagateMembership(chatID string, before, after *Membership, fresh, all []MembershipChange) {
+	ownID := s.Node.Host.ID().String()
+	recipients := make(map[string]bool)
+	for p := range before.Members {
+		recipients[p] = true
+	}
+	for p := range after.Members {
+		recipients[p] = true
+	}
+	// kicked peers learn about it too
+	for _, c := range fresh {
+		for _, p := range c.Peers {
+			recipients[p] = true
+		}
+	}
+	delete(recipients, ownID)
+	for peerID := range recipients {
+		changes := fresh
+		if before.Members[peerID] == RoleNone {
+			changes = all
+		}
+		s.sendMembership(peerID, chatID, changes)
+	}
+}
+
+func (s *State) sendMembership(peerID, chatID string, changes []MembershipChange) {
+	log := &pb.MembershipLog{ChatId: chatID}
+	for i := range changes {
+		log.Changes = append(log.Changes, changes[i].ToProto())
+	}
+	err := s.deliver(peerID, &pb.DataPacket{Msg: &pb.DataPacket_MembershipLog{MembershipLog: log}})
+	if err != nil {
+		fmt.Printf("membership of chat %s not delivered to %s: %v\n", chatID, peerID, err)
+	}
+}
+
+// SendMembershipLogs gives the peer the full membership log of every group we share.
+func (s *State) SendMembershipLogs(peerID string) {
+	s.mu.RLock()
+	var chatIDs []string
+	for _, c := range s.Chats {
+		if c.Group && c.Roles[peerID] != RoleNone {
+			chatIDs = append(chatIDs, c.ID)
+		}
+	}
+	s.mu.RUnlock()
+	for _, chatID := range chatIDs {
+		changes, err := s.Store.GetMembershipChanges(chatID)
+		if err != nil {
+			fmt.Printf("error loading membership of chat %s: %v\n", chatID, err)
+			continue
+		}
+		s.sendMembership(peerID, chatID, changes)
+	}
+}
+
+func (s *State) receiveMembership(peerID string, log *pb.MembershipLog) error {
+	// a direct chat never becomes a group, whoever knows its ID
+	ownID := s.Node.Host.ID().String()
+	s.mu.RLock()
+	chat := s.findChat(log.ChatId)
+	direct := chat != nil && !chat.Group || chat == nil && log.ChatId == DirectChatID(peerID, ownID)
+	s.mu.RUnlock()
+	if direct {
+		return fmt.Errorf("membership of direct chat %s", log.ChatId)
+	}
+	changes, err := s.Store.GetMembershipChanges(log.ChatId)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(changes))
+	for _, c := range changes {
+		known[c.ID] = true
+	}
+	root := rootCreate(changes)
+	var fresh []MembershipChange
+	for _, p := range log.Changes {
+		c := MembershipChangeFromProto(p)
+		if c.ChatID != log.ChatId || known[c.ID] {
+			continue
+		}
+		// the first CREATE stored stays the root unless the chat ID names another
+		if c.Kind == pb.MembershipChange_CREATE && root != "" && groupChatID(c.Author, c.ID) != c.ChatID {
+			fmt.Printf("second CREATE %s of chat %s dropped\n", c.ID, c.ChatID)
+			continue
+		}
+		if err := c.Verify(); err != nil {
+			fmt.Printf("membership change %s of chat %s dropped: %v\n", c.ID, c.ChatID, err)
+			continue
+		}
+		known[c.ID] = true
+		fresh = append(fresh, c)
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	before := ReplayMembership(changes)
+	all := append(changes, fresh...)
+	after := ReplayMembership(all)
+	if before.Members[peerID] == RoleNone && after.Members[peerID] == RoleNone {
+		return fmt.Errorf("%s is not a member of chat %s", peerID, log.ChatId)
+	}
+	if before.Members[ownID] == RoleNone && after.Members[ownID] == RoleNone && len(changes) == 0 {
+		return fmt.Errorf("membership of chat %s we are not in", log.ChatId)
+	}
+	for _, c := range fresh {
+		if after.Revoked[c.ID] {
+			fmt.Printf("membership change %s of chat %s dropped: %s may not make it\n", c.ID, c.ChatID, c.Author)
+			continue
+		}
+		if err := s.Store.AddMembershipChange(c); err != nil {
+			return err
+		}
+	}
+	return s.applyMembership(log.ChatId, after)
+}
+
+// applyMembership writes the replayed membership to the chat and its member keys.
+func (s *State) applyMembership(chatID string, m *Membership) error {
+	ownID := s.Node.Host.ID().String()
+	s.mu.RLock()
+	var oldPeers []string
+	if c := s.findChat(chatID); c != nil {
+		// invited peers have a role but are not among the peers yet
+		oldPeers = slices.Collect(maps.Keys(c.Roles))
+	}
+	s.mu.RUnlock()
+
+	chat := Chat{
+		ID:      chatID,
+		Name:    m.Name,
+		Group:   true,
+		Pending: m.Members[ownID] == RoleInvited,
+		Left:    m.Members[ownID] == RoleNone,
+	}
+	if err := s.Store.createChatHeader(chat); err != nil {
+		return err
+	}
+	// new and removed members must not share the key of the old membership
+	if err := s.E2E.RotateSenderKey(chatID); err != nil {
+		return err
+	}
+	for _, p := range oldPeers {
+		if m.Members[p] == RoleNone {
+			if err := s.Store.RemoveChatMember(chatID, p); err != nil {
+				return err
+			}
+		}
+	}
+	for p, role := range m.Members {
+		if err := s.Store.SetChatMemberRole(chatID, p, role); err != nil {
+			return err
+		}
+	}
+
+	s.ReloadContactsAndChats()
+	fyne.Do(func() {
+		s.mu.Lock()
+		selected := s.SelectedChat != nil && s.SelectedChat.ID == chatID
+		if selected {
+			// the timeline shows the membership events too
+			s.Store.GetFullChat(s.SelectedChat, s.Contacts)
+		}
+		s.mu.Unlock()
+		if s.OnChatsChanged != nil {
+			s.OnChatsChanged()
+		}
+		if selected && s.OnMessagesChanged != nil {
+			s.OnMessagesChanged(chatID)
+		}
+	})
+	return nil
+}
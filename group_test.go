@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mobila/pb"
+)
+
+// membershipLog builds a log the way commitMembership does, each change made
+// on the heads of the ones before it.
+type membershipLog struct {
+	changes []MembershipChange
+	sent    time.Time
+	chatID  string
+}
+
+func (l *membershipLog) add(c MembershipChange) MembershipChange {
+	l.sent = l.sent.Add(time.Minute)
+	c.ID = c.Author + "-" + c.Kind.String() + "-" + l.sent.Format("1504")
+	c.Sent = l.sent
+	if c.Kind == pb.MembershipChange_CREATE && l.chatID == "" {
+		l.chatID = groupChatID(c.Author, c.ID)
+	}
+	c.ChatID = l.chatID
+	c.Parents = ReplayMembership(l.changes).Heads
+	l.changes = append(l.changes, c)
+	return c
+}
+
+func TestReplayMembershipCausalOrder(t *testing.T) {
+	l := &membershipLog{sent: time.Unix(1700000000, 0)}
+	l.add(MembershipChange{Kind: pb.MembershipChange_CREATE, Author: "owner", Peers: []string{"admin"}, Name: "Weekend"})
+	l.add(MembershipChange{Kind: pb.MembershipChange_JOIN, Author: "admin"})
+	l.add(MembershipChange{Kind: pb.MembershipChange_SET_ROLE, Author: "owner", Peers: []string{"admin"}, Role: pb.MembershipChange_ADMIN})
+	made := ReplayMembership(l.changes).Heads
+	invite := l.add(MembershipChange{Kind: pb.MembershipChange_INVITE, Author: "admin", Peers: []string{"friend"}})
+	l.add(MembershipChange{Kind: pb.MembershipChange_SET_ROLE, Author: "owner", Peers: []string{"admin"}, Role: pb.MembershipChange_MEMBER})
+
+	m := ReplayMembership(l.changes)
+	if !m.Applied[invite.ID] || m.Members["friend"] != RoleInvited || m.Members["admin"] != RoleMember {
+		t.Fatalf("members %v, applied %v", m.Members, m.Applied)
+	}
+
+	// the demoted admin backdates a kick onto the heads from before it
+	backdated := MembershipChange{Kind: pb.MembershipChange_KICK, ID: "backdated", Author: "admin",
+		Peers: []string{"friend"}, Sent: l.changes[2].Sent.Add(time.Second), Parents: made}
+	// or makes it on the log it has, demotion included
+	late := MembershipChange{Kind: pb.MembershipChange_KICK, ID: "late", Author: "admin",
+		Peers: []string{"friend"}, Sent: l.sent.Add(time.Minute), Parents: m.Heads}
+	// or pretends to be from before changes had parents
+	legacy := MembershipChange{Kind: pb.MembershipChange_RENAME, ID: "legacy", Author: "admin",
+		Name: "Mine", Sent: l.changes[2].Sent.Add(time.Second)}
+	// or starts the group over, backdated, and builds on that
+	root := MembershipChange{Kind: pb.MembershipChange_CREATE, ID: "root", ChatID: l.chatID, Author: "admin",
+		Peers: []string{"mallory"}, Name: "Mine", Sent: l.changes[0].Sent.Add(-time.Minute)}
+	onRoot := MembershipChange{Kind: pb.MembershipChange_KICK, ID: "onRoot", ChatID: l.chatID, Author: "admin",
+		Peers: []string{"friend"}, Sent: l.sent.Add(time.Minute), Parents: append([]string{root.ID}, m.Heads...)}
+	for _, c := range [][]MembershipChange{{backdated}, {late}, {legacy}, {root, onRoot}} {
+		m := ReplayMembership(append(l.changes, c...))
+		if c[0].ID == "root" {
+			if !m.Applied[l.changes[0].ID] || m.Applied[onRoot.ID] || m.Members["mallory"] != RoleNone {
+				t.Errorf("root replaced: members %v, applied %v", m.Members, m.Applied)
+			}
+		}
+		first := c[0]
+		if m.Applied[first.ID] || m.Members["friend"] != RoleInvited || m.Name != "Weekend" {
+			t.Errorf("%s applied: members %v, name %q", first.ID, m.Members, m.Name)
+		}
+		if first.ID != "legacy" && !m.Revoked[first.ID] {
+			t.Errorf("%s not revoked", first.ID)
+		}
+		if len(m.Heads) != 1 || m.Heads[0] != l.changes[len(l.changes)-1].ID {
+			t.Errorf("%s: heads %v", first.ID, m.Heads)
+		}
+	}
+}
+
+func TestReplayMembershipWaitsForParents(t *testing.T) {
+	l := &membershipLog{sent: time.Unix(1700000000, 0)}
+	l.add(MembershipChange{Kind: pb.MembershipChange_CREATE, Author: "owner", Peers: []string{"friend"}, Name: "Weekend"})
+	invite := l.add(MembershipChange{Kind: pb.MembershipChange_INVITE, Author: "owner", Peers: []string{"late"}})
+	join := l.add(MembershipChange{Kind: pb.MembershipChange_JOIN, Author: "late"})
+
+	m := ReplayMembership([]MembershipChange{l.changes[0], join})
+	if m.Applied[join.ID] || m.Members["late"] != RoleNone {
+		t.Errorf("join applied before its invitation: %v", m.Members)
+	}
+	m = ReplayMembership([]MembershipChange{join, invite, l.changes[0]})
+	if !m.Applied[join.ID] || m.Members["late"] != RoleMember {
+		t.Errorf("join not applied: %v", m.Members)
+	}
+}
+
+func TestReplayMembershipLegacyLog(t *testing.T) {
+	sent := time.Unix(1700000000, 0)
+	changes := []MembershipChange{
+		{Kind: pb.MembershipChange_JOIN, ID: "join", Author: "friend", Sent: sent.Add(time.Minute)},
+		{Kind: pb.MembershipChange_CREATE, ID: "create", Author: "owner", Peers: []string{"friend"}, Name: "Weekend", Sent: sent},
+	}
+	m := ReplayMembership(changes)
+	if m.Members["friend"] != RoleMember || len(m.Heads) != 2 {
+		t.Fatalf("members %v, heads %v", m.Members, m.Heads)
+	}
+	// the first change with parents names every change from before
+	rename := MembershipChange{Kind: pb.MembershipChange_RENAME, ID: "rename", Author: "owner", Name: "Sunday",
+		Sent: sent.Add(2 * time.Minute), Parents: m.Heads}
+	m = ReplayMembership(append(changes, rename))
+	if !m.Applied["join"] || !m.Applied["rename"] || m.Name != "Sunday" || len(m.Heads) != 1 {
+		t.Errorf("applied %v, name %q, heads %v", m.Applied, m.Name, m.Heads)
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"maps"
 	"math/rand/v2"
+	"mobila/pb"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -52,6 +62,70 @@ func showPeersWindow(a fyne.App, h host.Host) {
 	win.Show()
 }
 
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// quoteText is the one line a message is quoted with.
+func quoteText(state *State, m *Message) string {
+	text := m.Text
+	switch {
+	case m.Deleted:
+		text = "message deleted"
+	case m.Attachment != nil:
+		text = m.Attachment.Name
+	}
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i] + " ..."
+	}
+	if r := []rune(text); len(r) > 60 {
+		text = string(r[:60]) + "..."
+	}
+	return peerName(state, m.Author) + ": " + text
+}
+
+func peerName(state *State, peerID string) string {
+	if peerID == state.Node.Host.ID().String() {
+		return "you"
+	}
+	if c, ok := state.Contacts[peerID]; ok && c.Alias != "" {
+		return c.Alias
+	}
+	return peerID
+}
+
+func describeMembershipChange(state *State, c *MembershipChange) string {
+	var peers []string
+	for _, p := range c.Peers {
+		peers = append(peers, peerName(state, p))
+	}
+	author := peerName(state, c.Author)
+	list := strings.Join(peers, ", ")
+	switch c.Kind {
+	case pb.MembershipChange_CREATE:
+		return fmt.Sprintf("%s created %s with %s", author, c.Name, list)
+	case pb.MembershipChange_INVITE:
+		return fmt.Sprintf("%s invited %s", author, list)
+	case pb.MembershipChange_JOIN:
+		return fmt.Sprintf("%s joined", author)
+	case pb.MembershipChange_LEAVE:
+		return fmt.Sprintf("%s left", author)
+	case pb.MembershipChange_KICK:
+		return fmt.Sprintf("%s removed %s", author, list)
+	case pb.MembershipChange_RENAME:
+		return fmt.Sprintf("%s renamed the group to %s", author, c.Name)
+	case pb.MembershipChange_SET_ROLE:
+		return fmt.Sprintf("%s made %s %s", author, list, roleFromProto(c.Role))
+	}
+	return c.Kind.String()
+}
+
 func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 	window := app.NewWindow("Mobila")
 	window.Resize(fyne.NewSize(800, 600))
@@ -60,45 +134,208 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 	contactAlias.SetPlaceHolder("Name")
 	contactAddress := widget.NewEntry()
 	contactAddress.SetPlaceHolder("Peer ID (12D3KooW...)")
+	contactMailbox := widget.NewCheck("Use as mailbox", nil)
 	chatsList := widget.NewList(func() int {
 		return len(state.Chats)
 	}, func() fyne.CanvasObject {
 		return widget.NewLabel("Placeholder")
 	}, func(id widget.ListItemID, canvasObj fyne.CanvasObject) {
-		canvasObj.(*widget.Label).SetText(state.Chats[id].Name)
+		chat := &state.Chats[id]
+		switch {
+		case chat.Pending:
+			canvasObj.(*widget.Label).SetText(chat.Name + " (invited)")
+		case chat.Left:
+			canvasObj.(*widget.Label).SetText(chat.Name + " (left)")
+		default:
+			canvasObj.(*widget.Label).SetText(chat.Name)
+		}
 	})
-	chatsBorder := container.NewBorder(widget.NewButton("Add contact", func() {
+	addContactBtn := widget.NewButton("Add contact", func() {
 		addContactForm := dialog.NewCustomConfirm("Add contact", "Confirm", "Cancel",
 			container.NewVBox(
 				contactAlias,
 				contactAddress,
+				contactMailbox,
 			), func(confirmed bool) {
 				if confirmed {
 					state.AddContact(Contact{
-						ID:    contactAddress.Text,
-						Alias: contactAlias.Text,
+						ID:      contactAddress.Text,
+						Alias:   contactAlias.Text,
+						Mailbox: contactMailbox.Checked,
 					})
 					contactAddress.SetText("")
 					contactAlias.SetText("")
+					contactMailbox.SetChecked(false)
 					state.ReloadContactsAndChats()
 					window.Content().Refresh()
 				}
 			}, window)
 		addContactForm.Show()
-	}), nil, nil, nil, chatsList)
-
-	myIDLabel := widget.NewLabel("")
-	myID := container.NewBorder(nil, nil,
-		widget.NewButton("Copy my address", func() {
-			app.Clipboard().SetContent(myIDLabel.Text)
-		}), nil,
-		myIDLabel)
+	})
 
 	statusBar := widget.NewLabel("")
 
 	setStatus := func(status string) {
 		statusBar.SetText(status)
 	}
+
+	// contactPicker lists the contacts for a check group, skipping the excluded IDs.
+	contactPicker := func(exclude []string) (*widget.CheckGroup, map[string]string) {
+		ids := make(map[string]string)
+		var aliases []string
+		for id, c := range state.Contacts {
+			if slices.Contains(exclude, id) {
+				continue
+			}
+			alias := c.Alias
+			if _, taken := ids[alias]; taken || alias == "" {
+				alias = fmt.Sprintf("%s (%s)", c.Alias, id)
+			}
+			ids[alias] = id
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		return widget.NewCheckGroup(aliases, nil), ids
+	}
+	picked := func(group *widget.CheckGroup, ids map[string]string) []string {
+		var peers []string
+		for _, alias := range group.Selected {
+			peers = append(peers, ids[alias])
+		}
+		return peers
+	}
+
+	newGroupBtn := widget.NewButton("New group", func() {
+		if state.Node == nil {
+			return
+		}
+		name := widget.NewEntry()
+		name.SetPlaceHolder("Group name")
+		members, ids := contactPicker(nil)
+		dialog.ShowForm("New group", "Create", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Name", name),
+			widget.NewFormItem("Members", container.NewVScroll(members)),
+		}, func(confirmed bool) {
+			if !confirmed || name.Text == "" {
+				return
+			}
+			if _, err := state.CreateGroup(name.Text, picked(members, ids)); err != nil {
+				fmt.Printf("error creating group: %v\n", err)
+				setStatus("Group not created")
+			}
+		}, window)
+	})
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search messages")
+	chatsBorder := container.NewBorder(
+		container.NewVBox(container.NewGridWithColumns(2, addContactBtn, newGroupBtn), searchEntry),
+		nil, nil, nil, chatsList,
+	)
+
+	changePassword := func() {
+		if state.Store == nil {
+			return
+		}
+		current := widget.NewPasswordEntry()
+		next := widget.NewPasswordEntry()
+		repeat := widget.NewPasswordEntry()
+		dialog.ShowForm("Change password", "Change", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Current", current),
+			widget.NewFormItem("New", next),
+			widget.NewFormItem("Repeat", repeat),
+		}, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if next.Text != repeat.Text {
+				dialog.ShowInformation("Change password", "New passwords do not match", window)
+				return
+			}
+			setStatus("Re-encrypting store...")
+			go func() {
+				err := state.Store.ChangePassword(current.Text, next.Text)
+				fyne.Do(func() {
+					if err != nil {
+						fmt.Printf("error changing password: %v\n", err)
+						setStatus("Password not changed")
+						dialog.ShowError(err, window)
+						return
+					}
+					setStatus("Password changed")
+				})
+			}()
+		}, window)
+	}
+
+	exportBackup := func() {
+		if state.Store == nil {
+			return
+		}
+		password := widget.NewPasswordEntry()
+		repeat := widget.NewPasswordEntry()
+		dialog.ShowForm("Export backup", "Export", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Backup password", password),
+			widget.NewFormItem("Repeat", repeat),
+		}, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if password.Text == "" || password.Text != repeat.Text {
+				dialog.ShowInformation("Export backup", "Passwords are empty or do not match", window)
+				return
+			}
+			d := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+				if err != nil || w == nil {
+					return
+				}
+				setStatus("Exporting backup...")
+				go func() {
+					err := state.Store.ExportBackup(w, password.Text)
+					if closeErr := w.Close(); err == nil {
+						err = closeErr
+					}
+					fyne.Do(func() {
+						if err != nil {
+							fmt.Printf("error exporting backup: %v\n", err)
+							setStatus("Backup not exported")
+							dialog.ShowError(err, window)
+							return
+						}
+						setStatus("Backup exported")
+					})
+				}()
+			}, window)
+			d.SetFileName(fmt.Sprintf("mobila-%s.backup", time.Now().Format("2006-01-02")))
+			d.Show()
+		}, window)
+	}
+
+	myIDLabel := widget.NewLabel("")
+	myID := container.NewBorder(nil, nil,
+		widget.NewButton("Copy my address", func() {
+			app.Clipboard().SetContent(myIDLabel.Text)
+		}),
+		container.NewHBox(
+			widget.NewButton("Rebuild search index", func() {
+				if state.Store == nil {
+					return
+				}
+				setStatus("Rebuilding search index...")
+				go func() {
+					err := state.RebuildSearchIndex()
+					fyne.Do(func() {
+						if err != nil {
+							setStatus("Search index not rebuilt")
+							return
+						}
+						setStatus("Search index rebuilt")
+					})
+				}()
+			}),
+			widget.NewButton("Change password", changePassword),
+			widget.NewButton("Export backup", exportBackup),
+		),
+		myIDLabel)
 	setStatus("waiting for password")
 
 	peerBtn := widget.NewButton("Peers: 0", func() {
@@ -108,54 +345,122 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 	passEntry := widget.NewPasswordEntry()
 	startingDialog := dialog.NewCustomWithoutButtons("Magic word", passEntry, window)
 
-	startingDialog.SetButtons([]fyne.CanvasObject{
-		widget.NewButton("Confirm", func() {
-			var err error
-			state.Store, err = NewStore(passEntry.Text)
-			passEntry.SetText("")
-			if err != nil {
-				fmt.Println("Password error")
-				setStatus("Password error")
-				return
+	// openStore opens the store with the password entered, unless a restore
+	// opened it already.
+	openStore := func() bool {
+		if state.Store != nil {
+			return true
+		}
+		var err error
+		state.Store, err = NewStore(passEntry.Text)
+		passEntry.SetText("")
+		if errors.Is(err, ErrMigrationDryRun) {
+			setStatus("Migration dry run done, see the log")
+			return false
+		} else if err != nil && !errors.Is(err, ErrWrongPassword) {
+			fmt.Printf("error opening store: %v\n", err)
+			setStatus("Store error")
+			return false
+		} else if err != nil {
+			fmt.Println("Password error")
+			setStatus("Password error")
+			return false
+		}
+		return true
+	}
+
+	startNode := func() {
+		var err error
+		state.Node, err = StartNode(ctx, state.Store)
+		if err != nil {
+			fmt.Println("Node startup error")
+			setStatus("Node startup error")
+			return
+		}
+
+		go func() {
+			for {
+				count := len(state.Node.Host.Network().Peers())
+				fyne.Do(func() {
+					peerBtn.SetText(fmt.Sprintf("Peers: %d", count))
+				})
+
+				time.Sleep(time.Second * 3)
 			}
+		}()
 
-			state.Node, err = StartNode(ctx, state.Store)
-			if err != nil {
-				fmt.Println("Node startup error")
-				setStatus("Node startup error")
+		fmt.Printf("Node started: %s\n", state.Node.Host.ID())
+		myIDLabel.SetText(state.Node.Host.ID().String())
+		setStatus("Node started")
+		err = state.Init(ctx)
+		if err != nil {
+			panic(err)
+		}
+		chatsList.Refresh()
+
+		startingDialog.Hide()
+	}
+
+	restoreBackup := func() {
+		if !openStore() {
+			return
+		}
+		dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+			if err != nil || r == nil {
 				return
 			}
-
-			go func() {
-				for {
-					count := len(state.Node.Host.Network().Peers())
+			password := widget.NewPasswordEntry()
+			conflict := widget.NewRadioGroup([]string{"Keep this profile", "Take the backup"}, nil)
+			conflict.SetSelected("Keep this profile")
+			dialog.ShowForm("Restore backup", "Restore", "Cancel", []*widget.FormItem{
+				widget.NewFormItem("Backup password", password),
+				widget.NewFormItem("On conflict", conflict),
+			}, func(confirmed bool) {
+				if !confirmed {
+					r.Close()
+					return
+				}
+				mode := KeepProfile
+				if conflict.Selected == "Take the backup" {
+					mode = TakeBackup
+				}
+				setStatus("Restoring backup...")
+				go func() {
+					defer r.Close()
+					stats, err := state.Store.RestoreBackup(r, password.Text, mode)
 					fyne.Do(func() {
-						peerBtn.SetText(fmt.Sprintf("Peers: %d", count))
+						if err != nil {
+							fmt.Printf("error restoring backup: %v\n", err)
+							setStatus("Backup not restored")
+							dialog.ShowError(err, window)
+							return
+						}
+						fmt.Printf("backup restored: %d contacts, %d chats, %d messages, %d files added\n",
+							stats.Contacts, stats.Chats, stats.Messages, stats.Blobs)
+						startNode()
 					})
+				}()
+			}, window)
+		}, window)
+	}
 
-					time.Sleep(time.Second * 3)
-				}
-			}()
-
-			fmt.Printf("Node started: %s\n", state.Node.Host.ID())
-			myIDLabel.SetText(state.Node.Host.ID().String())
-			setStatus("Node started")
-			err = state.Init()
-			if err != nil {
-				panic(err)
+	startingDialog.SetButtons([]fyne.CanvasObject{
+		widget.NewButton("Restore backup", restoreBackup),
+		widget.NewButton("Confirm", func() {
+			if openStore() {
+				startNode()
 			}
-			chatsList.Refresh()
-
-			startingDialog.Hide()
 		})})
 	startingDialog.Show()
 
 	var selectChat func(id widget.ListItemID)
 
+	var callWindow fyne.Window
+	callStatus := widget.NewLabel("")
 	summonCallWindow := func() {
-		if state.SelectedChat != nil {
+		if state.SelectedChat != nil && callWindow == nil {
 			chatsList.OnSelected = nil
-			callWindow := app.NewWindow(fmt.Sprintf("Calling %s", state.SelectedChat.Name))
+			callWindow = app.NewWindow(fmt.Sprintf("Calling %s", state.SelectedChat.Name))
 			var switchVideoBtn, switchAudioBtn *widget.Button
 			switchVideoBtn = widget.NewButton("Video on", func() {
 				state.VideoMutex.Lock()
@@ -179,41 +484,251 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 			})
 
 			disconnectBtn := widget.NewButton("Disconnect", func() {
-				state.LeaveVideoChat()
+				callWindow.Close()
 			})
 			callWindow.SetOnClosed(func() {
+				state.HangUp()
 				state.LeaveVideoChat()
+				callWindow = nil
 				chatsList.OnSelected = selectChat
 			})
 			videoPad := state.JoinVideoChat()
 			if videoPad != nil {
-				callWindow.SetContent(container.NewBorder(nil, container.NewHBox(switchVideoBtn, switchAudioBtn, disconnectBtn), nil, nil, videoPad))
+				callWindow.SetContent(container.NewBorder(callStatus, container.NewHBox(switchVideoBtn, switchAudioBtn, disconnectBtn), nil, nil, videoPad))
 				fmt.Println("set call content")
 				callWindow.Resize(fyne.NewSize(600, 600))
 				callWindow.Show()
 				fmt.Println("show call window")
 			} else {
+				state.HangUp()
 				state.LeaveVideoChat()
+				callWindow = nil
 				fmt.Println("Unable to create video pad for some reason (selected chat became nil?)")
 			}
 		}
 	}
+	startCall := func() {
+		if state.SelectedChat == nil {
+			return
+		}
+		if err := state.StartCall(state.SelectedChat.ID); err != nil {
+			setStatus(fmt.Sprintf("Call failed: %v", err))
+			return
+		}
+		summonCallWindow()
+	}
+
+	var incomingCall dialog.Dialog
+	state.OnCallChanged = func(call Call) {
+		callStatus.SetText(call.State.String())
+		switch call.State {
+		case CallRingingIn:
+			caller := call.From
+			if contact, ok := state.Contacts[call.From]; ok {
+				caller = contact.Alias
+			}
+			incomingCall = dialog.NewConfirm("Incoming call", fmt.Sprintf("%s is calling", caller), func(accept bool) {
+				incomingCall = nil
+				if !accept {
+					state.DeclineCall()
+					return
+				}
+				for i := range state.Chats {
+					if state.Chats[i].ID == call.ChatID {
+						chatsList.Select(i)
+					}
+				}
+				if err := state.AcceptCall(); err != nil {
+					setStatus(fmt.Sprintf("Call failed: %v", err))
+					return
+				}
+				summonCallWindow()
+			}, window)
+			incomingCall.Show()
+		case CallEnded:
+			if incomingCall != nil {
+				incomingCall.Hide()
+				incomingCall = nil
+			}
+			if callWindow != nil {
+				callWindow.Close()
+			}
+			setStatus("Call " + call.Reason)
+		}
+	}
+
+	membershipFailed := func(err error) {
+		if err != nil {
+			fmt.Printf("error changing membership: %v\n", err)
+			setStatus(fmt.Sprintf("Membership change failed: %v", err))
+		}
+	}
+	showGroup := func() {
+		chat := state.SelectedChat
+		if chat == nil || !chat.Group {
+			return
+		}
+		ownRole := chat.Roles[state.Node.Host.ID().String()]
+		name := widget.NewEntry()
+		name.SetText(chat.Name)
+		var memberNames []string
+		memberIDs := make(map[string]string)
+		// invited peers are listed too, they are not among the peers yet
+		for p := range chat.Roles {
+			label := fmt.Sprintf("%s, %s", peerName(state, p), chat.Roles[p])
+			memberIDs[label] = p
+			memberNames = append(memberNames, label)
+		}
+		sort.Strings(memberNames)
+		members := widget.NewCheckGroup(memberNames, nil)
+		invite, inviteIDs := contactPicker(slices.Collect(maps.Keys(chat.Roles)))
+		var d dialog.Dialog
+		content := container.NewVBox(widget.NewLabel("Members"), members)
+		if ownRole >= RoleAdmin {
+			content.Objects = append([]fyne.CanvasObject{
+				container.NewBorder(nil, nil, nil, widget.NewButton("Rename", func() {
+					membershipFailed(state.RenameGroup(chat.ID, name.Text))
+				}), name),
+			}, content.Objects...)
+			content.Add(widget.NewButton("Kick selected", func() {
+				membershipFailed(state.KickFromGroup(chat.ID, picked(members, memberIDs)))
+				d.Hide()
+			}))
+		}
+		if ownRole == RoleOwner {
+			setRole := func(role pb.MembershipChange_Role) func() {
+				return func() {
+					membershipFailed(state.SetGroupRole(chat.ID, picked(members, memberIDs), role))
+					d.Hide()
+				}
+			}
+			content.Add(container.NewGridWithColumns(3,
+				widget.NewButton("Make admin", setRole(pb.MembershipChange_ADMIN)),
+				widget.NewButton("Make member", setRole(pb.MembershipChange_MEMBER)),
+				widget.NewButton("Hand over", setRole(pb.MembershipChange_OWNER)),
+			))
+		}
+		if ownRole >= RoleAdmin {
+			content.Add(widget.NewLabel("Contacts"))
+			content.Add(invite)
+			content.Add(widget.NewButton("Invite selected", func() {
+				membershipFailed(state.InviteToGroup(chat.ID, picked(invite, inviteIDs)))
+				d.Hide()
+			}))
+		}
+		content.Add(widget.NewButton("Leave group", func() {
+			membershipFailed(state.LeaveGroup(chat.ID))
+			d.Hide()
+		}))
+		d = dialog.NewCustom("Group "+chat.Name, "Close", container.NewVScroll(content), window)
+		d.Resize(fyne.NewSize(400, 500))
+		d.Show()
+	}
+	groupBtn := widget.NewButton("Members", showGroup)
+	groupBtn.Hide()
 
 	chatName := widget.NewLabel("chat placeholder")
 	chatTop := container.NewBorder(nil, nil, nil,
-		widget.NewButton("Call", summonCallWindow), chatName,
+		container.NewHBox(groupBtn, widget.NewButton("Call", startCall)), chatName,
 	)
 
 	messageEntry := widget.NewEntry()
+	// the message being answered, if any
+	replyTo := ""
+	replyLabel := widget.NewLabel("")
+	replyLabel.Truncation = fyne.TextTruncateEllipsis
+	var replyBar *fyne.Container
+	setReply := func(m *Message) {
+		if m == nil {
+			replyTo = ""
+			replyBar.Hide()
+			return
+		}
+		replyTo = m.ID
+		replyLabel.SetText("Replying to " + quoteText(state, m))
+		replyBar.Show()
+		window.Canvas().Focus(messageEntry)
+	}
+	replyBar = container.NewBorder(nil, nil, nil, widget.NewButton("x", func() { setReply(nil) }), replyLabel)
+	replyBar.Hide()
 	messageSender := func(msg string) {
-		fmt.Printf("%s\n", msg)
+		if msg == "" || state.SelectedChat == nil {
+			return
+		}
+		var err error
+		if replyTo != "" {
+			err = state.SendReply(state.SelectedChat.ID, replyTo, msg)
+		} else {
+			err = state.SendMessage(state.SelectedChat.ID, msg)
+		}
+		if err != nil {
+			fmt.Printf("error sending message: %v\n", err)
+			setStatus("Message not sent")
+			return
+		}
 		messageEntry.SetText("")
+		setReply(nil)
 	}
 	messageEntry.OnSubmitted = messageSender
 	messageSend := widget.NewButton(">>", func() {
 		messageSender(messageEntry.Text)
 	})
-	chatSendMessage := container.NewBorder(nil, nil, nil, messageSend, messageEntry)
+	attach := widget.NewButton("+", func() {
+		if state.SelectedChat == nil {
+			return
+		}
+		chatID := state.SelectedChat.ID
+		dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+			if err != nil || r == nil {
+				return
+			}
+			defer r.Close()
+			if err := state.SendAttachment(chatID, r.URI().Name(), r); err != nil {
+				fmt.Printf("error sending attachment: %v\n", err)
+				setStatus("File not sent")
+			}
+		}, window)
+	})
+	chatSendMessage := container.NewBorder(replyBar, nil, attach, messageSend, messageEntry)
+
+	// previews of complete image blobs by hex hash
+	previews := make(map[string]fyne.Resource)
+	previewSize := fyne.NewSize(240, 180)
+	preview := func(a *Attachment) fyne.Resource {
+		if !strings.HasPrefix(a.Mime, "image/") || a.Size > 10<<20 {
+			return nil
+		}
+		key := hex.EncodeToString(a.Hash)
+		if res, ok := previews[key]; ok {
+			return res
+		}
+		if info := state.BlobStatus(a.Hash); info == nil || !info.Complete {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := state.Store.ReadBlob(a.Hash, &buf); err != nil {
+			fmt.Printf("error reading %s: %v\n", a.Name, err)
+			return nil
+		}
+		previews[key] = fyne.NewStaticResource(a.Name, buf.Bytes())
+		return previews[key]
+	}
+	saveAs := func(a *Attachment) {
+		d := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+			if err != nil || w == nil {
+				return
+			}
+			defer w.Close()
+			if err := state.Store.ReadBlob(a.Hash, w); err != nil {
+				fmt.Printf("error saving %s: %v\n", a.Name, err)
+				setStatus("File not saved")
+			}
+		}, window)
+		d.SetFileName(a.Name)
+		d.Show()
+	}
+	var jumpTo func(chatID, msgID string)
+	var loadMore func(id widget.ListItemID)
 	messagesList := widget.NewList(func() int {
 		if state.SelectedChat != nil {
 			return len(state.SelectedChat.Messages)
@@ -225,11 +740,24 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 		text.Alignment = fyne.TextAlignLeading
 		time := widget.NewLabel("00:00")
 		time.Alignment = fyne.TextAlignTrailing
+		image := canvas.NewImageFromResource(nil)
+		image.FillMode = canvas.ImageFillContain
+		image.SetMinSize(previewSize)
+		image.Hide()
+		save := widget.NewButton("Save as", nil)
+		save.Hide()
+		quote := widget.NewButton("", nil)
+		quote.Importance = widget.LowImportance
+		quote.Alignment = widget.ButtonAlignLeading
+		quote.Hide()
 		return container.NewHBox(
 			layout.NewSpacer(),
 			container.NewVBox(
+				quote,
 				text,
-				time,
+				image,
+				container.NewHBox(),
+				container.NewHBox(layout.NewSpacer(), time, widget.NewIcon(nil), save),
 			),
 			layout.NewSpacer(),
 		)
@@ -238,17 +766,397 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 		leftSpacer := line.Objects[0].(*layout.Spacer)
 		container := line.Objects[1].(*fyne.Container)
 		rightSpacer := line.Objects[2].(*layout.Spacer)
-		textLabel := container.Objects[0].(*widget.Label)
-		timeLabel := container.Objects[1].(*widget.Label)
+		quoteBtn := container.Objects[0].(*widget.Button)
+		textLabel := container.Objects[1].(*widget.Label)
+		image := container.Objects[2].(*canvas.Image)
+		reactionBar := container.Objects[3].(*fyne.Container)
+		timeRow := container.Objects[4].(*fyne.Container)
+		timeLabel := timeRow.Objects[1].(*widget.Label)
+		statusIcon := timeRow.Objects[2].(*widget.Icon)
+		saveBtn := timeRow.Objects[3].(*widget.Button)
 		message := &state.SelectedChat.Messages[id]
+		ownID := state.Node.Host.ID().String()
+		loadMore(id)
+		statusIcon.Hide()
+		image.Hide()
+		saveBtn.Hide()
+		quoteBtn.Hide()
+		reactionBar.RemoveAll()
+		textLabel.TextStyle = fyne.TextStyle{}
+		if message.Event != nil {
+			textLabel.SetText(describeMembershipChange(state, message.Event))
+			timeLabel.Importance = widget.MediumImportance
+			timeLabel.SetText(message.Sent.Format("15:04 02-01-06"))
+			leftSpacer.Show()
+			rightSpacer.Show()
+			return
+		}
+		if message.ReplyTo != "" {
+			chatID, original := message.ChatID, message.ReplyTo
+			quoted := state.SelectedChat.GetMessage(original)
+			if quoted == nil {
+				// the original may be stored but outside the loaded page
+				if quoted, _ = state.Store.GetMessage(chatID, original); quoted != nil {
+					if edits, err := state.Store.GetMessageEdits(chatID, original); err == nil {
+						quoted.applyEdits(edits)
+					}
+				}
+			}
+			if quoted != nil {
+				quoteBtn.SetText("> " + quoteText(state, quoted))
+			} else {
+				quoteBtn.SetText("> message not loaded, tap to fetch")
+			}
+			quoteBtn.OnTapped = func() { jumpTo(chatID, original) }
+			quoteBtn.Show()
+		}
 		textLabel.SetText(message.Text)
-		timeLabel.SetText(message.Sent.Format("HH:MM DD-MM-YY"))
-		if message.Author == state.Node.Host.ID().String() {
+		if message.Deleted {
+			textLabel.TextStyle.Italic = true
+			textLabel.SetText("message deleted")
+		}
+		if a := message.Attachment; a != nil {
+			text := fmt.Sprintf("%s (%s)", a.Name, formatSize(a.Size))
+			if info := state.BlobStatus(a.Hash); info != nil && info.Complete {
+				if res := preview(a); res != nil {
+					image.Resource = res
+					image.Refresh()
+					image.Show()
+				}
+				saveBtn.OnTapped = func() { saveAs(a) }
+				saveBtn.Show()
+			} else if info != nil && info.Chunks() > 0 {
+				text += fmt.Sprintf(" · %d%%", info.Received*100/info.Chunks())
+			} else {
+				text += " · not fetched"
+			}
+			textLabel.SetText(text)
+		}
+		if !message.Deleted {
+			counts := message.Reactions.Counts()
+			emojis := slices.Sorted(maps.Keys(counts))
+			for _, emoji := range emojis {
+				chatID, msgID := message.ChatID, message.ID
+				mine := slices.Contains(counts[emoji], ownID)
+				btn := widget.NewButton(fmt.Sprintf("%s %d", emoji, len(counts[emoji])), func() {
+					if err := state.React(chatID, msgID, emoji, mine); err != nil {
+						fmt.Printf("error reacting: %v\n", err)
+					}
+				})
+				if mine {
+					btn.Importance = widget.HighImportance
+				}
+				reactionBar.Add(btn)
+			}
+		}
+		timeText := message.Sent.Format("15:04 02-01-06")
+		timeLabel.Importance = widget.MediumImportance
+		if message.Unverified {
+			timeText += " · unverified"
+			timeLabel.Importance = widget.WarningImportance
+		}
+		if len(message.Edits) > 0 && !message.Deleted {
+			timeText += " · edited"
+		}
+		if message.Author == ownID {
+			delivered, read, total := message.ReceiptSummary(state.SelectedChat.Peers)
+			switch {
+			case total > 0 && read == total:
+				statusIcon.SetResource(theme.VisibilityIcon())
+			case total > 0 && delivered == total:
+				statusIcon.SetResource(theme.ConfirmIcon())
+			default:
+				statusIcon.SetResource(theme.MailSendIcon())
+			}
+			statusIcon.Show()
+			if state.SelectedChat.Group && read > 0 {
+				timeText += fmt.Sprintf(" · read by %d of %d", read, total)
+			} else if state.SelectedChat.Group && delivered > 0 {
+				timeText += fmt.Sprintf(" · delivered to %d of %d", delivered, total)
+			}
+		}
+		timeLabel.SetText(timeText)
+		leftSpacer.Show()
+		rightSpacer.Show()
+		if message.Author == ownID {
 			rightSpacer.Hide()
 		} else {
 			leftSpacer.Hide()
 		}
 	})
+	searchEntry.OnSubmitted = func(query string) {
+		if state.Store == nil {
+			return
+		}
+		hits, err := state.Store.Search(query)
+		if err != nil {
+			fmt.Printf("error searching: %v\n", err)
+			setStatus("Search failed")
+			return
+		}
+		if len(hits) == 0 {
+			setStatus("Nothing found")
+			return
+		}
+		chatIndex := make(map[string]int)
+		for i := range state.Chats {
+			chatIndex[state.Chats[i].ID] = i
+		}
+		var d dialog.Dialog
+		results := container.NewVBox()
+		for _, hit := range hits {
+			i, ok := chatIndex[hit.ChatID]
+			if !ok {
+				continue
+			}
+			title := fmt.Sprintf("%s · %s · %s", state.Chats[i].Name, peerName(state, hit.Author), hit.Sent.Format("15:04 02-01-06"))
+			btn := widget.NewButton(title+"\n"+hit.Snippet, func() {
+				d.Hide()
+				chatsList.Select(i)
+				jumpTo(hit.ChatID, hit.MessageID)
+			})
+			btn.Alignment = widget.ButtonAlignLeading
+			results.Add(btn)
+		}
+		d = dialog.NewCustom(fmt.Sprintf("%d results", len(results.Objects)), "Close", container.NewVScroll(results), window)
+		d.Resize(fyne.NewSize(500, 500))
+		d.Show()
+	}
+	showThread := func(root *Message, replies []Message) {
+		thread := container.NewVBox(widget.NewLabel(quoteText(state, root)))
+		for _, m := range replies {
+			text := m.Text
+			if m.Deleted {
+				text = "message deleted"
+			} else if m.Attachment != nil {
+				text = m.Attachment.Name
+			}
+			thread.Add(widget.NewLabel(fmt.Sprintf("%s  %s: %s", m.Sent.Format("15:04 02-01-06"), peerName(state, m.Author), text)))
+		}
+		d := dialog.NewCustom("Thread", "Close", container.NewVScroll(thread), window)
+		d.Resize(fyne.NewSize(400, 400))
+		d.Show()
+	}
+	showHistory := func(message *Message) {
+		history := container.NewVBox(widget.NewLabel(message.Sent.Format("15:04 02-01-06") + "  " + message.Original))
+		for _, e := range message.Edits {
+			history.Add(widget.NewLabel(e.Sent.Format("15:04 02-01-06") + "  " + e.Text))
+		}
+		d := dialog.NewCustom("Edit history", "Close", container.NewVScroll(history), window)
+		d.Resize(fyne.NewSize(400, 300))
+		d.Show()
+	}
+	messagesList.OnSelected = func(id widget.ListItemID) {
+		messagesList.Unselect(id)
+		if state.SelectedChat == nil || id >= len(state.SelectedChat.Messages) {
+			return
+		}
+		chatID := state.SelectedChat.ID
+		message := state.SelectedChat.Messages[id]
+		if message.Event != nil || message.Deleted {
+			return
+		}
+		own := message.Author == state.Node.Host.ID().String()
+		var d dialog.Dialog
+		reactions := container.NewGridWithColumns(len(quickReactions))
+		for _, emoji := range quickReactions {
+			reactions.Add(widget.NewButton(emoji, func() {
+				d.Hide()
+				if err := state.React(chatID, message.ID, emoji, false); err != nil {
+					fmt.Printf("error reacting: %v\n", err)
+				}
+			}))
+		}
+		actions := container.NewVBox(reactions, widget.NewButton("Reply", func() {
+			d.Hide()
+			setReply(&message)
+		}))
+		replies, err := state.Store.GetReplies(chatID, message.ID)
+		if err != nil {
+			fmt.Printf("error reading thread of %s: %v\n", message.ID, err)
+		}
+		if len(replies) > 0 {
+			actions.Add(widget.NewButton(fmt.Sprintf("Thread (%d)", len(replies)), func() {
+				d.Hide()
+				showThread(&message, replies)
+			}))
+		}
+		if own && message.Attachment == nil {
+			actions.Add(widget.NewButton("Edit", func() {
+				d.Hide()
+				text := widget.NewEntry()
+				text.SetText(message.Text)
+				dialog.ShowForm("Edit message", "Save", "Cancel", []*widget.FormItem{
+					widget.NewFormItem("Text", text),
+				}, func(ok bool) {
+					if !ok || text.Text == "" || text.Text == message.Text {
+						return
+					}
+					if err := state.EditMessage(chatID, message.ID, text.Text); err != nil {
+						fmt.Printf("error editing message: %v\n", err)
+						setStatus("Message not edited")
+					}
+				}, window)
+			}))
+		}
+		if own {
+			actions.Add(widget.NewButton("Delete", func() {
+				d.Hide()
+				dialog.ShowConfirm("Delete message", "Delete this message for everyone?", func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := state.DeleteMessage(chatID, message.ID); err != nil {
+						fmt.Printf("error deleting message: %v\n", err)
+						setStatus("Message not deleted")
+					}
+				}, window)
+			}))
+		}
+		if len(message.Edits) > 0 {
+			actions.Add(widget.NewButton("Edit history", func() {
+				d.Hide()
+				showHistory(&message)
+			}))
+		}
+		d = dialog.NewCustom("Message", "Close", actions, window)
+		d.Show()
+	}
+	state.OnChatsChanged = func() {
+		chatsList.Refresh()
+		if state.SelectedChat != nil {
+			chatName.SetText(state.SelectedChat.Name)
+		}
+	}
+	rowHeight := messagesList.CreateItem().MinSize().Height
+	buttonRowHeight := widget.NewButton("", nil).MinSize().Height + theme.Padding()
+	// rows showing an image preview, a quote or reactions are taller than the rest
+	itemHeight := func(m *Message) float32 {
+		height := rowHeight
+		if m.Attachment != nil && preview(m.Attachment) != nil {
+			height += previewSize.Height + theme.Padding()
+		}
+		if m.ReplyTo != "" {
+			height += buttonRowHeight
+		}
+		if !m.Deleted && len(m.Reactions.Counts()) > 0 {
+			height += buttonRowHeight
+		}
+		return height
+	}
+	sizeRows := func() {
+		if state.SelectedChat == nil {
+			return
+		}
+		for i := range state.SelectedChat.Messages {
+			messagesList.SetItemHeight(i, itemHeight(&state.SelectedChat.Messages[i]))
+		}
+	}
+	// rowTop is where the row starts in the scrolled list
+	rowTop := func(id widget.ListItemID) float32 {
+		var y float32
+		for i := 0; i < id && i < len(state.SelectedChat.Messages); i++ {
+			y += itemHeight(&state.SelectedChat.Messages[i]) + theme.Padding()
+		}
+		return y
+	}
+	indexOf := func(msgID string) widget.ListItemID {
+		for i := range state.SelectedChat.Messages {
+			if state.SelectedChat.Messages[i].ID == msgID {
+				return i
+			}
+		}
+		return -1
+	}
+	// another page of history is loaded when a row near either end is shown
+	loadingPage := false
+	loadMore = func(id widget.ListItemID) {
+		chat := state.SelectedChat
+		if loadingPage || chat == nil {
+			return
+		}
+		older := id < 5 && chat.HasOlder
+		newer := id >= len(chat.Messages)-5 && chat.HasNewer
+		if !older && !newer {
+			return
+		}
+		loadingPage = true
+		anchor := chat.Messages[id].ID
+		// the list must not change while it is drawing rows
+		fyne.Do(func() {
+			defer func() { loadingPage = false }()
+			if state.SelectedChat != chat {
+				return
+			}
+			offset := messagesList.GetScrollOffset()
+			if i := indexOf(anchor); i >= 0 {
+				offset -= rowTop(i)
+			}
+			var loaded bool
+			var err error
+			state.mu.Lock()
+			if older {
+				loaded, err = state.Store.LoadOlder(chat)
+			} else {
+				loaded, err = state.Store.LoadNewer(chat)
+			}
+			state.mu.Unlock()
+			if err != nil {
+				fmt.Printf("error loading messages of %s: %v\n", chat.ID, err)
+				return
+			}
+			if !loaded {
+				return
+			}
+			sizeRows()
+			messagesList.Refresh()
+			// keep the rows on screen where they were
+			if i := indexOf(anchor); i >= 0 {
+				messagesList.ScrollToOffset(rowTop(i) + offset)
+			}
+			state.MarkRead(chat.ID)
+		})
+	}
+	jumpTo = func(chatID, msgID string) {
+		if state.SelectedChat == nil || state.SelectedChat.ID != chatID {
+			return
+		}
+		if i := indexOf(msgID); i >= 0 {
+			messagesList.ScrollTo(i)
+			return
+		}
+		state.mu.Lock()
+		found, err := state.Store.LoadAround(state.SelectedChat, msgID)
+		state.mu.Unlock()
+		if err != nil {
+			fmt.Printf("error loading messages around %s: %v\n", msgID, err)
+		}
+		if found {
+			sizeRows()
+			messagesList.Refresh()
+			messagesList.ScrollTo(indexOf(msgID))
+			return
+		}
+		if state.Syncer.Fetch(chatID, msgID) {
+			setStatus("Fetching the original message")
+		} else {
+			setStatus("Nobody online has the original message")
+		}
+	}
+	state.OnMessagesChanged = func(chatID string) {
+		sizeRows()
+		messagesList.Refresh()
+		messagesList.ScrollToBottom()
+		state.MarkRead(chatID)
+	}
+	state.OnMessagesUpdated = func(chatID string) {
+		sizeRows()
+		messagesList.Refresh()
+	}
+	state.OnBlobChanged = func(hash []byte) {
+		sizeRows()
+		messagesList.Refresh()
+	}
 	chatStructure := container.NewBorder(chatTop, chatSendMessage, nil, nil, messagesList)
 	chatStructure.Hide()
 	chatPlaceholder := layout.NewSpacer()
@@ -256,6 +1164,7 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 	selectChat = func(id widget.ListItemID) {
 		chatStructure.Show()
 		chatPlaceholder.Hide()
+		setReply(nil)
 		chatName.SetText(state.Chats[id].Name)
 		state.SelectedChat = &state.Chats[id]
 		state.Store.GetFullChat(state.SelectedChat, state.Contacts)
@@ -263,6 +1172,26 @@ func MainWindow(app fyne.App, state *State, ctx context.Context) fyne.Window {
 		rand.Shuffle(len(state.ChatPeersShuffled), func(i, j int) {
 			state.ChatPeersShuffled[i], state.ChatPeersShuffled[j] = state.ChatPeersShuffled[j], state.ChatPeersShuffled[i]
 		})
+		sizeRows()
+		messagesList.Refresh()
+		messagesList.ScrollToBottom()
+		state.MarkRead(state.SelectedChat.ID)
+
+		chat := state.SelectedChat
+		if chat.Group {
+			groupBtn.Show()
+		} else {
+			groupBtn.Hide()
+		}
+		if chat.Pending {
+			dialog.ShowConfirm("Group invitation", fmt.Sprintf("Join %s?", chat.Name), func(join bool) {
+				if join {
+					membershipFailed(state.JoinGroup(chat.ID))
+				} else {
+					membershipFailed(state.LeaveGroup(chat.ID))
+				}
+			}, window)
+		}
 	}
 	chatsList.OnSelected = selectChat
 
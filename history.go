@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A chat only keeps a window of its history in memory. Pages are read from
+// the msg:<chat>:<ts>:<id> keys; a cursor is the <ts>:<id> part of a key, so
+// cursors sort like the messages they point at.
+
+const (
+	messagePageSize   = 50
+	maxLoadedMessages = 200
+)
+
+func messagePrefix(chatID string) []byte {
+	return []byte("msg:" + chatID + ":")
+}
+
+// cursorOf returns the cursor of a stored message.
+func cursorOf(m *Message) string {
+	return fmt.Sprintf("%020d:%s", m.Sent.UnixNano(), m.ID)
+}
+
+// decorate adds what is stored apart from the message itself.
+func (s *Store) decorate(txn *badger.Txn, m *Message) {
+	m.Receipts, _ = s.getReceipts(txn, m.ChatID, m.ID)
+	edits, _ := s.getEdits(txn, m.ChatID, m.ID)
+	m.applyEdits(edits)
+	m.Reactions, _ = s.getReactions(txn, m.ChatID, m.ID)
+}
+
+// messagesBefore returns up to limit messages older than the cursor, oldest
+// first, and whether there are more. An empty cursor reads from the newest.
+func (s *Store) messagesBefore(txn *badger.Txn, chatID, cursor string, limit int) ([]Message, bool, error) {
+	prefix := messagePrefix(chatID)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	seek := append(slices.Clone(prefix), cursor...)
+	if cursor == "" {
+		seek = append(seek, 0xff)
+	}
+	var msgs []Message
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		if cursor != "" && string(it.Item().Key()) >= string(seek) {
+			continue
+		}
+		if len(msgs) == limit {
+			slices.Reverse(msgs)
+			return msgs, true, nil
+		}
+		m, err := decodeMessage(it.Item(), prefix, chatID)
+		if err != nil {
+			fmt.Printf("error reading message %s: %v\n", it.Item().Key(), err)
+			continue
+		}
+		s.decorate(txn, &m)
+		msgs = append(msgs, m)
+	}
+	slices.Reverse(msgs)
+	return msgs, false, nil
+}
+
+// messagesFrom returns up to limit messages at or after the cursor, oldest
+// first, and whether there are more.
+func (s *Store) messagesFrom(txn *badger.Txn, chatID, cursor string, limit int) ([]Message, bool, error) {
+	prefix := messagePrefix(chatID)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var msgs []Message
+	for it.Seek(append(slices.Clone(prefix), cursor...)); it.ValidForPrefix(prefix); it.Next() {
+		if len(msgs) == limit {
+			return msgs, true, nil
+		}
+		m, err := decodeMessage(it.Item(), prefix, chatID)
+		if err != nil {
+			fmt.Printf("error reading message %s: %v\n", it.Item().Key(), err)
+			continue
+		}
+		s.decorate(txn, &m)
+		msgs = append(msgs, m)
+	}
+	return msgs, false, nil
+}
+
+// loadedRange returns the oldest and newest loaded message, leaving out
+// membership events.
+func (c *Chat) loadedRange() (first, last *Message) {
+	for i := range c.Messages {
+		if c.Messages[i].Event == nil {
+			if first == nil {
+				first = &c.Messages[i]
+			}
+			last = &c.Messages[i]
+		}
+	}
+	return first, last
+}
+
+// loadedMessages returns a copy of the loaded messages without membership events.
+func (c *Chat) loadedMessages() []Message {
+	var msgs []Message
+	for _, m := range c.Messages {
+		if m.Event == nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// DropOldest keeps the window at maxLoadedMessages while new messages come in.
+func (c *Chat) DropOldest() {
+	msgs := c.loadedMessages()
+	if len(msgs) <= maxLoadedMessages {
+		return
+	}
+	cut := msgs[len(msgs)-maxLoadedMessages].Sent
+	i := 0
+	for i < len(c.Messages) && c.Messages[i].Sent.Before(cut) {
+		i++
+	}
+	c.Messages = append([]Message{}, c.Messages[i:]...)
+	c.HasOlder = true
+}
+
+// setWindow shows msgs in the chat together with the membership events of
+// the same stretch of time.
+func (s *Store) setWindow(chat *Chat, msgs []Message, hasOlder, hasNewer bool) error {
+	chat.Messages = msgs
+	chat.HasOlder, chat.HasNewer = hasOlder, hasNewer
+	if !chat.Group {
+		return nil
+	}
+	changes, err := s.GetMembershipChanges(chat.ID)
+	if err != nil {
+		return err
+	}
+	applied := ReplayMembership(changes).Applied
+	for i := range changes {
+		if applied[changes[i].ID] {
+			c := &changes[i]
+			chat.InsertMessage(Message{ID: c.ID, ChatID: c.ChatID, Author: c.Author, Sent: c.Sent, Event: c})
+		}
+	}
+	return nil
+}
+
+// LoadLatest loads the newest page of the chat.
+func (s *Store) LoadLatest(chat *Chat) error {
+	var msgs []Message
+	var more bool
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		msgs, more, err = s.messagesBefore(txn, chat.ID, "", messagePageSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.setWindow(chat, msgs, more, false)
+}
+
+// LoadOlder adds the page before the loaded messages, dropping the newest
+// ones past maxLoadedMessages. It reports whether anything was added.
+func (s *Store) LoadOlder(chat *Chat) (bool, error) {
+	first, _ := chat.loadedRange()
+	if first == nil || !chat.HasOlder {
+		return false, nil
+	}
+	var older []Message
+	var more bool
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		older, more, err = s.messagesBefore(txn, chat.ID, cursorOf(first), messagePageSize)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(older) == 0 {
+		chat.HasOlder = false
+		return false, nil
+	}
+	msgs := append(older, chat.loadedMessages()...)
+	hasNewer := chat.HasNewer
+	if len(msgs) > maxLoadedMessages {
+		msgs = msgs[:maxLoadedMessages]
+		hasNewer = true
+	}
+	return true, s.setWindow(chat, msgs, more, hasNewer)
+}
+
+// LoadNewer adds the page after the loaded messages, dropping the oldest
+// ones past maxLoadedMessages. It reports whether anything was added.
+func (s *Store) LoadNewer(chat *Chat) (bool, error) {
+	_, last := chat.loadedRange()
+	if last == nil || !chat.HasNewer {
+		return false, nil
+	}
+	var newer []Message
+	var more bool
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		newer, more, err = s.messagesFrom(txn, chat.ID, cursorOf(last)+"\x00", messagePageSize)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(newer) == 0 {
+		chat.HasNewer = false
+		return false, nil
+	}
+	msgs := append(chat.loadedMessages(), newer...)
+	hasOlder := chat.HasOlder
+	if len(msgs) > maxLoadedMessages {
+		msgs = msgs[len(msgs)-maxLoadedMessages:]
+		hasOlder = true
+	}
+	return true, s.setWindow(chat, msgs, hasOlder, more)
+}
+
+// LoadAround loads a page centered on a message. It reports false if the
+// message is not stored.
+func (s *Store) LoadAround(chat *Chat, msgID string) (bool, error) {
+	m, err := s.GetMessage(chat.ID, msgID)
+	if err != nil || m == nil {
+		return false, err
+	}
+	cursor := cursorOf(m) + "\x00"
+	var before, after []Message
+	var hasOlder, hasNewer bool
+	err = s.view(func(txn *badger.Txn) error {
+		var err error
+		// the message itself ends the older half
+		before, hasOlder, err = s.messagesBefore(txn, chat.ID, cursor, messagePageSize/2+1)
+		if err != nil {
+			return err
+		}
+		after, hasNewer, err = s.messagesFrom(txn, chat.ID, cursor, messagePageSize/2)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, s.setWindow(chat, append(before, after...), hasOlder, hasNewer)
+}
+
+// ReloadMessages reads the loaded stretch of the chat again after its
+// messages changed in the store.
+func (s *Store) ReloadMessages(chat *Chat) error {
+	first, _ := chat.loadedRange()
+	if first == nil {
+		return s.LoadLatest(chat)
+	}
+	limit := min(len(chat.loadedMessages())+messagePageSize, maxLoadedMessages)
+	var msgs []Message
+	var more bool
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		msgs, more, err = s.messagesFrom(txn, chat.ID, cursorOf(first), limit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.setWindow(chat, msgs, chat.HasOlder, more)
+}
+
+// GetReplies returns the messages answering rootID, directly or through
+// other replies, in send order.
+func (s *Store) GetReplies(chatID, rootID string) ([]Message, error) {
+	root, err := s.GetMessage(chatID, rootID)
+	if err != nil || root == nil {
+		return nil, err
+	}
+	inThread := map[string]bool{rootID: true}
+	var thread []Message
+	err = s.view(func(txn *badger.Txn) error {
+		prefix := messagePrefix(chatID)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		// a reply comes after what it answers
+		for it.Seek(append(slices.Clone(prefix), cursorOf(root)...)); it.ValidForPrefix(prefix); it.Next() {
+			m, err := decodeMessage(it.Item(), prefix, chatID)
+			if err != nil || m.ReplyTo == "" || !inThread[m.ReplyTo] {
+				continue
+			}
+			inThread[m.ID] = true
+			s.decorate(txn, &m)
+			thread = append(thread, m)
+		}
+		return nil
+	})
+	return thread, err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"mobila/pb"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	mailboxExpiry    = 7 * 24 * time.Hour
+	maxMailboxExpiry = 14 * 24 * time.Hour
+	// quotas per recipient
+	maxMailboxEntries = 500
+	maxMailboxBytes   = 4 << 20
+	// and per sender, over all its recipients
+	maxMailboxSenderBytes = 16 << 20
+	mailboxGCInterval     = time.Hour
+)
+
+// mailboxEnabled tells whether this node holds envelopes for its contacts;
+// set MOBILA_MAILBOX=1 on an always-on node.
+func mailboxEnabled() bool {
+	return os.Getenv("MOBILA_MAILBOX") != ""
+}
+
+// MailboxEntry is an envelope held for an offline recipient.
+type MailboxEntry struct {
+	ID        string    `json:"id"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Sealed    []byte    `json:"sealed"`
+	Bundle    []byte    `json:"bundle,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (e *MailboxEntry) size() int {
+	return len(e.Sealed) + len(e.Bundle)
+}
+
+// depositToMailbox seals the packet for the offline peer and leaves it with
+// the first online contact marked as mailbox. The envelope has the ID of the
+// outbox entry of the packet.
+func (s *State) depositToMailbox(peerID, envelopeID string, packet *pb.DataPacket) {
+	online := s.onlinePeers()
+	s.mu.RLock()
+	mailbox := ""
+	for id, c := range s.Contacts {
+		if c.Mailbox && online[id] && id != peerID {
+			mailbox = id
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if mailbox == "" {
+		return
+	}
+	sealed, err := s.E2E.Seal(peerID, packet)
+	if err != nil {
+		fmt.Printf("error sealing packet for the mailbox of %s: %v\n", peerID, err)
+		return
+	}
+	err = s.sendToPeer(mailbox, &pb.DataPacket{Msg: &pb.DataPacket_MailboxDeposit{MailboxDeposit: &pb.MailboxDeposit{
+		EnvelopeId:   envelopeID,
+		RecipientId:  peerID,
+		Expires:      time.Now().Add(mailboxExpiry).UnixNano(),
+		Sealed:       sealed,
+		SenderBundle: s.E2E.Bundle(),
+	}}})
+	if err != nil {
+		fmt.Printf("error depositing packet for %s at %s: %v\n", peerID, mailbox, err)
+	}
+}
+
+func (s *State) receiveDeposit(peerID string, d *pb.MailboxDeposit) error {
+	if !mailboxEnabled() {
+		return fmt.Errorf("mailbox is disabled")
+	}
+	s.mu.RLock()
+	_, isContact := s.Contacts[peerID]
+	s.mu.RUnlock()
+	if !isContact {
+		return fmt.Errorf("deposit from %s who is not a contact", peerID)
+	}
+	if _, err := peer.Decode(d.RecipientId); err != nil {
+		return fmt.Errorf("deposit for invalid recipient %q: %w", d.RecipientId, err)
+	}
+
+	entry := MailboxEntry{
+		ID:        d.EnvelopeId,
+		Sender:    peerID,
+		Recipient: d.RecipientId,
+		Expires:   time.Unix(0, d.Expires),
+	}
+	if latest := time.Now().Add(maxMailboxExpiry); entry.Expires.After(latest) {
+		entry.Expires = latest
+	}
+	var err error
+	if entry.Sealed, err = proto.Marshal(d.Sealed); err != nil {
+		return err
+	}
+	if d.SenderBundle != nil {
+		if entry.Bundle, err = proto.Marshal(d.SenderBundle); err != nil {
+			return err
+		}
+	}
+
+	held, err := s.Store.GetMailboxEntries(entry.Recipient)
+	if err != nil {
+		return err
+	}
+	size := entry.size()
+	for i := range held {
+		size += held[i].size()
+	}
+	if len(held) >= maxMailboxEntries || size > maxMailboxBytes {
+		return fmt.Errorf("mailbox of %s is full", entry.Recipient)
+	}
+	sent, err := s.Store.GetMailboxEntriesFrom(peerID)
+	if err != nil {
+		return err
+	}
+	size = entry.size()
+	for i := range sent {
+		size += sent[i].size()
+	}
+	if size > maxMailboxSenderBytes {
+		return fmt.Errorf("%s holds too much in the mailbox", peerID)
+	}
+	if err := s.Store.AddMailboxEntry(entry); err != nil {
+		return err
+	}
+	err = s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_MailboxAccepted{MailboxAccepted: &pb.MailboxAccepted{
+		RecipientId: entry.Recipient,
+		EnvelopeIds: []string{entry.ID},
+	}}})
+	if err != nil {
+		// the sender keeps its copy in the outbox, the recipient may get it twice
+		fmt.Printf("error confirming envelope %s to %s: %v\n", entry.ID, peerID, err)
+	}
+	go s.pushMailbox(entry.Recipient)
+	return nil
+}
+
+// receiveMailboxAccepted drops the outbox copies of what a mailbox now holds.
+func (s *State) receiveMailboxAccepted(peerID string, a *pb.MailboxAccepted) {
+	s.mu.RLock()
+	mailbox := s.Contacts[peerID].Mailbox
+	s.mu.RUnlock()
+	if !mailbox {
+		fmt.Printf("mailbox confirmation from %s who is not a mailbox ignored\n", peerID)
+		return
+	}
+	s.dropOutboxEntries(a.RecipientId, a.EnvelopeIds)
+}
+
+// pushMailbox hands the held envelopes to the recipient if it is connected.
+// They stay until acknowledged.
+func (s *State) pushMailbox(peerID string) {
+	entries, err := s.Store.GetMailboxEntries(peerID)
+	if err != nil {
+		fmt.Printf("error loading mailbox of %s: %v\n", peerID, err)
+		return
+	}
+	for _, entry := range entries {
+		if time.Now().After(entry.Expires) {
+			continue
+		}
+		delivery := &pb.MailboxDelivery{EnvelopeId: entry.ID, SenderId: entry.Sender, Sealed: &pb.Sealed{}}
+		if err := proto.Unmarshal(entry.Sealed, delivery.Sealed); err != nil {
+			fmt.Printf("corrupt mailbox entry %s: %v\n", entry.ID, err)
+			continue
+		}
+		if entry.Bundle != nil {
+			delivery.SenderBundle = &pb.PrekeyBundle{}
+			if err := proto.Unmarshal(entry.Bundle, delivery.SenderBundle); err != nil {
+				fmt.Printf("corrupt mailbox entry %s: %v\n", entry.ID, err)
+				continue
+			}
+		}
+		err := s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_MailboxDelivery{MailboxDelivery: delivery}})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *State) receiveDelivery(peerID string, d *pb.MailboxDelivery) {
+	// a mailbox can replay an old bundle that is still validly signed, so it
+	// only introduces senders we have no keys of; changed keys come from the
+	// sender itself
+	if d.SenderBundle != nil {
+		if known, err := s.Store.LoadPeerBundle(d.SenderId); err != nil {
+			fmt.Printf("error loading bundle of %s: %v\n", d.SenderId, err)
+		} else if known == nil {
+			if err := s.E2E.ReceiveBundle(d.SenderId, d.SenderBundle); err != nil {
+				fmt.Printf("error receiving bundle of %s from mailbox %s: %v\n", d.SenderId, peerID, err)
+			}
+		}
+	}
+	if d.Sealed != nil {
+		s.receiveSealed(d.SenderId, d.Sealed)
+	}
+	// acknowledged even if it did not open, it never will
+	err := s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_MailboxAck{MailboxAck: &pb.MailboxAck{
+		EnvelopeIds: []string{d.EnvelopeId},
+	}}})
+	if err != nil {
+		fmt.Printf("error acknowledging envelope %s: %v\n", d.EnvelopeId, err)
+	}
+}
+
+func (s *State) receiveMailboxAck(peerID string, ack *pb.MailboxAck) {
+	for _, id := range ack.EnvelopeIds {
+		if err := s.Store.DeleteMailboxEntry(peerID, id); err != nil {
+			fmt.Printf("error removing envelope %s: %v\n", id, err)
+		}
+	}
+}
+
+// runMailbox drops expired envelopes.
+func (s *State) runMailbox() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(mailboxGCInterval):
+		}
+		n, err := s.Store.DeleteExpiredMailboxEntries(time.Now())
+		if err != nil {
+			fmt.Printf("error expiring mailbox: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("%d mailbox envelopes expired\n", n)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The layout of the keys and values in the store is versioned. A store
+// keeps its version under schemaVersionKey; stores written before the key
+// existed are version 0. Opening a store runs the migrations it misses in
+// order, each in one transaction together with the new version, so a store
+// is never left between two versions. Migrations too big for one
+// transaction go in batches, see forEachBatched.
+//
+// MOBILA_MIGRATE=dry-run runs the pending migrations without committing them
+// and refuses to open the store, MOBILA_MIGRATE=no-backup skips the copy of
+// the store made before migrating.
+
+const (
+	schemaVersionKey   = "system:schema_version"
+	migrationCursorKey = "system:migration_cursor"
+)
+
+// keys migrated per transaction, the tests make it smaller
+var migrationBatch = 10000
+
+var ErrMigrationDryRun = errors.New("store not opened after migration dry run")
+
+// errMoreToMigrate is returned by a migration that filled its transaction.
+// The transaction is committed and the migration runs again in a new one.
+var errMoreToMigrate = errors.New("more to migrate")
+
+type migration struct {
+	version int
+	name    string
+	apply   func(txn *badger.Txn) error
+}
+
+// migrations in order of version, append only
+var migrations = []migration{
+	{1, "index messages by ID", indexMessageIDs},
+	{2, "store contacts, chats, messages and bootstrap peers as protobuf", jsonToRecords},
+	{3, "move two-person chats to their direct chat ID", directChatIDs},
+	{4, "index the heads of chats", indexChatHeads},
+	{5, "index the heads of chats without unverified messages", reindexChatHeads},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func getSchemaVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get([]byte(schemaVersionKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var version int
+	return version, item.Value(func(v []byte) error { return json.Unmarshal(v, &version) })
+}
+
+func setSchemaVersion(txn *badger.Txn, version int) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(schemaVersionKey), data)
+}
+
+// SchemaVersion is the layout version of the open store.
+func (s *Store) SchemaVersion() (int, error) {
+	var version int
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		version, err = getSchemaVersion(txn)
+		return err
+	})
+	return version, err
+}
+
+func (s *Store) isEmpty() (bool, error) {
+	empty := true
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// migrate brings the store up to the latest schema version. password is
+// needed for the backup copy.
+func (s *Store) migrate(password string) error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	if version > latest {
+		return fmt.Errorf("store schema version %d is newer than this build", version)
+	}
+	if version == latest {
+		return nil
+	}
+	if empty, err := s.isEmpty(); err != nil {
+		return err
+	} else if empty {
+		// a new store starts at the latest layout
+		return s.update(func(txn *badger.Txn) error { return setSchemaVersion(txn, latest) })
+	}
+
+	mode := os.Getenv("MOBILA_MIGRATE")
+	if mode == "dry-run" {
+		return s.dryRunMigrations(version, pendingMigrations(version))
+	}
+	if mode != "no-backup" {
+		if err := s.backupBeforeMigration(version, password); err != nil {
+			return fmt.Errorf("backing up store before migration: %w", err)
+		}
+	}
+	return s.runMigrations(version)
+}
+
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// runMigrations applies the migrations after version.
+func (s *Store) runMigrations(version int) error {
+	for _, m := range pendingMigrations(version) {
+		fmt.Printf("migrating store to version %d: %s\n", m.version, m.name)
+		for more := true; more; {
+			more = false
+			err := s.update(func(txn *badger.Txn) error {
+				err := m.apply(txn)
+				if errors.Is(err, errMoreToMigrate) {
+					more = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+				return setSchemaVersion(txn, m.version)
+			})
+			if err != nil {
+				return fmt.Errorf("migrating store to version %d: %w", m.version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dryRunMigrations runs the pending migrations one after the other in a
+// transaction that is thrown away.
+func (s *Store) dryRunMigrations(version int, pending []migration) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	txn := s.DB.NewTransaction(true)
+	defer txn.Discard()
+	for _, m := range pending {
+		err := m.apply(txn)
+		if errors.Is(err, errMoreToMigrate) {
+			// the rest depends on batches that were not committed
+			fmt.Printf("dry run: store would migrate from version %d to %d in several batches: %s\n", version, m.version, m.name)
+			return ErrMigrationDryRun
+		} else if err != nil {
+			fmt.Printf("dry run: migration to version %d (%s) fails: %v\n", m.version, m.name, err)
+			return fmt.Errorf("migrating store to version %d: %w", m.version, err)
+		}
+		fmt.Printf("dry run: store would migrate from version %d to %d: %s\n", version, m.version, m.name)
+		version = m.version
+	}
+	return ErrMigrationDryRun
+}
+
+// backupBeforeMigration copies the store next to it, encrypted like the
+// store. A copy left by an earlier attempt from the same version is kept.
+func (s *Store) backupBeforeMigration(version int, password string) error {
+	path := fmt.Sprintf("%s.v%d.backup", s.Path, version)
+	if _, err := os.Stat(path + ".header"); err == nil {
+		fmt.Printf("keeping store backup %s\n", path)
+		return nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	err := s.copyInto(path, s.Header, password)
+	s.mu.RUnlock()
+	if err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	fmt.Printf("store backed up to %s\n", path)
+	// the header goes last, it marks the copy as complete
+	return writeStoreHeader(path+".header", s.Header)
+}
+
+// indexMessageIDs adds the msgid: entries of messages stored before the
+// index existed.
+func indexMessageIDs(txn *badger.Txn) error {
+	prefix := "msg:"
+	return forEachBatched(txn, []string{prefix}, func(item *badger.Item) error {
+		key := item.KeyCopy(nil)
+		parts := strings.Split(string(key[len(prefix):]), ":")
+		if len(parts) != 3 {
+			return nil
+		}
+		return txn.Set(messageIndexKey(parts[0], parts[2]), key)
+	})
+}
+
+func indexChatHeads(txn *badger.Txn) error {
+	prefix := "msg:"
+	return forEachBatched(txn, []string{prefix}, func(item *badger.Item) error {
+		key := item.KeyCopy(nil)
+		chatID, _, _ := strings.Cut(string(key[len(prefix):]), ":")
+		m, err := decodeMessage(item, messagePrefix(chatID), chatID)
+		if err != nil {
+			fmt.Printf("message %s left out of the heads: %v\n", key, err)
+			return nil
+		}
+		return indexHead(txn, &m, key)
+	})
+}
+
+// reindexChatHeads drops the head: and followed: keys and indexes the heads
+// again, unverified messages left out.
+func reindexChatHeads(txn *badger.Txn) error {
+	return forEachBatched(txn, []string{"followed:", "head:", "msg:"}, func(item *badger.Item) error {
+		key := item.KeyCopy(nil)
+		if !strings.HasPrefix(string(key), "msg:") {
+			return txn.Delete(key)
+		}
+		chatID, _, _ := strings.Cut(string(key[len("msg:"):]), ":")
+		m, err := decodeMessage(item, messagePrefix(chatID), chatID)
+		if err != nil {
+			fmt.Printf("message %s left out of the heads: %v\n", key, err)
+			return nil
+		}
+		return indexHead(txn, &m, key)
+	})
+}
+
+// forEachBatched passes the items under each prefix to fn, migrationBatch
+// keys per transaction. Where a batch ended is kept under
+// migrationCursorKey, so fn only sees each key once.
+func forEachBatched(txn *badger.Txn, prefixes []string, fn func(item *badger.Item) error) error {
+	var cursor []byte
+	if item, err := txn.Get([]byte(migrationCursorKey)); err == nil {
+		if cursor, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	n := 0
+	for _, prefix := range prefixes {
+		seek := []byte(prefix)
+		if string(cursor) > prefix {
+			seek = append(cursor, 0)
+		}
+		for it.Seek(seek); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			if n == migrationBatch {
+				if err := txn.Set([]byte(migrationCursorKey), cursor); err != nil {
+					return err
+				}
+				return errMoreToMigrate
+			}
+			cursor = it.Item().KeyCopy(nil)
+			if err := fn(it.Item()); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	return txn.Delete([]byte(migrationCursorKey))
+}
+
+// rewriteValues passes the values under each prefix through fn and stores
+// what it returns, in batches as forEachBatched.
+func rewriteValues(txn *badger.Txn, prefixes []string, fn func(key, value []byte) ([]byte, error)) error {
+	return forEachBatched(txn, prefixes, func(item *badger.Item) error {
+		key := item.KeyCopy(nil)
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		value, err = fn(key, value)
+		if err != nil || value == nil {
+			return err
+		}
+		return txn.Set(key, value)
+	})
+}
+
+// jsonToRecords replaces the JSON values of contacts, chats, messages and
+// bootstrap peers with the records of pb/store.proto. Values that do not
+// decode are left alone and skipped when read, as before.
+func jsonToRecords(txn *badger.Txn) error {
+	return rewriteValues(txn, []string{"boot:", "chat:", "contact:", "msg:"}, func(key, value []byte) ([]byte, error) {
+		var data []byte
+		var err error
+		switch {
+		case strings.HasPrefix(string(key), "boot:"):
+			var info peer.AddrInfo
+			if err = json.Unmarshal(value, &info); err == nil {
+				data, err = marshalAddrInfo(info)
+			}
+		case strings.HasPrefix(string(key), "chat:"):
+			var c Chat
+			if err = json.Unmarshal(value, &c); err == nil {
+				data, err = marshalChat(&c)
+			}
+		case strings.HasPrefix(string(key), "contact:"):
+			var c Contact
+			if err = json.Unmarshal(value, &c); err == nil {
+				data, err = marshalContact(c)
+			}
+		default:
+			var m Message
+			if err = json.Unmarshal(value, &m); err == nil {
+				data, err = marshalMessage(&m)
+			}
+		}
+		if err != nil {
+			fmt.Printf("error converting %s: %v\n", key, err)
+			return nil, nil
+		}
+		return data, nil
+	})
+}
+
+// directChatIDs moves the two-person chats made with a random ID, before
+// DirectChatID, to the ID both sides derive, merging them into a chat of
+// that ID if one was opened since. The members and the header move last, so
+// a chat that is not done yet is found again by the next batch. Messages
+// keep their signatures, made for the old ID; peers have their own copies.
+func directChatIDs(txn *badger.Txn) error {
+	item, err := txn.Get([]byte(nodeKeyPath))
+	if err == badger.ErrKeyNotFound {
+		// without an identity there are no chats with anyone
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var ownID string
+	err = item.Value(func(v []byte) error {
+		priv, err := crypto.UnmarshalPrivateKey(v)
+		if err != nil {
+			return err
+		}
+		id, err := peer.IDFromPrivateKey(priv)
+		ownID = id.String()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var direct []string
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	prefix := []byte("chat:")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var c Chat
+		if err := it.Item().Value(func(v []byte) error { return unmarshalChat(v, &c) }); err == nil && !c.Group {
+			direct = append(direct, string(it.Item().Key()[len(prefix):]))
+		}
+	}
+	it.Close()
+
+	moves := make(map[string]string)
+	for _, chatID := range direct {
+		members := chatMemberIDs(txn, chatID)
+		if len(members) != 2 || !slices.Contains(members, ownID) {
+			continue
+		}
+		other := members[0]
+		if other == ownID {
+			other = members[1]
+		}
+		if id := DirectChatID(other, ownID); id != chatID {
+			moves[chatID] = id
+		}
+	}
+
+	n := 0
+	for _, from := range slices.Sorted(maps.Keys(moves)) {
+		fmt.Printf("moving chat %s to %s\n", from, moves[from])
+		if err := moveChat(txn, from, moves[from], &n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveChat moves what is stored under chat ID from to chat ID to, adding
+// each moved key to n. It returns errMoreToMigrate when n reaches
+// migrationBatch.
+func moveChat(txn *badger.Txn, from, to string, n *int) error {
+	moves := []struct {
+		prefix string
+		fn     func(key, value []byte) ([]byte, error)
+	}{
+		{"msg:", func(key, value []byte) ([]byte, error) {
+			m, err := unmarshalMessage(value)
+			if err != nil {
+				return value, nil
+			}
+			m.ChatID = to
+			if m.Attachment != nil {
+				msgID := key[strings.LastIndexByte(string(key), ':')+1:]
+				if err := moveKey(txn, blobRefKey(m.Attachment.Hash, from, string(msgID)), blobRefKey(m.Attachment.Hash, to, string(msgID)), nil); err != nil {
+					return nil, err
+				}
+			}
+			return marshalMessage(&m)
+		}},
+		{"msgid:", func(key, value []byte) ([]byte, error) {
+			return []byte("msg:" + to + ":" + strings.TrimPrefix(string(value), "msg:"+from+":")), nil
+		}},
+		{"edit:", moveEdit(to)},
+		{"tomb:", moveEdit(to)},
+		{"rcpt:", nil},
+		{"react:", func(key, value []byte) ([]byte, error) {
+			rs := make(Reactions)
+			if err := json.Unmarshal(value, &rs); err != nil {
+				return value, nil
+			}
+			for _, authors := range rs {
+				for author, r := range authors {
+					r.ChatID = to
+					authors[author] = r
+				}
+			}
+			return json.Marshal(rs)
+		}},
+		{"idxdoc:", func(key, value []byte) ([]byte, error) {
+			msgID := string(key[len("idxdoc:"+from+":"):])
+			for _, token := range strings.Fields(string(value)) {
+				if err := moveKey(txn, indexKey(token, from, msgID), indexKey(token, to, msgID), nil); err != nil {
+					return nil, err
+				}
+			}
+			return value, nil
+		}},
+	}
+	for _, m := range moves {
+		var keys [][]byte
+		prefix := []byte(m.prefix + from + ":")
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && *n+len(keys) < migrationBatch; it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range keys {
+			newKey := append([]byte(m.prefix+to+":"), key[len(prefix):]...)
+			var fn func(value []byte) ([]byte, error)
+			if m.fn != nil {
+				fn = func(value []byte) ([]byte, error) { return m.fn(key, value) }
+			}
+			if err := moveKey(txn, key, newKey, fn); err != nil {
+				return err
+			}
+		}
+		if *n += len(keys); *n >= migrationBatch {
+			return errMoreToMigrate
+		}
+	}
+
+	// the members go with the header, they are what marks the chat as one to move
+	for _, peerID := range chatMemberIDs(txn, from) {
+		if err := moveKey(txn, []byte("member:"+from+":"+peerID), []byte("member:"+to+":"+peerID), nil); err != nil {
+			return err
+		}
+	}
+	item, err := txn.Get([]byte("chat:" + from))
+	if err != nil {
+		return err
+	}
+	if _, err := txn.Get([]byte("chat:" + to)); err == badger.ErrKeyNotFound {
+		var c Chat
+		if err := item.Value(func(v []byte) error { return unmarshalChat(v, &c) }); err != nil {
+			return err
+		}
+		c.ID = to
+		data, err := marshalChat(&c)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("chat:"+to), data); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return txn.Delete([]byte("chat:" + from))
+}
+
+// moveKey moves the value under from, passed through fn, to the key to.
+// A missing from is not an error.
+func moveKey(txn *badger.Txn, from, to []byte, fn func(value []byte) ([]byte, error)) error {
+	item, err := txn.Get(from)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if fn != nil {
+		if value, err = fn(value); err != nil {
+			return err
+		}
+	}
+	if err := txn.Set(to, value); err != nil {
+		return err
+	}
+	return txn.Delete(from)
+}
+
+func moveEdit(to string) func(key, value []byte) ([]byte, error) {
+	return func(key, value []byte) ([]byte, error) {
+		var e MessageEdit
+		if err := json.Unmarshal(value, &e); err != nil {
+			return value, nil
+		}
+		e.ChatID = to
+		return json.Marshal(e)
+	}
+}
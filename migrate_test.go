@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const fixturePassword = "fixture"
+
+// readFixture reads testdata/store_v<version>.txt: one entry per line, the
+// key, a tab and the value, binary values in hex with a 0x prefix.
+func readFixture(t *testing.T, version int) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", fmt.Sprintf("store_v%d.txt", version)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := make(map[string][]byte)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "\t")
+		if !ok {
+			t.Fatalf("bad fixture line %q", line)
+		}
+		data := []byte(value)
+		if strings.HasPrefix(value, "0x") {
+			if data, err = hex.DecodeString(value[2:]); err != nil {
+				t.Fatalf("bad fixture value of %s: %v", key, err)
+			}
+		}
+		entries[key] = data
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// openFixture writes a fixture into an encrypted store in a temporary
+// directory, as an older build left it. The store is not migrated yet.
+func openFixture(t *testing.T, version int) *Store {
+	t.Helper()
+	header, err := NewStoreHeader(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	db, err := openBadger(path, header, fixturePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{DB: db, Salt: header.Salt, Path: path, Header: header}
+	t.Cleanup(s.Close)
+	wb := db.NewWriteBatch()
+	for key, value := range readFixture(t, version) {
+		if err := wb.Set([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func dumpDB(t *testing.T, db *badger.DB) map[string][]byte {
+	t.Helper()
+	entries := make(map[string][]byte)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entries[string(it.Item().Key())] = value
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func sameEntries(t *testing.T, got, want map[string][]byte) {
+	t.Helper()
+	for key, value := range want {
+		if g, ok := got[key]; !ok {
+			t.Errorf("%s is missing", key)
+		} else if !bytes.Equal(g, value) {
+			t.Errorf("%s = %q, want %q", key, g, value)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected key %s", key)
+		}
+	}
+}
+
+func chatByName(t *testing.T, s *Store, name string) *Chat {
+	t.Helper()
+	chats, err := s.GetChatList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range chats {
+		if chats[i].Name == name {
+			if err := s.GetFullChat(&chats[i], nil); err != nil {
+				t.Fatal(err)
+			}
+			return &chats[i]
+		}
+	}
+	t.Fatalf("no chat %q", name)
+	return nil
+}
+
+func messageTexts(c *Chat) []string {
+	var texts []string
+	for _, m := range c.loadedMessages() {
+		if m.Attachment != nil {
+			texts = append(texts, "file "+m.Attachment.Name)
+		} else {
+			texts = append(texts, m.Text)
+		}
+	}
+	return texts
+}
+
+func messageIDs(msgs []Message) []string {
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestMigrateFixtures(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "")
+	tests := []struct {
+		version  int
+		chats    map[string][]string
+		contacts map[string]string
+	}{
+		{
+			version: 0,
+			chats: map[string][]string{
+				"Alice": {"hello Alice", "hey! long time", "coffee tomorrow?"},
+				"Bob":   {"are you there?", "yes"},
+			},
+			contacts: map[string]string{"Alice": "/ip4/192.0.2.10/tcp/4001", "Bob": ""},
+		},
+		{
+			version: 1,
+			chats: map[string][]string{
+				"Alice":   {"hi Alice", "hi, here is the photo", "file photo.jpg", "no typo"},
+				"Weekend": {"Saturday?", "works for me"},
+			},
+			contacts: map[string]string{"Alice": "/ip4/192.0.2.10/tcp/4001", "Bob": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("v%d", tt.version), func(t *testing.T) {
+			s := openFixture(t, tt.version)
+			if err := s.migrate(fixturePassword); err != nil {
+				t.Fatal(err)
+			}
+			if version, err := s.SchemaVersion(); err != nil || version != latestSchemaVersion() {
+				t.Fatalf("schema version %d, %v; want %d", version, err, latestSchemaVersion())
+			}
+
+			for name, want := range tt.chats {
+				chat := chatByName(t, s, name)
+				if got := messageTexts(chat); !slices.Equal(got, want) {
+					t.Errorf("chat %s: %q, want %q", name, got, want)
+				}
+				if !chat.Group && (len(chat.Peers) != 2 || chat.ID != DirectChatID(chat.Peers[0], chat.Peers[1])) {
+					t.Errorf("chat %s with %v kept ID %s", name, chat.Peers, chat.ID)
+				}
+				// found through the msgid: index
+				for _, m := range chat.loadedMessages() {
+					if got, err := s.GetMessage(chat.ID, m.ID); err != nil || got == nil {
+						t.Errorf("GetMessage(%s, %s) = %v, %v", name, m.ID, got, err)
+					}
+				}
+				// and the head: index agrees with the whole history
+				heads, err := s.GetChatHeads(chat.ID)
+				if got, want := messageIDs(heads), messageIDs(Heads(chat.loadedMessages())); err != nil || !slices.Equal(got, want) {
+					t.Errorf("chat %s heads %v, %v; want %v", name, got, err, want)
+				}
+			}
+
+			contacts, err := s.GetAllContacts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(contacts) != len(tt.contacts) {
+				t.Errorf("%d contacts, want %d", len(contacts), len(tt.contacts))
+			}
+			for _, c := range contacts {
+				addr, ok := tt.contacts[c.Alias]
+				if !ok {
+					t.Errorf("unexpected contact %s", c.Alias)
+				} else if addr != "" && !slices.Contains(c.Addresses, addr) {
+					t.Errorf("contact %s lost address %s: %v", c.Alias, addr, c.Addresses)
+				}
+			}
+
+			peers, err := s.LoadBootstrapPeers()
+			if err != nil || len(peers) != 1 || len(peers[0].Addrs) != 1 || peers[0].Addrs[0].String() != "/ip4/192.0.2.1/tcp/4001" {
+				t.Errorf("bootstrap peers %v, %v", peers, err)
+			}
+			if _, err := s.LoadPrivateKey(); err != nil {
+				t.Errorf("identity lost: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateKeepsV1Details(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "")
+	s := openFixture(t, 1)
+	if err := s.migrate(fixturePassword); err != nil {
+		t.Fatal(err)
+	}
+	chat := chatByName(t, s, "Alice")
+	msgs := chat.loadedMessages()
+	if len(msgs) != 4 {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	if msgs[1].ReplyTo != "m1" || len(msgs[1].Signature) == 0 {
+		t.Errorf("reply lost its fields: %+v", msgs[1])
+	}
+	if len(msgs[0].Receipts) != 1 {
+		t.Errorf("receipts %v", msgs[0].Receipts)
+	}
+	if len(msgs[2].Reactions) != 1 {
+		t.Errorf("reactions %v", msgs[2].Reactions)
+	}
+	if msgs[3].Original != "typo" {
+		t.Errorf("original text %q", msgs[3].Original)
+	}
+	var blob bytes.Buffer
+	if err := s.ReadBlob(msgs[2].Attachment.Hash, &blob); err != nil || blob.Len() != int(msgs[2].Attachment.Size) {
+		t.Errorf("attachment blob: %d bytes, %v", blob.Len(), err)
+	}
+
+	group := chatByName(t, s, "Weekend")
+	if !group.Group || len(group.Peers) != 3 {
+		t.Errorf("group %+v", group)
+	}
+	hits, err := s.Search("photo")
+	if err != nil || len(hits) != 2 {
+		t.Errorf("search found %v, %v", hits, err)
+	}
+}
+
+func TestMigrateDryRunLeavesStore(t *testing.T) {
+	for _, version := range []int{0, 1} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			t.Setenv("MOBILA_MIGRATE", "dry-run")
+			s := openFixture(t, version)
+			before := dumpDB(t, s.DB)
+			if err := s.migrate(fixturePassword); !errors.Is(err, ErrMigrationDryRun) {
+				t.Fatalf("migrate = %v, want %v", err, ErrMigrationDryRun)
+			}
+			sameEntries(t, dumpDB(t, s.DB), before)
+			if matches, _ := filepath.Glob(s.Path + ".v*"); len(matches) > 0 {
+				t.Errorf("dry run left %v", matches)
+			}
+		})
+	}
+}
+
+func TestMigrateBacksUpStore(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "")
+	s := openFixture(t, 0)
+	before := dumpDB(t, s.DB)
+	if err := s.migrate(fixturePassword); err != nil {
+		t.Fatal(err)
+	}
+	path := s.Path + ".v0.backup"
+	header, err := readStoreHeader(path + ".header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openBadger(path, header, fixturePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sameEntries(t, dumpDB(t, db), before)
+}
+
+func TestMigrateSkipsBackup(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "no-backup")
+	s := openFixture(t, 0)
+	if err := s.migrate(fixturePassword); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(s.Path + ".v*"); len(matches) > 0 {
+		t.Errorf("backup made anyway: %v", matches)
+	}
+}
+
+func TestMigrateRefusesNewerStore(t *testing.T) {
+	s := openFixture(t, 1)
+	err := s.update(func(txn *badger.Txn) error { return setSchemaVersion(txn, latestSchemaVersion()+1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(fixturePassword); err == nil {
+		t.Fatal("store from a newer build opened")
+	}
+}
+
+func smallBatches(t *testing.T, n int) {
+	old := migrationBatch
+	migrationBatch = n
+	t.Cleanup(func() { migrationBatch = old })
+}
+
+func TestForEachBatchedResumesFromCursor(t *testing.T) {
+	smallBatches(t, 3)
+	s := openFixture(t, 0)
+	prefixes := []string{"contact:", "msg:"}
+	seen := make(map[string]int)
+	batches := 0
+	for more := true; more; batches++ {
+		more = false
+		err := s.update(func(txn *badger.Txn) error {
+			err := forEachBatched(txn, prefixes, func(item *badger.Item) error {
+				seen[string(item.Key())]++
+				return nil
+			})
+			if errors.Is(err, errMoreToMigrate) {
+				more = true
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more {
+			cursor := dumpDB(t, s.DB)[migrationCursorKey]
+			if len(cursor) == 0 {
+				t.Fatalf("batch %d left no cursor", batches)
+			}
+		}
+	}
+
+	want := 0
+	for key := range readFixture(t, 0) {
+		if strings.HasPrefix(key, "contact:") || strings.HasPrefix(key, "msg:") {
+			want++
+			if seen[key] != 1 {
+				t.Errorf("%s seen %d times", key, seen[key])
+			}
+		}
+	}
+	if len(seen) != want {
+		t.Errorf("saw %d keys, want %d", len(seen), want)
+	}
+	if batches != (want+2)/3 {
+		t.Errorf("%d batches for %d keys", batches, want)
+	}
+	if _, ok := dumpDB(t, s.DB)[migrationCursorKey]; ok {
+		t.Error("cursor left after the last batch")
+	}
+}
+
+func TestMigrateResumesInterruptedMigration(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "no-backup")
+	smallBatches(t, 2)
+	s := openFixture(t, 1)
+	// the first batch of jsonToRecords commits, then the app is closed
+	err := s.update(func(txn *badger.Txn) error {
+		if err := jsonToRecords(txn); !errors.Is(err, errMoreToMigrate) {
+			return fmt.Errorf("first batch: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := s.SchemaVersion(); version != 1 {
+		t.Fatalf("version %d after one batch", version)
+	}
+
+	if err := s.migrate(fixturePassword); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := s.SchemaVersion(); version != latestSchemaVersion() {
+		t.Fatalf("version %d", version)
+	}
+	entries := dumpDB(t, s.DB)
+	if _, ok := entries[migrationCursorKey]; ok {
+		t.Error("cursor left behind")
+	}
+	// every value was converted, none skipped by the restart
+	for key, value := range entries {
+		var err error
+		switch {
+		case strings.HasPrefix(key, "msg:"):
+			_, err = unmarshalMessage(value)
+		case strings.HasPrefix(key, "contact:"):
+			_, err = unmarshalContact(value)
+		case strings.HasPrefix(key, "boot:"):
+			_, err = unmarshalAddrInfo(value)
+		case strings.HasPrefix(key, "chat:"):
+			err = unmarshalChat(value, &Chat{})
+		}
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	if got := messageTexts(chatByName(t, s, "Weekend")); !slices.Equal(got, []string{"Saturday?", "works for me"}) {
+		t.Errorf("group messages %q", got)
+	}
+}
+
+func contactID(t *testing.T, s *Store, alias string) string {
+	t.Helper()
+	contacts, err := s.GetAllContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, c := range contacts {
+		if c.Alias == alias {
+			return id
+		}
+	}
+	t.Fatalf("no contact %s", alias)
+	return ""
+}
+
+func TestMigrateMergesDirectChats(t *testing.T) {
+	t.Setenv("MOBILA_MIGRATE", "no-backup")
+	s := openFixture(t, 0)
+	for _, m := range migrations[:2] {
+		if err := s.update(m.apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.update(func(txn *badger.Txn) error { return setSchemaVersion(txn, 2) }); err != nil {
+		t.Fatal(err)
+	}
+	// a build that knew DirectChatID opened a second chat when Alice wrote
+	priv, err := s.LoadPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, _ := peer.IDFromPrivateKey(priv)
+	aliceID := contactID(t, s, "Alice")
+	direct := DirectChatID(aliceID, own.String())
+	if err := s.CreateNewChat(Chat{ID: direct, Name: "Alice", Peers: []string{aliceID, own.String()}}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := s.AddMessage(Message{ID: "n1", ChatID: direct, Author: aliceID, Text: "where did you go?", Sent: later}); err != nil {
+		t.Fatal(err)
+	}
+
+	smallBatches(t, 2)
+	if err := s.migrate(fixturePassword); err != nil {
+		t.Fatal(err)
+	}
+	chats, err := s.GetChatList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 2 {
+		t.Fatalf("%d chats after the move", len(chats))
+	}
+	chat := chatByName(t, s, "Alice")
+	if chat.ID != direct {
+		t.Fatalf("chat with Alice is %s, want %s", chat.ID, direct)
+	}
+	want := []string{"hello Alice", "hey! long time", "coffee tomorrow?", "where did you go?"}
+	if got := messageTexts(chat); !slices.Equal(got, want) {
+		t.Errorf("messages %q, want %q", got, want)
+	}
+	if m, err := s.GetMessage(direct, "a2"); err != nil || m == nil || m.ChatID != direct {
+		t.Errorf("moved message: %+v, %v", m, err)
+	}
+	for key := range dumpDB(t, s.DB) {
+		if strings.Contains(key, "5f0c7a52-3d1e-4b8a-9c6f-2e7d1a4b8c90") {
+			t.Errorf("%s left behind", key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+/*
+#include <stdint.h>
+
+// libopus itself is linked statically by github.com/pion/mediadevices/pkg/codec/opus,
+// which only wraps the encoder, so the decoder API is declared here.
+typedef struct OpusDecoder OpusDecoder;
+OpusDecoder *opus_decoder_create(int32_t Fs, int channels, int *error);
+int opus_decode(OpusDecoder *st, const unsigned char *data, int32_t len, int16_t *pcm, int frame_size, int decode_fec);
+void opus_decoder_destroy(OpusDecoder *st);
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+const (
+	playbackRate     = 48000
+	playbackChannels = 2
+	// 120 ms is the longest Opus packet
+	maxOpusFrame = playbackRate * 120 / 1000
+)
+
+type OpusDecoder struct {
+	dec *C.OpusDecoder
+	pcm []int16
+}
+
+// NewOpusDecoder decodes to 48 kHz stereo no matter how the packets were encoded.
+func NewOpusDecoder() (*OpusDecoder, error) {
+	var cerr C.int
+	dec := C.opus_decoder_create(playbackRate, playbackChannels, &cerr)
+	if cerr != 0 || dec == nil {
+		return nil, fmt.Errorf("opus_decoder_create failed: %d", int(cerr))
+	}
+	return &OpusDecoder{dec: dec, pcm: make([]int16, maxOpusFrame*playbackChannels)}, nil
+}
+
+// Decode returns interleaved samples valid until the next call.
+func (d *OpusDecoder) Decode(packet []byte) ([]int16, error) {
+	if len(packet) == 0 {
+		return nil, nil
+	}
+	n := C.opus_decode(d.dec,
+		(*C.uchar)(unsafe.Pointer(&packet[0])), C.int32_t(len(packet)),
+		(*C.int16_t)(unsafe.Pointer(&d.pcm[0])), maxOpusFrame, 0)
+	if n < 0 {
+		return nil, fmt.Errorf("opus_decode failed: %d", int(n))
+	}
+	return d.pcm[:int(n)*playbackChannels], nil
+}
+
+func (d *OpusDecoder) Close() {
+	C.opus_decoder_destroy(d.dec)
+}
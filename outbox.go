@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// undelivered packets are dropped after this long
+const outboxExpiry = 30 * 24 * time.Hour
+
+// OutboxEntry is a packet waiting for its peer to come online. It is kept
+// unsealed and sealed with whatever session exists at delivery.
+type OutboxEntry struct {
+	ID     string    `json:"id"`
+	PeerID string    `json:"peer_id"`
+	Packet []byte    `json:"packet"`
+	Queued time.Time `json:"queued"`
+}
+
+// deliver sends the packet sealed to the peer. When that fails the packet is
+// queued in the outbox and, if the peer is offline, left at a mailbox; the
+// outbox entry goes once the mailbox accepts it.
+func (s *State) deliver(peerID string, packet *pb.DataPacket) error {
+	err := s.sendSealed(peerID, packet)
+	if err == nil {
+		return nil
+	}
+	data, merr := proto.Marshal(packet)
+	if merr != nil {
+		return merr
+	}
+	entry := OutboxEntry{ID: uuid.NewString(), PeerID: peerID, Packet: data, Queued: time.Now()}
+	if err := s.Store.AddOutboxEntry(entry); err != nil {
+		return err
+	}
+	fmt.Printf("queued packet for %s: %v\n", peerID, err)
+	if errors.Is(err, errNoStream) {
+		s.depositToMailbox(peerID, entry.ID, packet)
+	}
+	return nil
+}
+
+// flushOutbox sends the queued packets of a peer that just connected, oldest
+// first, stopping at the first failure.
+func (s *State) flushOutbox(peerID string) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	entries, err := s.Store.GetOutboxEntries(peerID)
+	if err != nil {
+		fmt.Printf("error loading outbox of %s: %v\n", peerID, err)
+		return
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Queued) > outboxExpiry {
+			fmt.Printf("outbox entry %s for %s expired\n", entry.ID, peerID)
+		} else {
+			var packet pb.DataPacket
+			if err := proto.Unmarshal(entry.Packet, &packet); err != nil {
+				fmt.Printf("corrupt outbox entry %s: %v\n", entry.ID, err)
+			} else if err := s.sendSealed(peerID, &packet); err != nil {
+				fmt.Printf("outbox of %s not flushed: %v\n", peerID, err)
+				return
+			}
+		}
+		if err := s.Store.DeleteOutboxEntry(entry); err != nil {
+			fmt.Printf("error removing outbox entry %s: %v\n", entry.ID, err)
+		}
+	}
+}
+
+// dropOutboxEntries removes the queued packets of a peer with the given IDs.
+func (s *State) dropOutboxEntries(peerID string, ids []string) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	entries, err := s.Store.GetOutboxEntries(peerID)
+	if err != nil {
+		fmt.Printf("error loading outbox of %s: %v\n", peerID, err)
+		return
+	}
+	for _, entry := range entries {
+		if !slices.Contains(ids, entry.ID) {
+			continue
+		}
+		if err := s.Store.DeleteOutboxEntry(entry); err != nil {
+			fmt.Printf("error removing outbox entry %s: %v\n", entry.ID, err)
+		}
+	}
+}
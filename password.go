@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Suffixes of the files a password change leaves behind while it runs.
+const (
+	rekeySuffix      = ".rekey" // the re-encrypted copy being written
+	oldStoreSuffix   = ".old"   // the previous store while the copy takes its place
+	nextHeaderSuffix = ".next"  // header of the copy
+)
+
+// ChangePassword rewrites the whole store into a fresh one encrypted with a
+// key derived from newPassword and a new salt, then swaps it in. An empty
+// newPassword leaves the store unencrypted. On failure the old store stays.
+func (s *Store) ChangePassword(currentPassword, newPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Header.Encrypted != (currentPassword != "") {
+		return ErrWrongPassword
+	}
+	if s.Header.Encrypted {
+		if err := checkStoreKey(s.Path, s.Header.DeriveKey(currentPassword)); err != nil {
+			return err
+		}
+	}
+
+	header, err := NewStoreHeader(newPassword != "")
+	if err != nil {
+		return err
+	}
+	copyPath := s.Path + rekeySuffix
+	if err := os.RemoveAll(copyPath); err != nil {
+		return err
+	}
+	if err := s.copyInto(copyPath, header, newPassword); err != nil {
+		os.RemoveAll(copyPath)
+		return fmt.Errorf("re-encrypting store: %w", err)
+	}
+
+	if err := s.DB.Close(); err != nil {
+		os.RemoveAll(copyPath)
+		return err
+	}
+	swapErr := swapStore(s.Path, header)
+	if swapErr != nil {
+		// swapStore put the old store back, open it again
+		os.RemoveAll(copyPath)
+		header, newPassword = s.Header, currentPassword
+	}
+	db, err := openBadger(s.Path, header, newPassword)
+	if err != nil {
+		return errors.Join(swapErr, err)
+	}
+	s.DB, s.Header, s.Salt = db, header, header.Salt
+	return swapErr
+}
+
+func (s *Store) copyInto(path string, header *StoreHeader, password string) error {
+	dst, err := openBadger(path, header, password)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.DB.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	err = dst.Load(pr, 256)
+	pr.CloseWithError(err)
+	return errors.Join(err, dst.Close())
+}
+
+// swapStore moves the re-encrypted copy in place of the closed store at
+// dbPath, undoing every step if one fails.
+func swapStore(dbPath string, header *StoreHeader) error {
+	headerPath := dbPath + ".header"
+	nextHeader := headerPath + nextHeaderSuffix
+	if err := writeStoreHeader(nextHeader, header); err != nil {
+		return err
+	}
+	if err := os.Rename(dbPath, dbPath+oldStoreSuffix); err != nil {
+		os.Remove(nextHeader)
+		return err
+	}
+	if err := os.Rename(dbPath+rekeySuffix, dbPath); err != nil {
+		os.Rename(dbPath+oldStoreSuffix, dbPath)
+		os.Remove(nextHeader)
+		return err
+	}
+	if err := os.Rename(nextHeader, headerPath); err != nil {
+		os.Rename(dbPath, dbPath+rekeySuffix)
+		os.Rename(dbPath+oldStoreSuffix, dbPath)
+		os.Remove(nextHeader)
+		return err
+	}
+	if err := os.RemoveAll(dbPath + oldStoreSuffix); err != nil {
+		fmt.Printf("error removing the old store: %v\n", err)
+	}
+	return nil
+}
+
+// recoverPasswordChange finishes or undoes a password change that was
+// interrupted, judging by which of its files are left.
+func recoverPasswordChange(dbPath string) error {
+	headerPath := dbPath + ".header"
+	nextHeader := headerPath + nextHeaderSuffix
+	_, errOld := os.Stat(dbPath + oldStoreSuffix)
+	_, errNext := os.Stat(nextHeader)
+	switch {
+	case errOld == nil && errNext == nil:
+		if _, err := os.Stat(dbPath); err == nil {
+			// the copy is in place, only its header is missing
+			if err := os.Rename(nextHeader, headerPath); err != nil {
+				return err
+			}
+		} else {
+			if err := os.Rename(dbPath+oldStoreSuffix, dbPath); err != nil {
+				return err
+			}
+			os.Remove(nextHeader)
+		}
+	case errNext == nil:
+		os.Remove(nextHeader)
+	}
+	os.RemoveAll(dbPath + oldStoreSuffix)
+	return os.RemoveAll(dbPath + rekeySuffix)
+}
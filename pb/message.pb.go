@@ -21,6 +21,98 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type MessageEdit_Kind int32
+
+const (
+	MessageEdit_EDIT   MessageEdit_Kind = 0
+	MessageEdit_DELETE MessageEdit_Kind = 1
+)
+
+// Enum value maps for MessageEdit_Kind.
+var (
+	MessageEdit_Kind_name = map[int32]string{
+		0: "EDIT",
+		1: "DELETE",
+	}
+	MessageEdit_Kind_value = map[string]int32{
+		"EDIT":   0,
+		"DELETE": 1,
+	}
+)
+
+func (x MessageEdit_Kind) Enum() *MessageEdit_Kind {
+	p := new(MessageEdit_Kind)
+	*p = x
+	return p
+}
+
+func (x MessageEdit_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MessageEdit_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[0].Descriptor()
+}
+
+func (MessageEdit_Kind) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[0]
+}
+
+func (x MessageEdit_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MessageEdit_Kind.Descriptor instead.
+func (MessageEdit_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{6, 0}
+}
+
+type Reaction_Kind int32
+
+const (
+	Reaction_ADD    Reaction_Kind = 0
+	Reaction_REMOVE Reaction_Kind = 1
+)
+
+// Enum value maps for Reaction_Kind.
+var (
+	Reaction_Kind_name = map[int32]string{
+		0: "ADD",
+		1: "REMOVE",
+	}
+	Reaction_Kind_value = map[string]int32{
+		"ADD":    0,
+		"REMOVE": 1,
+	}
+)
+
+func (x Reaction_Kind) Enum() *Reaction_Kind {
+	p := new(Reaction_Kind)
+	*p = x
+	return p
+}
+
+func (x Reaction_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Reaction_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[1].Descriptor()
+}
+
+func (Reaction_Kind) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[1]
+}
+
+func (x Reaction_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Reaction_Kind.Descriptor instead.
+func (Reaction_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{7, 0}
+}
+
 type StreamInfo_Status int32
 
 const (
@@ -51,11 +143,11 @@ func (x StreamInfo_Status) String() string {
 }
 
 func (StreamInfo_Status) Descriptor() protoreflect.EnumDescriptor {
-	return file_pb_message_proto_enumTypes[0].Descriptor()
+	return file_pb_message_proto_enumTypes[2].Descriptor()
 }
 
 func (StreamInfo_Status) Type() protoreflect.EnumType {
-	return &file_pb_message_proto_enumTypes[0]
+	return &file_pb_message_proto_enumTypes[2]
 }
 
 func (x StreamInfo_Status) Number() protoreflect.EnumNumber {
@@ -64,7 +156,7 @@ func (x StreamInfo_Status) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use StreamInfo_Status.Descriptor instead.
 func (StreamInfo_Status) EnumDescriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{4, 0}
+	return file_pb_message_proto_rawDescGZIP(), []int{10, 0}
 }
 
 type StreamInfoResponse_Answer int32
@@ -97,11 +189,11 @@ func (x StreamInfoResponse_Answer) String() string {
 }
 
 func (StreamInfoResponse_Answer) Descriptor() protoreflect.EnumDescriptor {
-	return file_pb_message_proto_enumTypes[1].Descriptor()
+	return file_pb_message_proto_enumTypes[3].Descriptor()
 }
 
 func (StreamInfoResponse_Answer) Type() protoreflect.EnumType {
-	return &file_pb_message_proto_enumTypes[1]
+	return &file_pb_message_proto_enumTypes[3]
 }
 
 func (x StreamInfoResponse_Answer) Number() protoreflect.EnumNumber {
@@ -110,7 +202,221 @@ func (x StreamInfoResponse_Answer) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use StreamInfoResponse_Answer.Descriptor instead.
 func (StreamInfoResponse_Answer) EnumDescriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{5, 0}
+	return file_pb_message_proto_rawDescGZIP(), []int{11, 0}
+}
+
+type CallSignal_Kind int32
+
+const (
+	CallSignal_INVITE  CallSignal_Kind = 0
+	CallSignal_ACCEPT  CallSignal_Kind = 1
+	CallSignal_DECLINE CallSignal_Kind = 2
+	CallSignal_BUSY    CallSignal_Kind = 3
+	CallSignal_CANCEL  CallSignal_Kind = 4
+	CallSignal_HANGUP  CallSignal_Kind = 5
+)
+
+// Enum value maps for CallSignal_Kind.
+var (
+	CallSignal_Kind_name = map[int32]string{
+		0: "INVITE",
+		1: "ACCEPT",
+		2: "DECLINE",
+		3: "BUSY",
+		4: "CANCEL",
+		5: "HANGUP",
+	}
+	CallSignal_Kind_value = map[string]int32{
+		"INVITE":  0,
+		"ACCEPT":  1,
+		"DECLINE": 2,
+		"BUSY":    3,
+		"CANCEL":  4,
+		"HANGUP":  5,
+	}
+)
+
+func (x CallSignal_Kind) Enum() *CallSignal_Kind {
+	p := new(CallSignal_Kind)
+	*p = x
+	return p
+}
+
+func (x CallSignal_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CallSignal_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[4].Descriptor()
+}
+
+func (CallSignal_Kind) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[4]
+}
+
+func (x CallSignal_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CallSignal_Kind.Descriptor instead.
+func (CallSignal_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{12, 0}
+}
+
+type Receipt_Kind int32
+
+const (
+	Receipt_DELIVERED Receipt_Kind = 0
+	Receipt_READ      Receipt_Kind = 1
+)
+
+// Enum value maps for Receipt_Kind.
+var (
+	Receipt_Kind_name = map[int32]string{
+		0: "DELIVERED",
+		1: "READ",
+	}
+	Receipt_Kind_value = map[string]int32{
+		"DELIVERED": 0,
+		"READ":      1,
+	}
+)
+
+func (x Receipt_Kind) Enum() *Receipt_Kind {
+	p := new(Receipt_Kind)
+	*p = x
+	return p
+}
+
+func (x Receipt_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Receipt_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[5].Descriptor()
+}
+
+func (Receipt_Kind) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[5]
+}
+
+func (x Receipt_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Receipt_Kind.Descriptor instead.
+func (Receipt_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{18, 0}
+}
+
+type MembershipChange_Kind int32
+
+const (
+	MembershipChange_CREATE   MembershipChange_Kind = 0
+	MembershipChange_INVITE   MembershipChange_Kind = 1
+	MembershipChange_JOIN     MembershipChange_Kind = 2
+	MembershipChange_LEAVE    MembershipChange_Kind = 3
+	MembershipChange_KICK     MembershipChange_Kind = 4
+	MembershipChange_RENAME   MembershipChange_Kind = 5
+	MembershipChange_SET_ROLE MembershipChange_Kind = 6
+)
+
+// Enum value maps for MembershipChange_Kind.
+var (
+	MembershipChange_Kind_name = map[int32]string{
+		0: "CREATE",
+		1: "INVITE",
+		2: "JOIN",
+		3: "LEAVE",
+		4: "KICK",
+		5: "RENAME",
+		6: "SET_ROLE",
+	}
+	MembershipChange_Kind_value = map[string]int32{
+		"CREATE":   0,
+		"INVITE":   1,
+		"JOIN":     2,
+		"LEAVE":    3,
+		"KICK":     4,
+		"RENAME":   5,
+		"SET_ROLE": 6,
+	}
+)
+
+func (x MembershipChange_Kind) Enum() *MembershipChange_Kind {
+	p := new(MembershipChange_Kind)
+	*p = x
+	return p
+}
+
+func (x MembershipChange_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MembershipChange_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[6].Descriptor()
+}
+
+func (MembershipChange_Kind) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[6]
+}
+
+func (x MembershipChange_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MembershipChange_Kind.Descriptor instead.
+func (MembershipChange_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{23, 0}
+}
+
+type MembershipChange_Role int32
+
+const (
+	MembershipChange_MEMBER MembershipChange_Role = 0
+	MembershipChange_ADMIN  MembershipChange_Role = 1
+	MembershipChange_OWNER  MembershipChange_Role = 2
+)
+
+// Enum value maps for MembershipChange_Role.
+var (
+	MembershipChange_Role_name = map[int32]string{
+		0: "MEMBER",
+		1: "ADMIN",
+		2: "OWNER",
+	}
+	MembershipChange_Role_value = map[string]int32{
+		"MEMBER": 0,
+		"ADMIN":  1,
+		"OWNER":  2,
+	}
+)
+
+func (x MembershipChange_Role) Enum() *MembershipChange_Role {
+	p := new(MembershipChange_Role)
+	*p = x
+	return p
+}
+
+func (x MembershipChange_Role) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MembershipChange_Role) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_message_proto_enumTypes[7].Descriptor()
+}
+
+func (MembershipChange_Role) Type() protoreflect.EnumType {
+	return &file_pb_message_proto_enumTypes[7]
+}
+
+func (x MembershipChange_Role) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MembershipChange_Role.Descriptor instead.
+func (MembershipChange_Role) EnumDescriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{23, 1}
 }
 
 type Ping struct {
@@ -186,15 +492,21 @@ func (*Pong) Descriptor() ([]byte, []int) {
 }
 
 type Static struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
-	PrevMessageId string                 `protobuf:"bytes,2,opt,name=prev_message_id,json=prevMessageId,proto3" json:"prev_message_id,omitempty"`
-	MessageId     string                 `protobuf:"bytes,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
-	MimeType      string                 `protobuf:"bytes,4,opt,name=mimeType,proto3" json:"mimeType,omitempty"`
-	AuthorId      string                 `protobuf:"bytes,5,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
-	Data          []byte                 `protobuf:"bytes,6,opt,name=data,proto3" json:"data,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ChatId          string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	PrevMessageId   string                 `protobuf:"bytes,2,opt,name=prev_message_id,json=prevMessageId,proto3" json:"prev_message_id,omitempty"`
+	MessageId       string                 `protobuf:"bytes,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	MimeType        string                 `protobuf:"bytes,4,opt,name=mimeType,proto3" json:"mimeType,omitempty"`
+	AuthorId        string                 `protobuf:"bytes,5,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
+	Data            []byte                 `protobuf:"bytes,6,opt,name=data,proto3" json:"data,omitempty"`
+	Timestamp       int64                  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	MergeMessageIds []string               `protobuf:"bytes,8,rep,name=merge_message_ids,json=mergeMessageIds,proto3" json:"merge_message_ids,omitempty"`
+	// by the libp2p key of the author, see staticSignedData
+	Signature []byte `protobuf:"bytes,9,opt,name=signature,proto3" json:"signature,omitempty"`
+	// the message this one answers, if any
+	ReplyToMessageId string `protobuf:"bytes,10,opt,name=reply_to_message_id,json=replyToMessageId,proto3" json:"reply_to_message_id,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
 }
 
 func (x *Static) Reset() {
@@ -269,28 +581,62 @@ func (x *Static) GetData() []byte {
 	return nil
 }
 
-type StaticResendRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
-	MessageId     string                 `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+func (x *Static) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Static) GetMergeMessageIds() []string {
+	if x != nil {
+		return x.MergeMessageIds
+	}
+	return nil
+}
+
+func (x *Static) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *Static) GetReplyToMessageId() string {
+	if x != nil {
+		return x.ReplyToMessageId
+	}
+	return ""
+}
+
+// Attachment is the manifest carried in the data of a Static whose mime type
+// is not text/plain. The content is fetched separately in chunks.
+type Attachment struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// sha256 of the whole content
+	Hash          []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	Size          uint64 `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Name          string `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	MimeType      string `protobuf:"bytes,4,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"`
+	ChunkSize     uint32 `protobuf:"varint,5,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *StaticResendRequest) Reset() {
-	*x = StaticResendRequest{}
+func (x *Attachment) Reset() {
+	*x = Attachment{}
 	mi := &file_pb_message_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *StaticResendRequest) String() string {
+func (x *Attachment) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*StaticResendRequest) ProtoMessage() {}
+func (*Attachment) ProtoMessage() {}
 
-func (x *StaticResendRequest) ProtoReflect() protoreflect.Message {
+func (x *Attachment) ProtoReflect() protoreflect.Message {
 	mi := &file_pb_message_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -302,100 +648,1475 @@ func (x *StaticResendRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use StaticResendRequest.ProtoReflect.Descriptor instead.
-func (*StaticResendRequest) Descriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{3}
+// Deprecated: Use Attachment.ProtoReflect.Descriptor instead.
+func (*Attachment) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Attachment) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *Attachment) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Attachment) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Attachment) GetMimeType() string {
+	if x != nil {
+		return x.MimeType
+	}
+	return ""
+}
+
+func (x *Attachment) GetChunkSize() uint32 {
+	if x != nil {
+		return x.ChunkSize
+	}
+	return 0
+}
+
+// BlobRequest asks a member of the chat for chunks of an attachment.
+type BlobRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	Hash          []byte                 `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	Chunks        []uint32               `protobuf:"varint,3,rep,packed,name=chunks,proto3" json:"chunks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlobRequest) Reset() {
+	*x = BlobRequest{}
+	mi := &file_pb_message_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlobRequest) ProtoMessage() {}
+
+func (x *BlobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlobRequest.ProtoReflect.Descriptor instead.
+func (*BlobRequest) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *BlobRequest) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *BlobRequest) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *BlobRequest) GetChunks() []uint32 {
+	if x != nil {
+		return x.Chunks
+	}
+	return nil
+}
+
+type BlobChunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Hash          []byte                 `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	Index         uint32                 `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	Data          []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlobChunk) Reset() {
+	*x = BlobChunk{}
+	mi := &file_pb_message_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlobChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlobChunk) ProtoMessage() {}
+
+func (x *BlobChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlobChunk.ProtoReflect.Descriptor instead.
+func (*BlobChunk) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *BlobChunk) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *BlobChunk) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *BlobChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// MessageEdit replaces the text of a message or deletes it. Only the author
+// of the message may do either.
+type MessageEdit struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          MessageEdit_Kind       `protobuf:"varint,1,opt,name=kind,proto3,enum=pb.MessageEdit_Kind" json:"kind,omitempty"`
+	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	EditId        string                 `protobuf:"bytes,3,opt,name=edit_id,json=editId,proto3" json:"edit_id,omitempty"`
+	MessageId     string                 `protobuf:"bytes,4,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	AuthorId      string                 `protobuf:"bytes,5,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
+	Text          string                 `protobuf:"bytes,6,opt,name=text,proto3" json:"text,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Signature     []byte                 `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MessageEdit) Reset() {
+	*x = MessageEdit{}
+	mi := &file_pb_message_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MessageEdit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MessageEdit) ProtoMessage() {}
+
+func (x *MessageEdit) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MessageEdit.ProtoReflect.Descriptor instead.
+func (*MessageEdit) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *MessageEdit) GetKind() MessageEdit_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return MessageEdit_EDIT
+}
+
+func (x *MessageEdit) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *MessageEdit) GetEditId() string {
+	if x != nil {
+		return x.EditId
+	}
+	return ""
+}
+
+func (x *MessageEdit) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *MessageEdit) GetAuthorId() string {
+	if x != nil {
+		return x.AuthorId
+	}
+	return ""
+}
+
+func (x *MessageEdit) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *MessageEdit) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *MessageEdit) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+// Reaction adds or takes back the emoji of a member on a message.
+type Reaction struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          Reaction_Kind          `protobuf:"varint,1,opt,name=kind,proto3,enum=pb.Reaction_Kind" json:"kind,omitempty"`
+	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	ReactionId    string                 `protobuf:"bytes,3,opt,name=reaction_id,json=reactionId,proto3" json:"reaction_id,omitempty"`
+	MessageId     string                 `protobuf:"bytes,4,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	AuthorId      string                 `protobuf:"bytes,5,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
+	Emoji         string                 `protobuf:"bytes,6,opt,name=emoji,proto3" json:"emoji,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Signature     []byte                 `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reaction) Reset() {
+	*x = Reaction{}
+	mi := &file_pb_message_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reaction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reaction) ProtoMessage() {}
+
+func (x *Reaction) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reaction.ProtoReflect.Descriptor instead.
+func (*Reaction) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Reaction) GetKind() Reaction_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return Reaction_ADD
+}
+
+func (x *Reaction) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *Reaction) GetReactionId() string {
+	if x != nil {
+		return x.ReactionId
+	}
+	return ""
+}
+
+func (x *Reaction) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *Reaction) GetAuthorId() string {
+	if x != nil {
+		return x.AuthorId
+	}
+	return ""
+}
+
+func (x *Reaction) GetEmoji() string {
+	if x != nil {
+		return x.Emoji
+	}
+	return ""
+}
+
+func (x *Reaction) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Reaction) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+type StaticResendRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	MessageId     string                 `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StaticResendRequest) Reset() {
+	*x = StaticResendRequest{}
+	mi := &file_pb_message_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StaticResendRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StaticResendRequest) ProtoMessage() {}
+
+func (x *StaticResendRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StaticResendRequest.ProtoReflect.Descriptor instead.
+func (*StaticResendRequest) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *StaticResendRequest) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *StaticResendRequest) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+type ChatHeads struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	MessageIds    []string               `protobuf:"bytes,2,rep,name=message_ids,json=messageIds,proto3" json:"message_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChatHeads) Reset() {
+	*x = ChatHeads{}
+	mi := &file_pb_message_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChatHeads) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChatHeads) ProtoMessage() {}
+
+func (x *ChatHeads) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChatHeads.ProtoReflect.Descriptor instead.
+func (*ChatHeads) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ChatHeads) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *ChatHeads) GetMessageIds() []string {
+	if x != nil {
+		return x.MessageIds
+	}
+	return nil
+}
+
+type StreamInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        StreamInfo_Status      `protobuf:"varint,1,opt,name=status,proto3,enum=pb.StreamInfo_Status" json:"status,omitempty"`
+	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamInfo) Reset() {
+	*x = StreamInfo{}
+	mi := &file_pb_message_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamInfo) ProtoMessage() {}
+
+func (x *StreamInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamInfo.ProtoReflect.Descriptor instead.
+func (*StreamInfo) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *StreamInfo) GetStatus() StreamInfo_Status {
+	if x != nil {
+		return x.Status
+	}
+	return StreamInfo_ACTIVE
+}
+
+func (x *StreamInfo) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+type StreamInfoResponse struct {
+	state         protoimpl.MessageState    `protogen:"open.v1"`
+	Answer        StreamInfoResponse_Answer `protobuf:"varint,1,opt,name=answer,proto3,enum=pb.StreamInfoResponse_Answer" json:"answer,omitempty"`
+	ChatId        string                    `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamInfoResponse) Reset() {
+	*x = StreamInfoResponse{}
+	mi := &file_pb_message_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamInfoResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamInfoResponse) ProtoMessage() {}
+
+func (x *StreamInfoResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamInfoResponse.ProtoReflect.Descriptor instead.
+func (*StreamInfoResponse) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *StreamInfoResponse) GetAnswer() StreamInfoResponse_Answer {
+	if x != nil {
+		return x.Answer
+	}
+	return StreamInfoResponse_ENTER
+}
+
+func (x *StreamInfoResponse) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+type CallSignal struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          CallSignal_Kind        `protobuf:"varint,1,opt,name=kind,proto3,enum=pb.CallSignal_Kind" json:"kind,omitempty"`
+	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	CallId        string                 `protobuf:"bytes,3,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallSignal) Reset() {
+	*x = CallSignal{}
+	mi := &file_pb_message_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallSignal) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallSignal) ProtoMessage() {}
+
+func (x *CallSignal) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallSignal.ProtoReflect.Descriptor instead.
+func (*CallSignal) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *CallSignal) GetKind() CallSignal_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return CallSignal_INVITE
+}
+
+func (x *CallSignal) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *CallSignal) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+// PrekeyBundle carries the X25519 keys of a node for X3DH, signed by its
+// libp2p Ed25519 identity over "mobila prekey bundle" || identity_key || signed_prekey.
+type PrekeyBundle struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IdentityKey   []byte                 `protobuf:"bytes,1,opt,name=identity_key,json=identityKey,proto3" json:"identity_key,omitempty"`
+	SignedPrekey  []byte                 `protobuf:"bytes,2,opt,name=signed_prekey,json=signedPrekey,proto3" json:"signed_prekey,omitempty"`
+	Signature     []byte                 `protobuf:"bytes,3,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrekeyBundle) Reset() {
+	*x = PrekeyBundle{}
+	mi := &file_pb_message_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrekeyBundle) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrekeyBundle) ProtoMessage() {}
+
+func (x *PrekeyBundle) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrekeyBundle.ProtoReflect.Descriptor instead.
+func (*PrekeyBundle) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *PrekeyBundle) GetIdentityKey() []byte {
+	if x != nil {
+		return x.IdentityKey
+	}
+	return nil
+}
+
+func (x *PrekeyBundle) GetSignedPrekey() []byte {
+	if x != nil {
+		return x.SignedPrekey
+	}
+	return nil
+}
+
+func (x *PrekeyBundle) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+// SessionInit is attached to sealed packets until the initiator of a session
+// hears back from the responder.
+type SessionInit struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IdentityKey   []byte                 `protobuf:"bytes,1,opt,name=identity_key,json=identityKey,proto3" json:"identity_key,omitempty"`
+	EphemeralKey  []byte                 `protobuf:"bytes,2,opt,name=ephemeral_key,json=ephemeralKey,proto3" json:"ephemeral_key,omitempty"`
+	SignedPrekey  []byte                 `protobuf:"bytes,3,opt,name=signed_prekey,json=signedPrekey,proto3" json:"signed_prekey,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionInit) Reset() {
+	*x = SessionInit{}
+	mi := &file_pb_message_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionInit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionInit) ProtoMessage() {}
+
+func (x *SessionInit) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionInit.ProtoReflect.Descriptor instead.
+func (*SessionInit) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SessionInit) GetIdentityKey() []byte {
+	if x != nil {
+		return x.IdentityKey
+	}
+	return nil
+}
+
+func (x *SessionInit) GetEphemeralKey() []byte {
+	if x != nil {
+		return x.EphemeralKey
+	}
+	return nil
+}
+
+func (x *SessionInit) GetSignedPrekey() []byte {
+	if x != nil {
+		return x.SignedPrekey
+	}
+	return nil
+}
+
+// Sealed is a DataPacket encrypted with a Double Ratchet session.
+type Sealed struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SessionId     []byte                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Init          *SessionInit           `protobuf:"bytes,2,opt,name=init,proto3" json:"init,omitempty"`
+	RatchetKey    []byte                 `protobuf:"bytes,3,opt,name=ratchet_key,json=ratchetKey,proto3" json:"ratchet_key,omitempty"`
+	PreviousCount uint32                 `protobuf:"varint,4,opt,name=previous_count,json=previousCount,proto3" json:"previous_count,omitempty"`
+	Count         uint32                 `protobuf:"varint,5,opt,name=count,proto3" json:"count,omitempty"`
+	Ciphertext    []byte                 `protobuf:"bytes,6,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Sealed) Reset() {
+	*x = Sealed{}
+	mi := &file_pb_message_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Sealed) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Sealed) ProtoMessage() {}
+
+func (x *Sealed) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Sealed.ProtoReflect.Descriptor instead.
+func (*Sealed) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *Sealed) GetSessionId() []byte {
+	if x != nil {
+		return x.SessionId
+	}
+	return nil
+}
+
+func (x *Sealed) GetInit() *SessionInit {
+	if x != nil {
+		return x.Init
+	}
+	return nil
+}
+
+func (x *Sealed) GetRatchetKey() []byte {
+	if x != nil {
+		return x.RatchetKey
+	}
+	return nil
+}
+
+func (x *Sealed) GetPreviousCount() uint32 {
+	if x != nil {
+		return x.PreviousCount
+	}
+	return 0
+}
+
+func (x *Sealed) GetCount() uint32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Sealed) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+// SenderKey hands the chain key of the sender's current group key to one
+// member; it only travels inside Sealed.
+type SenderKey struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	ChatId    string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	KeyId     []byte                 `protobuf:"bytes,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	ChainKey  []byte                 `protobuf:"bytes,3,opt,name=chain_key,json=chainKey,proto3" json:"chain_key,omitempty"`
+	Iteration uint32                 `protobuf:"varint,4,opt,name=iteration,proto3" json:"iteration,omitempty"`
+	// ed25519 public key the packets under this key are signed with
+	SigningKey    []byte `protobuf:"bytes,5,opt,name=signing_key,json=signingKey,proto3" json:"signing_key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SenderKey) Reset() {
+	*x = SenderKey{}
+	mi := &file_pb_message_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SenderKey) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SenderKey) ProtoMessage() {}
+
+func (x *SenderKey) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SenderKey.ProtoReflect.Descriptor instead.
+func (*SenderKey) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *SenderKey) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *SenderKey) GetKeyId() []byte {
+	if x != nil {
+		return x.KeyId
+	}
+	return nil
+}
+
+func (x *SenderKey) GetChainKey() []byte {
+	if x != nil {
+		return x.ChainKey
+	}
+	return nil
+}
+
+func (x *SenderKey) GetIteration() uint32 {
+	if x != nil {
+		return x.Iteration
+	}
+	return 0
+}
+
+func (x *SenderKey) GetSigningKey() []byte {
+	if x != nil {
+		return x.SigningKey
+	}
+	return nil
+}
+
+// GroupSealed is a DataPacket encrypted once with the sender key of its author
+// and sent as is to every member.
+type GroupSealed struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	ChatId     string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	SenderId   string                 `protobuf:"bytes,2,opt,name=sender_id,json=senderId,proto3" json:"sender_id,omitempty"`
+	KeyId      []byte                 `protobuf:"bytes,3,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Iteration  uint32                 `protobuf:"varint,4,opt,name=iteration,proto3" json:"iteration,omitempty"`
+	Ciphertext []byte                 `protobuf:"bytes,5,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	// by the signing key of the sender key, see groupSignedData
+	Signature     []byte `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GroupSealed) Reset() {
+	*x = GroupSealed{}
+	mi := &file_pb_message_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GroupSealed) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GroupSealed) ProtoMessage() {}
+
+func (x *GroupSealed) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GroupSealed.ProtoReflect.Descriptor instead.
+func (*GroupSealed) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *GroupSealed) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *GroupSealed) GetSenderId() string {
+	if x != nil {
+		return x.SenderId
+	}
+	return ""
+}
+
+func (x *GroupSealed) GetKeyId() []byte {
+	if x != nil {
+		return x.KeyId
+	}
+	return nil
+}
+
+func (x *GroupSealed) GetIteration() uint32 {
+	if x != nil {
+		return x.Iteration
+	}
+	return 0
+}
+
+func (x *GroupSealed) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+func (x *GroupSealed) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+// Receipt tells the author of messages that they reached or were read by the sender.
+type Receipt struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          Receipt_Kind           `protobuf:"varint,1,opt,name=kind,proto3,enum=pb.Receipt_Kind" json:"kind,omitempty"`
+	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	MessageIds    []string               `protobuf:"bytes,3,rep,name=message_ids,json=messageIds,proto3" json:"message_ids,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Receipt) Reset() {
+	*x = Receipt{}
+	mi := &file_pb_message_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Receipt) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Receipt) ProtoMessage() {}
+
+func (x *Receipt) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Receipt.ProtoReflect.Descriptor instead.
+func (*Receipt) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *Receipt) GetKind() Receipt_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return Receipt_DELIVERED
+}
+
+func (x *Receipt) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *Receipt) GetMessageIds() []string {
+	if x != nil {
+		return x.MessageIds
+	}
+	return nil
+}
+
+func (x *Receipt) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+// MailboxDeposit asks an always-on contact to hold a sealed packet for a
+// recipient that is offline.
+type MailboxDeposit struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	EnvelopeId  string                 `protobuf:"bytes,1,opt,name=envelope_id,json=envelopeId,proto3" json:"envelope_id,omitempty"`
+	RecipientId string                 `protobuf:"bytes,2,opt,name=recipient_id,json=recipientId,proto3" json:"recipient_id,omitempty"`
+	Expires     int64                  `protobuf:"varint,3,opt,name=expires,proto3" json:"expires,omitempty"`
+	Sealed      *Sealed                `protobuf:"bytes,4,opt,name=sealed,proto3" json:"sealed,omitempty"`
+	// lets the recipient answer a session started in the envelope
+	SenderBundle  *PrekeyBundle `protobuf:"bytes,5,opt,name=sender_bundle,json=senderBundle,proto3" json:"sender_bundle,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MailboxDeposit) Reset() {
+	*x = MailboxDeposit{}
+	mi := &file_pb_message_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MailboxDeposit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MailboxDeposit) ProtoMessage() {}
+
+func (x *MailboxDeposit) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MailboxDeposit.ProtoReflect.Descriptor instead.
+func (*MailboxDeposit) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *MailboxDeposit) GetEnvelopeId() string {
+	if x != nil {
+		return x.EnvelopeId
+	}
+	return ""
+}
+
+func (x *MailboxDeposit) GetRecipientId() string {
+	if x != nil {
+		return x.RecipientId
+	}
+	return ""
+}
+
+func (x *MailboxDeposit) GetExpires() int64 {
+	if x != nil {
+		return x.Expires
+	}
+	return 0
+}
+
+func (x *MailboxDeposit) GetSealed() *Sealed {
+	if x != nil {
+		return x.Sealed
+	}
+	return nil
+}
+
+func (x *MailboxDeposit) GetSenderBundle() *PrekeyBundle {
+	if x != nil {
+		return x.SenderBundle
+	}
+	return nil
+}
+
+// MailboxDelivery hands a deposited envelope to its recipient, who answers
+// with MailboxAck.
+type MailboxDelivery struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	EnvelopeId    string                 `protobuf:"bytes,1,opt,name=envelope_id,json=envelopeId,proto3" json:"envelope_id,omitempty"`
+	SenderId      string                 `protobuf:"bytes,2,opt,name=sender_id,json=senderId,proto3" json:"sender_id,omitempty"`
+	Sealed        *Sealed                `protobuf:"bytes,3,opt,name=sealed,proto3" json:"sealed,omitempty"`
+	SenderBundle  *PrekeyBundle          `protobuf:"bytes,4,opt,name=sender_bundle,json=senderBundle,proto3" json:"sender_bundle,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MailboxDelivery) Reset() {
+	*x = MailboxDelivery{}
+	mi := &file_pb_message_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MailboxDelivery) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MailboxDelivery) ProtoMessage() {}
+
+func (x *MailboxDelivery) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MailboxDelivery.ProtoReflect.Descriptor instead.
+func (*MailboxDelivery) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *MailboxDelivery) GetEnvelopeId() string {
+	if x != nil {
+		return x.EnvelopeId
+	}
+	return ""
+}
+
+func (x *MailboxDelivery) GetSenderId() string {
+	if x != nil {
+		return x.SenderId
+	}
+	return ""
+}
+
+func (x *MailboxDelivery) GetSealed() *Sealed {
+	if x != nil {
+		return x.Sealed
+	}
+	return nil
+}
+
+func (x *MailboxDelivery) GetSenderBundle() *PrekeyBundle {
+	if x != nil {
+		return x.SenderBundle
+	}
+	return nil
+}
+
+type MailboxAck struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	EnvelopeIds   []string               `protobuf:"bytes,1,rep,name=envelope_ids,json=envelopeIds,proto3" json:"envelope_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MailboxAck) Reset() {
+	*x = MailboxAck{}
+	mi := &file_pb_message_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MailboxAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MailboxAck) ProtoMessage() {}
+
+func (x *MailboxAck) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MailboxAck.ProtoReflect.Descriptor instead.
+func (*MailboxAck) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *MailboxAck) GetEnvelopeIds() []string {
+	if x != nil {
+		return x.EnvelopeIds
+	}
+	return nil
+}
+
+// MailboxAccepted tells the depositor that the mailbox holds its envelopes,
+// which it then drops from its outbox so they do not arrive twice.
+type MailboxAccepted struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RecipientId   string                 `protobuf:"bytes,1,opt,name=recipient_id,json=recipientId,proto3" json:"recipient_id,omitempty"`
+	EnvelopeIds   []string               `protobuf:"bytes,2,rep,name=envelope_ids,json=envelopeIds,proto3" json:"envelope_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MailboxAccepted) Reset() {
+	*x = MailboxAccepted{}
+	mi := &file_pb_message_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MailboxAccepted) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MailboxAccepted) ProtoMessage() {}
+
+func (x *MailboxAccepted) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MailboxAccepted.ProtoReflect.Descriptor instead.
+func (*MailboxAccepted) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *MailboxAccepted) GetRecipientId() string {
+	if x != nil {
+		return x.RecipientId
+	}
+	return ""
+}
+
+func (x *MailboxAccepted) GetEnvelopeIds() []string {
+	if x != nil {
+		return x.EnvelopeIds
+	}
+	return nil
+}
+
+// MembershipChange is one step of the membership log of a group chat. Every
+// member replays the log in (timestamp, change_id) order.
+type MembershipChange struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Kind     MembershipChange_Kind  `protobuf:"varint,1,opt,name=kind,proto3,enum=pb.MembershipChange_Kind" json:"kind,omitempty"`
+	ChatId   string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	ChangeId string                 `protobuf:"bytes,3,opt,name=change_id,json=changeId,proto3" json:"change_id,omitempty"`
+	AuthorId string                 `protobuf:"bytes,4,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
+	// CREATE, INVITE, KICK and SET_ROLE: the peers the change is about
+	PeerIds []string `protobuf:"bytes,5,rep,name=peer_ids,json=peerIds,proto3" json:"peer_ids,omitempty"`
+	// CREATE and RENAME
+	Name      string `protobuf:"bytes,6,opt,name=name,proto3" json:"name,omitempty"`
+	Timestamp int64  `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// SET_ROLE: the role given to peer_ids
+	Role MembershipChange_Role `protobuf:"varint,8,opt,name=role,proto3,enum=pb.MembershipChange_Role" json:"role,omitempty"`
+	// by the libp2p key of the author, see membershipSignedData
+	Signature []byte `protobuf:"bytes,9,opt,name=signature,proto3" json:"signature,omitempty"`
+	// the heads of the log the author had when making the change
+	ParentIds     []string `protobuf:"bytes,10,rep,name=parent_ids,json=parentIds,proto3" json:"parent_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MembershipChange) Reset() {
+	*x = MembershipChange{}
+	mi := &file_pb_message_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MembershipChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MembershipChange) ProtoMessage() {}
+
+func (x *MembershipChange) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MembershipChange.ProtoReflect.Descriptor instead.
+func (*MembershipChange) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{23}
 }
 
-func (x *StaticResendRequest) GetChatId() string {
+func (x *MembershipChange) GetKind() MembershipChange_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return MembershipChange_CREATE
+}
+
+func (x *MembershipChange) GetChatId() string {
 	if x != nil {
 		return x.ChatId
 	}
 	return ""
 }
 
-func (x *StaticResendRequest) GetMessageId() string {
+func (x *MembershipChange) GetChangeId() string {
 	if x != nil {
-		return x.MessageId
+		return x.ChangeId
 	}
 	return ""
 }
 
-type StreamInfo struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Status        StreamInfo_Status      `protobuf:"varint,1,opt,name=status,proto3,enum=pb.StreamInfo_Status" json:"status,omitempty"`
-	ChatId        string                 `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+func (x *MembershipChange) GetAuthorId() string {
+	if x != nil {
+		return x.AuthorId
+	}
+	return ""
 }
 
-func (x *StreamInfo) Reset() {
-	*x = StreamInfo{}
-	mi := &file_pb_message_proto_msgTypes[4]
-	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-	ms.StoreMessageInfo(mi)
+func (x *MembershipChange) GetPeerIds() []string {
+	if x != nil {
+		return x.PeerIds
+	}
+	return nil
 }
 
-func (x *StreamInfo) String() string {
-	return protoimpl.X.MessageStringOf(x)
+func (x *MembershipChange) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
 }
 
-func (*StreamInfo) ProtoMessage() {}
-
-func (x *StreamInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_message_proto_msgTypes[4]
+func (x *MembershipChange) GetTimestamp() int64 {
 	if x != nil {
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		if ms.LoadMessageInfo() == nil {
-			ms.StoreMessageInfo(mi)
-		}
-		return ms
+		return x.Timestamp
 	}
-	return mi.MessageOf(x)
+	return 0
 }
 
-// Deprecated: Use StreamInfo.ProtoReflect.Descriptor instead.
-func (*StreamInfo) Descriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{4}
+func (x *MembershipChange) GetRole() MembershipChange_Role {
+	if x != nil {
+		return x.Role
+	}
+	return MembershipChange_MEMBER
 }
 
-func (x *StreamInfo) GetStatus() StreamInfo_Status {
+func (x *MembershipChange) GetSignature() []byte {
 	if x != nil {
-		return x.Status
+		return x.Signature
 	}
-	return StreamInfo_ACTIVE
+	return nil
 }
 
-func (x *StreamInfo) GetChatId() string {
+func (x *MembershipChange) GetParentIds() []string {
 	if x != nil {
-		return x.ChatId
+		return x.ParentIds
 	}
-	return ""
+	return nil
 }
 
-type StreamInfoResponse struct {
-	state         protoimpl.MessageState    `protogen:"open.v1"`
-	Answer        StreamInfoResponse_Answer `protobuf:"varint,1,opt,name=answer,proto3,enum=pb.StreamInfoResponse_Answer" json:"answer,omitempty"`
-	ChatId        string                    `protobuf:"bytes,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+type MembershipLog struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChatId        string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	Changes       []*MembershipChange    `protobuf:"bytes,2,rep,name=changes,proto3" json:"changes,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *StreamInfoResponse) Reset() {
-	*x = StreamInfoResponse{}
-	mi := &file_pb_message_proto_msgTypes[5]
+func (x *MembershipLog) Reset() {
+	*x = MembershipLog{}
+	mi := &file_pb_message_proto_msgTypes[24]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *StreamInfoResponse) String() string {
+func (x *MembershipLog) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*StreamInfoResponse) ProtoMessage() {}
+func (*MembershipLog) ProtoMessage() {}
 
-func (x *StreamInfoResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_message_proto_msgTypes[5]
+func (x *MembershipLog) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_message_proto_msgTypes[24]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -406,23 +2127,23 @@ func (x *StreamInfoResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use StreamInfoResponse.ProtoReflect.Descriptor instead.
-func (*StreamInfoResponse) Descriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{5}
+// Deprecated: Use MembershipLog.ProtoReflect.Descriptor instead.
+func (*MembershipLog) Descriptor() ([]byte, []int) {
+	return file_pb_message_proto_rawDescGZIP(), []int{24}
 }
 
-func (x *StreamInfoResponse) GetAnswer() StreamInfoResponse_Answer {
+func (x *MembershipLog) GetChatId() string {
 	if x != nil {
-		return x.Answer
+		return x.ChatId
 	}
-	return StreamInfoResponse_ENTER
+	return ""
 }
 
-func (x *StreamInfoResponse) GetChatId() string {
+func (x *MembershipLog) GetChanges() []*MembershipChange {
 	if x != nil {
-		return x.ChatId
+		return x.Changes
 	}
-	return ""
+	return nil
 }
 
 type StreamChunk struct {
@@ -438,7 +2159,7 @@ type StreamChunk struct {
 
 func (x *StreamChunk) Reset() {
 	*x = StreamChunk{}
-	mi := &file_pb_message_proto_msgTypes[6]
+	mi := &file_pb_message_proto_msgTypes[25]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -450,7 +2171,7 @@ func (x *StreamChunk) String() string {
 func (*StreamChunk) ProtoMessage() {}
 
 func (x *StreamChunk) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_message_proto_msgTypes[6]
+	mi := &file_pb_message_proto_msgTypes[25]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -463,7 +2184,7 @@ func (x *StreamChunk) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use StreamChunk.ProtoReflect.Descriptor instead.
 func (*StreamChunk) Descriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{6}
+	return file_pb_message_proto_rawDescGZIP(), []int{25}
 }
 
 func (x *StreamChunk) GetIsInit() bool {
@@ -512,6 +2233,22 @@ type DataPacket struct {
 	//	*DataPacket_StreamChunk
 	//	*DataPacket_Ping
 	//	*DataPacket_Pong
+	//	*DataPacket_ChatHeads
+	//	*DataPacket_CallSignal
+	//	*DataPacket_PrekeyBundle
+	//	*DataPacket_Sealed
+	//	*DataPacket_MembershipLog
+	//	*DataPacket_SenderKey
+	//	*DataPacket_GroupSealed
+	//	*DataPacket_MailboxDeposit
+	//	*DataPacket_MailboxDelivery
+	//	*DataPacket_MailboxAck
+	//	*DataPacket_Receipt
+	//	*DataPacket_BlobRequest
+	//	*DataPacket_BlobChunk
+	//	*DataPacket_MessageEdit
+	//	*DataPacket_Reaction
+	//	*DataPacket_MailboxAccepted
 	Msg           isDataPacket_Msg `protobuf_oneof:"msg"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -519,7 +2256,7 @@ type DataPacket struct {
 
 func (x *DataPacket) Reset() {
 	*x = DataPacket{}
-	mi := &file_pb_message_proto_msgTypes[7]
+	mi := &file_pb_message_proto_msgTypes[26]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -531,7 +2268,7 @@ func (x *DataPacket) String() string {
 func (*DataPacket) ProtoMessage() {}
 
 func (x *DataPacket) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_message_proto_msgTypes[7]
+	mi := &file_pb_message_proto_msgTypes[26]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -544,7 +2281,7 @@ func (x *DataPacket) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DataPacket.ProtoReflect.Descriptor instead.
 func (*DataPacket) Descriptor() ([]byte, []int) {
-	return file_pb_message_proto_rawDescGZIP(), []int{7}
+	return file_pb_message_proto_rawDescGZIP(), []int{26}
 }
 
 func (x *DataPacket) GetMsg() isDataPacket_Msg {
@@ -617,6 +2354,150 @@ func (x *DataPacket) GetPong() *Pong {
 	return nil
 }
 
+func (x *DataPacket) GetChatHeads() *ChatHeads {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_ChatHeads); ok {
+			return x.ChatHeads
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetCallSignal() *CallSignal {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_CallSignal); ok {
+			return x.CallSignal
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetPrekeyBundle() *PrekeyBundle {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_PrekeyBundle); ok {
+			return x.PrekeyBundle
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetSealed() *Sealed {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_Sealed); ok {
+			return x.Sealed
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMembershipLog() *MembershipLog {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MembershipLog); ok {
+			return x.MembershipLog
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetSenderKey() *SenderKey {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_SenderKey); ok {
+			return x.SenderKey
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetGroupSealed() *GroupSealed {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_GroupSealed); ok {
+			return x.GroupSealed
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMailboxDeposit() *MailboxDeposit {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MailboxDeposit); ok {
+			return x.MailboxDeposit
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMailboxDelivery() *MailboxDelivery {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MailboxDelivery); ok {
+			return x.MailboxDelivery
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMailboxAck() *MailboxAck {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MailboxAck); ok {
+			return x.MailboxAck
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetReceipt() *Receipt {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_Receipt); ok {
+			return x.Receipt
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetBlobRequest() *BlobRequest {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_BlobRequest); ok {
+			return x.BlobRequest
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetBlobChunk() *BlobChunk {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_BlobChunk); ok {
+			return x.BlobChunk
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMessageEdit() *MessageEdit {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MessageEdit); ok {
+			return x.MessageEdit
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetReaction() *Reaction {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_Reaction); ok {
+			return x.Reaction
+		}
+	}
+	return nil
+}
+
+func (x *DataPacket) GetMailboxAccepted() *MailboxAccepted {
+	if x != nil {
+		if x, ok := x.Msg.(*DataPacket_MailboxAccepted); ok {
+			return x.MailboxAccepted
+		}
+	}
+	return nil
+}
+
 type isDataPacket_Msg interface {
 	isDataPacket_Msg()
 }
@@ -649,6 +2530,70 @@ type DataPacket_Pong struct {
 	Pong *Pong `protobuf:"bytes,7,opt,name=pong,proto3,oneof"`
 }
 
+type DataPacket_ChatHeads struct {
+	ChatHeads *ChatHeads `protobuf:"bytes,8,opt,name=chat_heads,json=chatHeads,proto3,oneof"`
+}
+
+type DataPacket_CallSignal struct {
+	CallSignal *CallSignal `protobuf:"bytes,9,opt,name=call_signal,json=callSignal,proto3,oneof"`
+}
+
+type DataPacket_PrekeyBundle struct {
+	PrekeyBundle *PrekeyBundle `protobuf:"bytes,10,opt,name=prekey_bundle,json=prekeyBundle,proto3,oneof"`
+}
+
+type DataPacket_Sealed struct {
+	Sealed *Sealed `protobuf:"bytes,11,opt,name=sealed,proto3,oneof"`
+}
+
+type DataPacket_MembershipLog struct {
+	MembershipLog *MembershipLog `protobuf:"bytes,12,opt,name=membership_log,json=membershipLog,proto3,oneof"`
+}
+
+type DataPacket_SenderKey struct {
+	SenderKey *SenderKey `protobuf:"bytes,13,opt,name=sender_key,json=senderKey,proto3,oneof"`
+}
+
+type DataPacket_GroupSealed struct {
+	GroupSealed *GroupSealed `protobuf:"bytes,14,opt,name=group_sealed,json=groupSealed,proto3,oneof"`
+}
+
+type DataPacket_MailboxDeposit struct {
+	MailboxDeposit *MailboxDeposit `protobuf:"bytes,15,opt,name=mailbox_deposit,json=mailboxDeposit,proto3,oneof"`
+}
+
+type DataPacket_MailboxDelivery struct {
+	MailboxDelivery *MailboxDelivery `protobuf:"bytes,16,opt,name=mailbox_delivery,json=mailboxDelivery,proto3,oneof"`
+}
+
+type DataPacket_MailboxAck struct {
+	MailboxAck *MailboxAck `protobuf:"bytes,17,opt,name=mailbox_ack,json=mailboxAck,proto3,oneof"`
+}
+
+type DataPacket_Receipt struct {
+	Receipt *Receipt `protobuf:"bytes,18,opt,name=receipt,proto3,oneof"`
+}
+
+type DataPacket_BlobRequest struct {
+	BlobRequest *BlobRequest `protobuf:"bytes,19,opt,name=blob_request,json=blobRequest,proto3,oneof"`
+}
+
+type DataPacket_BlobChunk struct {
+	BlobChunk *BlobChunk `protobuf:"bytes,20,opt,name=blob_chunk,json=blobChunk,proto3,oneof"`
+}
+
+type DataPacket_MessageEdit struct {
+	MessageEdit *MessageEdit `protobuf:"bytes,21,opt,name=message_edit,json=messageEdit,proto3,oneof"`
+}
+
+type DataPacket_Reaction struct {
+	Reaction *Reaction `protobuf:"bytes,22,opt,name=reaction,proto3,oneof"`
+}
+
+type DataPacket_MailboxAccepted struct {
+	MailboxAccepted *MailboxAccepted `protobuf:"bytes,23,opt,name=mailbox_accepted,json=mailboxAccepted,proto3,oneof"`
+}
+
 func (*DataPacket_Static) isDataPacket_Msg() {}
 
 func (*DataPacket_ResendStatic) isDataPacket_Msg() {}
@@ -663,13 +2608,45 @@ func (*DataPacket_Ping) isDataPacket_Msg() {}
 
 func (*DataPacket_Pong) isDataPacket_Msg() {}
 
+func (*DataPacket_ChatHeads) isDataPacket_Msg() {}
+
+func (*DataPacket_CallSignal) isDataPacket_Msg() {}
+
+func (*DataPacket_PrekeyBundle) isDataPacket_Msg() {}
+
+func (*DataPacket_Sealed) isDataPacket_Msg() {}
+
+func (*DataPacket_MembershipLog) isDataPacket_Msg() {}
+
+func (*DataPacket_SenderKey) isDataPacket_Msg() {}
+
+func (*DataPacket_GroupSealed) isDataPacket_Msg() {}
+
+func (*DataPacket_MailboxDeposit) isDataPacket_Msg() {}
+
+func (*DataPacket_MailboxDelivery) isDataPacket_Msg() {}
+
+func (*DataPacket_MailboxAck) isDataPacket_Msg() {}
+
+func (*DataPacket_Receipt) isDataPacket_Msg() {}
+
+func (*DataPacket_BlobRequest) isDataPacket_Msg() {}
+
+func (*DataPacket_BlobChunk) isDataPacket_Msg() {}
+
+func (*DataPacket_MessageEdit) isDataPacket_Msg() {}
+
+func (*DataPacket_Reaction) isDataPacket_Msg() {}
+
+func (*DataPacket_MailboxAccepted) isDataPacket_Msg() {}
+
 var File_pb_message_proto protoreflect.FileDescriptor
 
 const file_pb_message_proto_rawDesc = "" +
 	"\n" +
 	"\x10pb/message.proto\x12\x02pb\"\x06\n" +
 	"\x04Ping\"\x06\n" +
-	"\x04Pong\"\xb5\x01\n" +
+	"\x04Pong\"\xcc\x02\n" +
 	"\x06Static\x12\x17\n" +
 	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12&\n" +
 	"\x0fprev_message_id\x18\x02 \x01(\tR\rprevMessageId\x12\x1d\n" +
@@ -677,11 +2654,65 @@ const file_pb_message_proto_rawDesc = "" +
 	"message_id\x18\x03 \x01(\tR\tmessageId\x12\x1a\n" +
 	"\bmimeType\x18\x04 \x01(\tR\bmimeType\x12\x1b\n" +
 	"\tauthor_id\x18\x05 \x01(\tR\bauthorId\x12\x12\n" +
-	"\x04data\x18\x06 \x01(\fR\x04data\"M\n" +
+	"\x04data\x18\x06 \x01(\fR\x04data\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12*\n" +
+	"\x11merge_message_ids\x18\b \x03(\tR\x0fmergeMessageIds\x12\x1c\n" +
+	"\tsignature\x18\t \x01(\fR\tsignature\x12-\n" +
+	"\x13reply_to_message_id\x18\n" +
+	" \x01(\tR\x10replyToMessageId\"\x84\x01\n" +
+	"\n" +
+	"Attachment\x12\x12\n" +
+	"\x04hash\x18\x01 \x01(\fR\x04hash\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x04R\x04size\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12\x1b\n" +
+	"\tmime_type\x18\x04 \x01(\tR\bmimeType\x12\x1d\n" +
+	"\n" +
+	"chunk_size\x18\x05 \x01(\rR\tchunkSize\"R\n" +
+	"\vBlobRequest\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x12\n" +
+	"\x04hash\x18\x02 \x01(\fR\x04hash\x12\x16\n" +
+	"\x06chunks\x18\x03 \x03(\rR\x06chunks\"I\n" +
+	"\tBlobChunk\x12\x12\n" +
+	"\x04hash\x18\x01 \x01(\fR\x04hash\x12\x14\n" +
+	"\x05index\x18\x02 \x01(\rR\x05index\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"\x93\x02\n" +
+	"\vMessageEdit\x12(\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x14.pb.MessageEdit.KindR\x04kind\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x17\n" +
+	"\aedit_id\x18\x03 \x01(\tR\x06editId\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x04 \x01(\tR\tmessageId\x12\x1b\n" +
+	"\tauthor_id\x18\x05 \x01(\tR\bauthorId\x12\x12\n" +
+	"\x04text\x18\x06 \x01(\tR\x04text\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12\x1c\n" +
+	"\tsignature\x18\b \x01(\fR\tsignature\"\x1c\n" +
+	"\x04Kind\x12\b\n" +
+	"\x04EDIT\x10\x00\x12\n" +
+	"\n" +
+	"\x06DELETE\x10\x01\"\x96\x02\n" +
+	"\bReaction\x12%\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x11.pb.Reaction.KindR\x04kind\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x1f\n" +
+	"\vreaction_id\x18\x03 \x01(\tR\n" +
+	"reactionId\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x04 \x01(\tR\tmessageId\x12\x1b\n" +
+	"\tauthor_id\x18\x05 \x01(\tR\bauthorId\x12\x14\n" +
+	"\x05emoji\x18\x06 \x01(\tR\x05emoji\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12\x1c\n" +
+	"\tsignature\x18\b \x01(\fR\tsignature\"\x1b\n" +
+	"\x04Kind\x12\a\n" +
+	"\x03ADD\x10\x00\x12\n" +
+	"\n" +
+	"\x06REMOVE\x10\x01\"M\n" +
 	"\x13StaticResendRequest\x12\x17\n" +
 	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x1d\n" +
 	"\n" +
-	"message_id\x18\x02 \x01(\tR\tmessageId\"t\n" +
+	"message_id\x18\x02 \x01(\tR\tmessageId\"E\n" +
+	"\tChatHeads\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x1f\n" +
+	"\vmessage_ids\x18\x02 \x03(\tR\n" +
+	"messageIds\"t\n" +
 	"\n" +
 	"StreamInfo\x12-\n" +
 	"\x06status\x18\x01 \x01(\x0e2\x15.pb.StreamInfo.StatusR\x06status\x12\x17\n" +
@@ -695,14 +2726,127 @@ const file_pb_message_proto_rawDesc = "" +
 	"\achat_id\x18\x02 \x01(\tR\x06chatId\"\x1e\n" +
 	"\x06Answer\x12\t\n" +
 	"\x05ENTER\x10\x00\x12\t\n" +
-	"\x05LEAVE\x10\x01\"\x8a\x01\n" +
+	"\x05LEAVE\x10\x01\"\xb6\x01\n" +
+	"\n" +
+	"CallSignal\x12'\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x13.pb.CallSignal.KindR\x04kind\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x17\n" +
+	"\acall_id\x18\x03 \x01(\tR\x06callId\"M\n" +
+	"\x04Kind\x12\n" +
+	"\n" +
+	"\x06INVITE\x10\x00\x12\n" +
+	"\n" +
+	"\x06ACCEPT\x10\x01\x12\v\n" +
+	"\aDECLINE\x10\x02\x12\b\n" +
+	"\x04BUSY\x10\x03\x12\n" +
+	"\n" +
+	"\x06CANCEL\x10\x04\x12\n" +
+	"\n" +
+	"\x06HANGUP\x10\x05\"t\n" +
+	"\fPrekeyBundle\x12!\n" +
+	"\fidentity_key\x18\x01 \x01(\fR\videntityKey\x12#\n" +
+	"\rsigned_prekey\x18\x02 \x01(\fR\fsignedPrekey\x12\x1c\n" +
+	"\tsignature\x18\x03 \x01(\fR\tsignature\"z\n" +
+	"\vSessionInit\x12!\n" +
+	"\fidentity_key\x18\x01 \x01(\fR\videntityKey\x12#\n" +
+	"\rephemeral_key\x18\x02 \x01(\fR\fephemeralKey\x12#\n" +
+	"\rsigned_prekey\x18\x03 \x01(\fR\fsignedPrekey\"\xca\x01\n" +
+	"\x06Sealed\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\fR\tsessionId\x12#\n" +
+	"\x04init\x18\x02 \x01(\v2\x0f.pb.SessionInitR\x04init\x12\x1f\n" +
+	"\vratchet_key\x18\x03 \x01(\fR\n" +
+	"ratchetKey\x12%\n" +
+	"\x0eprevious_count\x18\x04 \x01(\rR\rpreviousCount\x12\x14\n" +
+	"\x05count\x18\x05 \x01(\rR\x05count\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x06 \x01(\fR\n" +
+	"ciphertext\"\x97\x01\n" +
+	"\tSenderKey\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\fR\x05keyId\x12\x1b\n" +
+	"\tchain_key\x18\x03 \x01(\fR\bchainKey\x12\x1c\n" +
+	"\titeration\x18\x04 \x01(\rR\titeration\x12\x1f\n" +
+	"\vsigning_key\x18\x05 \x01(\fR\n" +
+	"signingKey\"\xb6\x01\n" +
+	"\vGroupSealed\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x1b\n" +
+	"\tsender_id\x18\x02 \x01(\tR\bsenderId\x12\x15\n" +
+	"\x06key_id\x18\x03 \x01(\fR\x05keyId\x12\x1c\n" +
+	"\titeration\x18\x04 \x01(\rR\titeration\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x05 \x01(\fR\n" +
+	"ciphertext\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\"\xa8\x01\n" +
+	"\aReceipt\x12$\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x10.pb.Receipt.KindR\x04kind\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x1f\n" +
+	"\vmessage_ids\x18\x03 \x03(\tR\n" +
+	"messageIds\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\"\x1f\n" +
+	"\x04Kind\x12\r\n" +
+	"\tDELIVERED\x10\x00\x12\b\n" +
+	"\x04READ\x10\x01\"\xc9\x01\n" +
+	"\x0eMailboxDeposit\x12\x1f\n" +
+	"\venvelope_id\x18\x01 \x01(\tR\n" +
+	"envelopeId\x12!\n" +
+	"\frecipient_id\x18\x02 \x01(\tR\vrecipientId\x12\x18\n" +
+	"\aexpires\x18\x03 \x01(\x03R\aexpires\x12\"\n" +
+	"\x06sealed\x18\x04 \x01(\v2\n" +
+	".pb.SealedR\x06sealed\x125\n" +
+	"\rsender_bundle\x18\x05 \x01(\v2\x10.pb.PrekeyBundleR\fsenderBundle\"\xaa\x01\n" +
+	"\x0fMailboxDelivery\x12\x1f\n" +
+	"\venvelope_id\x18\x01 \x01(\tR\n" +
+	"envelopeId\x12\x1b\n" +
+	"\tsender_id\x18\x02 \x01(\tR\bsenderId\x12\"\n" +
+	"\x06sealed\x18\x03 \x01(\v2\n" +
+	".pb.SealedR\x06sealed\x125\n" +
+	"\rsender_bundle\x18\x04 \x01(\v2\x10.pb.PrekeyBundleR\fsenderBundle\"/\n" +
+	"\n" +
+	"MailboxAck\x12!\n" +
+	"\fenvelope_ids\x18\x01 \x03(\tR\venvelopeIds\"W\n" +
+	"\x0fMailboxAccepted\x12!\n" +
+	"\frecipient_id\x18\x01 \x01(\tR\vrecipientId\x12!\n" +
+	"\fenvelope_ids\x18\x02 \x03(\tR\venvelopeIds\"\xd0\x03\n" +
+	"\x10MembershipChange\x12-\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x19.pb.MembershipChange.KindR\x04kind\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x1b\n" +
+	"\tchange_id\x18\x03 \x01(\tR\bchangeId\x12\x1b\n" +
+	"\tauthor_id\x18\x04 \x01(\tR\bauthorId\x12\x19\n" +
+	"\bpeer_ids\x18\x05 \x03(\tR\apeerIds\x12\x12\n" +
+	"\x04name\x18\x06 \x01(\tR\x04name\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12-\n" +
+	"\x04role\x18\b \x01(\x0e2\x19.pb.MembershipChange.RoleR\x04role\x12\x1c\n" +
+	"\tsignature\x18\t \x01(\fR\tsignature\x12\x1d\n" +
+	"\n" +
+	"parent_ids\x18\n" +
+	" \x03(\tR\tparentIds\"W\n" +
+	"\x04Kind\x12\n" +
+	"\n" +
+	"\x06CREATE\x10\x00\x12\n" +
+	"\n" +
+	"\x06INVITE\x10\x01\x12\b\n" +
+	"\x04JOIN\x10\x02\x12\t\n" +
+	"\x05LEAVE\x10\x03\x12\b\n" +
+	"\x04KICK\x10\x04\x12\n" +
+	"\n" +
+	"\x06RENAME\x10\x05\x12\f\n" +
+	"\bSET_ROLE\x10\x06\"(\n" +
+	"\x04Role\x12\n" +
+	"\n" +
+	"\x06MEMBER\x10\x00\x12\t\n" +
+	"\x05ADMIN\x10\x01\x12\t\n" +
+	"\x05OWNER\x10\x02\"X\n" +
+	"\rMembershipLog\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12.\n" +
+	"\achanges\x18\x02 \x03(\v2\x14.pb.MembershipChangeR\achanges\"\x8a\x01\n" +
 	"\vStreamChunk\x12\x17\n" +
 	"\ais_init\x18\x01 \x01(\bR\x06isInit\x12\x17\n" +
 	"\achat_id\x18\x02 \x01(\tR\x06chatId\x12\x1d\n" +
 	"\n" +
 	"seq_number\x18\x03 \x01(\rR\tseqNumber\x12\x16\n" +
 	"\x06offset\x18\x04 \x01(\fR\x06offset\x12\x12\n" +
-	"\x04data\x18\x05 \x01(\fR\x04data\"\xee\x02\n" +
+	"\x04data\x18\x05 \x01(\fR\x04data\"\xb9\t\n" +
 	"\n" +
 	"DataPacket\x12$\n" +
 	"\x06static\x18\x01 \x01(\v2\n" +
@@ -713,7 +2857,30 @@ const file_pb_message_proto_rawDesc = "" +
 	"\x14stream_info_response\x18\x04 \x01(\v2\x16.pb.StreamInfoResponseH\x00R\x12streamInfoResponse\x124\n" +
 	"\fstream_chunk\x18\x05 \x01(\v2\x0f.pb.StreamChunkH\x00R\vstreamChunk\x12\x1e\n" +
 	"\x04ping\x18\x06 \x01(\v2\b.pb.PingH\x00R\x04ping\x12\x1e\n" +
-	"\x04pong\x18\a \x01(\v2\b.pb.PongH\x00R\x04pongB\x05\n" +
+	"\x04pong\x18\a \x01(\v2\b.pb.PongH\x00R\x04pong\x12.\n" +
+	"\n" +
+	"chat_heads\x18\b \x01(\v2\r.pb.ChatHeadsH\x00R\tchatHeads\x121\n" +
+	"\vcall_signal\x18\t \x01(\v2\x0e.pb.CallSignalH\x00R\n" +
+	"callSignal\x127\n" +
+	"\rprekey_bundle\x18\n" +
+	" \x01(\v2\x10.pb.PrekeyBundleH\x00R\fprekeyBundle\x12$\n" +
+	"\x06sealed\x18\v \x01(\v2\n" +
+	".pb.SealedH\x00R\x06sealed\x12:\n" +
+	"\x0emembership_log\x18\f \x01(\v2\x11.pb.MembershipLogH\x00R\rmembershipLog\x12.\n" +
+	"\n" +
+	"sender_key\x18\r \x01(\v2\r.pb.SenderKeyH\x00R\tsenderKey\x124\n" +
+	"\fgroup_sealed\x18\x0e \x01(\v2\x0f.pb.GroupSealedH\x00R\vgroupSealed\x12=\n" +
+	"\x0fmailbox_deposit\x18\x0f \x01(\v2\x12.pb.MailboxDepositH\x00R\x0emailboxDeposit\x12@\n" +
+	"\x10mailbox_delivery\x18\x10 \x01(\v2\x13.pb.MailboxDeliveryH\x00R\x0fmailboxDelivery\x121\n" +
+	"\vmailbox_ack\x18\x11 \x01(\v2\x0e.pb.MailboxAckH\x00R\n" +
+	"mailboxAck\x12'\n" +
+	"\areceipt\x18\x12 \x01(\v2\v.pb.ReceiptH\x00R\areceipt\x124\n" +
+	"\fblob_request\x18\x13 \x01(\v2\x0f.pb.BlobRequestH\x00R\vblobRequest\x12.\n" +
+	"\n" +
+	"blob_chunk\x18\x14 \x01(\v2\r.pb.BlobChunkH\x00R\tblobChunk\x124\n" +
+	"\fmessage_edit\x18\x15 \x01(\v2\x0f.pb.MessageEditH\x00R\vmessageEdit\x12*\n" +
+	"\breaction\x18\x16 \x01(\v2\f.pb.ReactionH\x00R\breaction\x12@\n" +
+	"\x10mailbox_accepted\x18\x17 \x01(\v2\x13.pb.MailboxAcceptedH\x00R\x0fmailboxAcceptedB\x05\n" +
 	"\x03msgB\x06Z\x04./pbb\x06proto3"
 
 var (
@@ -728,35 +2895,88 @@ func file_pb_message_proto_rawDescGZIP() []byte {
 	return file_pb_message_proto_rawDescData
 }
 
-var file_pb_message_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_pb_message_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_pb_message_proto_enumTypes = make([]protoimpl.EnumInfo, 8)
+var file_pb_message_proto_msgTypes = make([]protoimpl.MessageInfo, 27)
 var file_pb_message_proto_goTypes = []any{
-	(StreamInfo_Status)(0),         // 0: pb.StreamInfo.Status
-	(StreamInfoResponse_Answer)(0), // 1: pb.StreamInfoResponse.Answer
-	(*Ping)(nil),                   // 2: pb.Ping
-	(*Pong)(nil),                   // 3: pb.Pong
-	(*Static)(nil),                 // 4: pb.Static
-	(*StaticResendRequest)(nil),    // 5: pb.StaticResendRequest
-	(*StreamInfo)(nil),             // 6: pb.StreamInfo
-	(*StreamInfoResponse)(nil),     // 7: pb.StreamInfoResponse
-	(*StreamChunk)(nil),            // 8: pb.StreamChunk
-	(*DataPacket)(nil),             // 9: pb.DataPacket
+	(MessageEdit_Kind)(0),          // 0: pb.MessageEdit.Kind
+	(Reaction_Kind)(0),             // 1: pb.Reaction.Kind
+	(StreamInfo_Status)(0),         // 2: pb.StreamInfo.Status
+	(StreamInfoResponse_Answer)(0), // 3: pb.StreamInfoResponse.Answer
+	(CallSignal_Kind)(0),           // 4: pb.CallSignal.Kind
+	(Receipt_Kind)(0),              // 5: pb.Receipt.Kind
+	(MembershipChange_Kind)(0),     // 6: pb.MembershipChange.Kind
+	(MembershipChange_Role)(0),     // 7: pb.MembershipChange.Role
+	(*Ping)(nil),                   // 8: pb.Ping
+	(*Pong)(nil),                   // 9: pb.Pong
+	(*Static)(nil),                 // 10: pb.Static
+	(*Attachment)(nil),             // 11: pb.Attachment
+	(*BlobRequest)(nil),            // 12: pb.BlobRequest
+	(*BlobChunk)(nil),              // 13: pb.BlobChunk
+	(*MessageEdit)(nil),            // 14: pb.MessageEdit
+	(*Reaction)(nil),               // 15: pb.Reaction
+	(*StaticResendRequest)(nil),    // 16: pb.StaticResendRequest
+	(*ChatHeads)(nil),              // 17: pb.ChatHeads
+	(*StreamInfo)(nil),             // 18: pb.StreamInfo
+	(*StreamInfoResponse)(nil),     // 19: pb.StreamInfoResponse
+	(*CallSignal)(nil),             // 20: pb.CallSignal
+	(*PrekeyBundle)(nil),           // 21: pb.PrekeyBundle
+	(*SessionInit)(nil),            // 22: pb.SessionInit
+	(*Sealed)(nil),                 // 23: pb.Sealed
+	(*SenderKey)(nil),              // 24: pb.SenderKey
+	(*GroupSealed)(nil),            // 25: pb.GroupSealed
+	(*Receipt)(nil),                // 26: pb.Receipt
+	(*MailboxDeposit)(nil),         // 27: pb.MailboxDeposit
+	(*MailboxDelivery)(nil),        // 28: pb.MailboxDelivery
+	(*MailboxAck)(nil),             // 29: pb.MailboxAck
+	(*MailboxAccepted)(nil),        // 30: pb.MailboxAccepted
+	(*MembershipChange)(nil),       // 31: pb.MembershipChange
+	(*MembershipLog)(nil),          // 32: pb.MembershipLog
+	(*StreamChunk)(nil),            // 33: pb.StreamChunk
+	(*DataPacket)(nil),             // 34: pb.DataPacket
 }
 var file_pb_message_proto_depIdxs = []int32{
-	0, // 0: pb.StreamInfo.status:type_name -> pb.StreamInfo.Status
-	1, // 1: pb.StreamInfoResponse.answer:type_name -> pb.StreamInfoResponse.Answer
-	4, // 2: pb.DataPacket.static:type_name -> pb.Static
-	5, // 3: pb.DataPacket.resend_static:type_name -> pb.StaticResendRequest
-	6, // 4: pb.DataPacket.stream_info:type_name -> pb.StreamInfo
-	7, // 5: pb.DataPacket.stream_info_response:type_name -> pb.StreamInfoResponse
-	8, // 6: pb.DataPacket.stream_chunk:type_name -> pb.StreamChunk
-	2, // 7: pb.DataPacket.ping:type_name -> pb.Ping
-	3, // 8: pb.DataPacket.pong:type_name -> pb.Pong
-	9, // [9:9] is the sub-list for method output_type
-	9, // [9:9] is the sub-list for method input_type
-	9, // [9:9] is the sub-list for extension type_name
-	9, // [9:9] is the sub-list for extension extendee
-	0, // [0:9] is the sub-list for field type_name
+	0,  // 0: pb.MessageEdit.kind:type_name -> pb.MessageEdit.Kind
+	1,  // 1: pb.Reaction.kind:type_name -> pb.Reaction.Kind
+	2,  // 2: pb.StreamInfo.status:type_name -> pb.StreamInfo.Status
+	3,  // 3: pb.StreamInfoResponse.answer:type_name -> pb.StreamInfoResponse.Answer
+	4,  // 4: pb.CallSignal.kind:type_name -> pb.CallSignal.Kind
+	22, // 5: pb.Sealed.init:type_name -> pb.SessionInit
+	5,  // 6: pb.Receipt.kind:type_name -> pb.Receipt.Kind
+	23, // 7: pb.MailboxDeposit.sealed:type_name -> pb.Sealed
+	21, // 8: pb.MailboxDeposit.sender_bundle:type_name -> pb.PrekeyBundle
+	23, // 9: pb.MailboxDelivery.sealed:type_name -> pb.Sealed
+	21, // 10: pb.MailboxDelivery.sender_bundle:type_name -> pb.PrekeyBundle
+	6,  // 11: pb.MembershipChange.kind:type_name -> pb.MembershipChange.Kind
+	7,  // 12: pb.MembershipChange.role:type_name -> pb.MembershipChange.Role
+	31, // 13: pb.MembershipLog.changes:type_name -> pb.MembershipChange
+	10, // 14: pb.DataPacket.static:type_name -> pb.Static
+	16, // 15: pb.DataPacket.resend_static:type_name -> pb.StaticResendRequest
+	18, // 16: pb.DataPacket.stream_info:type_name -> pb.StreamInfo
+	19, // 17: pb.DataPacket.stream_info_response:type_name -> pb.StreamInfoResponse
+	33, // 18: pb.DataPacket.stream_chunk:type_name -> pb.StreamChunk
+	8,  // 19: pb.DataPacket.ping:type_name -> pb.Ping
+	9,  // 20: pb.DataPacket.pong:type_name -> pb.Pong
+	17, // 21: pb.DataPacket.chat_heads:type_name -> pb.ChatHeads
+	20, // 22: pb.DataPacket.call_signal:type_name -> pb.CallSignal
+	21, // 23: pb.DataPacket.prekey_bundle:type_name -> pb.PrekeyBundle
+	23, // 24: pb.DataPacket.sealed:type_name -> pb.Sealed
+	32, // 25: pb.DataPacket.membership_log:type_name -> pb.MembershipLog
+	24, // 26: pb.DataPacket.sender_key:type_name -> pb.SenderKey
+	25, // 27: pb.DataPacket.group_sealed:type_name -> pb.GroupSealed
+	27, // 28: pb.DataPacket.mailbox_deposit:type_name -> pb.MailboxDeposit
+	28, // 29: pb.DataPacket.mailbox_delivery:type_name -> pb.MailboxDelivery
+	29, // 30: pb.DataPacket.mailbox_ack:type_name -> pb.MailboxAck
+	26, // 31: pb.DataPacket.receipt:type_name -> pb.Receipt
+	12, // 32: pb.DataPacket.blob_request:type_name -> pb.BlobRequest
+	13, // 33: pb.DataPacket.blob_chunk:type_name -> pb.BlobChunk
+	14, // 34: pb.DataPacket.message_edit:type_name -> pb.MessageEdit
+	15, // 35: pb.DataPacket.reaction:type_name -> pb.Reaction
+	30, // 36: pb.DataPacket.mailbox_accepted:type_name -> pb.MailboxAccepted
+	37, // [37:37] is the sub-list for method output_type
+	37, // [37:37] is the sub-list for method input_type
+	37, // [37:37] is the sub-list for extension type_name
+	37, // [37:37] is the sub-list for extension extendee
+	0,  // [0:37] is the sub-list for field type_name
 }
 
 func init() { file_pb_message_proto_init() }
@@ -764,7 +2984,7 @@ func file_pb_message_proto_init() {
 	if File_pb_message_proto != nil {
 		return
 	}
-	file_pb_message_proto_msgTypes[7].OneofWrappers = []any{
+	file_pb_message_proto_msgTypes[26].OneofWrappers = []any{
 		(*DataPacket_Static)(nil),
 		(*DataPacket_ResendStatic)(nil),
 		(*DataPacket_StreamInfo)(nil),
@@ -772,14 +2992,30 @@ func file_pb_message_proto_init() {
 		(*DataPacket_StreamChunk)(nil),
 		(*DataPacket_Ping)(nil),
 		(*DataPacket_Pong)(nil),
+		(*DataPacket_ChatHeads)(nil),
+		(*DataPacket_CallSignal)(nil),
+		(*DataPacket_PrekeyBundle)(nil),
+		(*DataPacket_Sealed)(nil),
+		(*DataPacket_MembershipLog)(nil),
+		(*DataPacket_SenderKey)(nil),
+		(*DataPacket_GroupSealed)(nil),
+		(*DataPacket_MailboxDeposit)(nil),
+		(*DataPacket_MailboxDelivery)(nil),
+		(*DataPacket_MailboxAck)(nil),
+		(*DataPacket_Receipt)(nil),
+		(*DataPacket_BlobRequest)(nil),
+		(*DataPacket_BlobChunk)(nil),
+		(*DataPacket_MessageEdit)(nil),
+		(*DataPacket_Reaction)(nil),
+		(*DataPacket_MailboxAccepted)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_message_proto_rawDesc), len(file_pb_message_proto_rawDesc)),
-			NumEnums:      2,
-			NumMessages:   8,
+			NumEnums:      8,
+			NumMessages:   27,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
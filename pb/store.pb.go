@@ -0,0 +1,373 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v3.19.6
+// source: pb/store.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ContactRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Alias         string                 `protobuf:"bytes,2,opt,name=alias,proto3" json:"alias,omitempty"`
+	Addresses     []string               `protobuf:"bytes,3,rep,name=addresses,proto3" json:"addresses,omitempty"`
+	LastSeen      int64                  `protobuf:"varint,4,opt,name=last_seen,json=lastSeen,proto3" json:"last_seen,omitempty"`
+	Mailbox       bool                   `protobuf:"varint,5,opt,name=mailbox,proto3" json:"mailbox,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ContactRecord) Reset() {
+	*x = ContactRecord{}
+	mi := &file_pb_store_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ContactRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ContactRecord) ProtoMessage() {}
+
+func (x *ContactRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_store_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ContactRecord.ProtoReflect.Descriptor instead.
+func (*ContactRecord) Descriptor() ([]byte, []int) {
+	return file_pb_store_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ContactRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ContactRecord) GetAlias() string {
+	if x != nil {
+		return x.Alias
+	}
+	return ""
+}
+
+func (x *ContactRecord) GetAddresses() []string {
+	if x != nil {
+		return x.Addresses
+	}
+	return nil
+}
+
+func (x *ContactRecord) GetLastSeen() int64 {
+	if x != nil {
+		return x.LastSeen
+	}
+	return 0
+}
+
+func (x *ContactRecord) GetMailbox() bool {
+	if x != nil {
+		return x.Mailbox
+	}
+	return false
+}
+
+type ChatRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Group         bool                   `protobuf:"varint,3,opt,name=group,proto3" json:"group,omitempty"`
+	Pending       bool                   `protobuf:"varint,4,opt,name=pending,proto3" json:"pending,omitempty"`
+	Left          bool                   `protobuf:"varint,5,opt,name=left,proto3" json:"left,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChatRecord) Reset() {
+	*x = ChatRecord{}
+	mi := &file_pb_store_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChatRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChatRecord) ProtoMessage() {}
+
+func (x *ChatRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_store_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChatRecord.ProtoReflect.Descriptor instead.
+func (*ChatRecord) Descriptor() ([]byte, []int) {
+	return file_pb_store_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ChatRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ChatRecord) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ChatRecord) GetGroup() bool {
+	if x != nil {
+		return x.Group
+	}
+	return false
+}
+
+func (x *ChatRecord) GetPending() bool {
+	if x != nil {
+		return x.Pending
+	}
+	return false
+}
+
+func (x *ChatRecord) GetLeft() bool {
+	if x != nil {
+		return x.Left
+	}
+	return false
+}
+
+// MessageRecord is a message as it was signed by its author plus what we
+// found out about it. The ID and send time are also part of the key.
+type MessageRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Static        *Static                `protobuf:"bytes,1,opt,name=static,proto3" json:"static,omitempty"`
+	Unverified    bool                   `protobuf:"varint,2,opt,name=unverified,proto3" json:"unverified,omitempty"`
+	Deleted       bool                   `protobuf:"varint,3,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MessageRecord) Reset() {
+	*x = MessageRecord{}
+	mi := &file_pb_store_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MessageRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MessageRecord) ProtoMessage() {}
+
+func (x *MessageRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_store_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MessageRecord.ProtoReflect.Descriptor instead.
+func (*MessageRecord) Descriptor() ([]byte, []int) {
+	return file_pb_store_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *MessageRecord) GetStatic() *Static {
+	if x != nil {
+		return x.Static
+	}
+	return nil
+}
+
+func (x *MessageRecord) GetUnverified() bool {
+	if x != nil {
+		return x.Unverified
+	}
+	return false
+}
+
+func (x *MessageRecord) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+type PeerRecord struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// binary multiaddrs
+	Addrs         [][]byte `protobuf:"bytes,2,rep,name=addrs,proto3" json:"addrs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PeerRecord) Reset() {
+	*x = PeerRecord{}
+	mi := &file_pb_store_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PeerRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerRecord) ProtoMessage() {}
+
+func (x *PeerRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_store_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerRecord.ProtoReflect.Descriptor instead.
+func (*PeerRecord) Descriptor() ([]byte, []int) {
+	return file_pb_store_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PeerRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *PeerRecord) GetAddrs() [][]byte {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+var File_pb_store_proto protoreflect.FileDescriptor
+
+const file_pb_store_proto_rawDesc = "" +
+	"\n" +
+	"\x0epb/store.proto\x12\x02pb\x1a\x10pb/message.proto\"\x8a\x01\n" +
+	"\rContactRecord\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05alias\x18\x02 \x01(\tR\x05alias\x12\x1c\n" +
+	"\taddresses\x18\x03 \x03(\tR\taddresses\x12\x1b\n" +
+	"\tlast_seen\x18\x04 \x01(\x03R\blastSeen\x12\x18\n" +
+	"\amailbox\x18\x05 \x01(\bR\amailbox\"t\n" +
+	"\n" +
+	"ChatRecord\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x14\n" +
+	"\x05group\x18\x03 \x01(\bR\x05group\x12\x18\n" +
+	"\apending\x18\x04 \x01(\bR\apending\x12\x12\n" +
+	"\x04left\x18\x05 \x01(\bR\x04left\"m\n" +
+	"\rMessageRecord\x12\"\n" +
+	"\x06static\x18\x01 \x01(\v2\n" +
+	".pb.StaticR\x06static\x12\x1e\n" +
+	"\n" +
+	"unverified\x18\x02 \x01(\bR\n" +
+	"unverified\x12\x18\n" +
+	"\adeleted\x18\x03 \x01(\bR\adeleted\"2\n" +
+	"\n" +
+	"PeerRecord\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05addrs\x18\x02 \x03(\fR\x05addrsB\x06Z\x04./pbb\x06proto3"
+
+var (
+	file_pb_store_proto_rawDescOnce sync.Once
+	file_pb_store_proto_rawDescData []byte
+)
+
+func file_pb_store_proto_rawDescGZIP() []byte {
+	file_pb_store_proto_rawDescOnce.Do(func() {
+		file_pb_store_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pb_store_proto_rawDesc), len(file_pb_store_proto_rawDesc)))
+	})
+	return file_pb_store_proto_rawDescData
+}
+
+var file_pb_store_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_pb_store_proto_goTypes = []any{
+	(*ContactRecord)(nil), // 0: pb.ContactRecord
+	(*ChatRecord)(nil),    // 1: pb.ChatRecord
+	(*MessageRecord)(nil), // 2: pb.MessageRecord
+	(*PeerRecord)(nil),    // 3: pb.PeerRecord
+	(*Static)(nil),        // 4: pb.Static
+}
+var file_pb_store_proto_depIdxs = []int32{
+	4, // 0: pb.MessageRecord.static:type_name -> pb.Static
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_pb_store_proto_init() }
+func file_pb_store_proto_init() {
+	if File_pb_store_proto != nil {
+		return
+	}
+	file_pb_message_proto_init()
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_store_proto_rawDesc), len(file_pb_store_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_pb_store_proto_goTypes,
+		DependencyIndexes: file_pb_store_proto_depIdxs,
+		MessageInfos:      file_pb_store_proto_msgTypes,
+	}.Build()
+	File_pb_store_proto = out.File
+	file_pb_store_proto_goTypes = nil
+	file_pb_store_proto_depIdxs = nil
+}
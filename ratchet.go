@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// how far ahead of the receiving chain a message may be
+	maxSkip = 1000
+	// message keys of lost or reordered messages kept per session
+	maxSkippedKeys = 2000
+)
+
+const (
+	x3dhInfo       = "mobila x3dh"
+	rootInfo       = "mobila ratchet"
+	messageKeyInfo = "mobila message key"
+)
+
+var errDecrypt = errors.New("message authentication failed")
+
+func newDHPair() (priv, pub []byte, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	sk, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return sk.ECDH(pk)
+}
+
+// x3dhSecret derives the shared secret from the three DH outputs. There are
+// no one-time prekeys, the ratchet provides forward secrecy from the first reply.
+func x3dhSecret(dh1, dh2, dh3 []byte) ([]byte, error) {
+	ikm := bytes.Repeat([]byte{0xFF}, 32)
+	ikm = append(ikm, dh1...)
+	ikm = append(ikm, dh2...)
+	ikm = append(ikm, dh3...)
+	return hkdf.Key(sha256.New, ikm, make([]byte, 32), x3dhInfo, 32)
+}
+
+// x3dhInitiate is run by the side that starts a session, with the bundle of the other.
+func x3dhInitiate(ourIdentity, theirIdentity, theirPrekey []byte) (secret, ephemeral []byte, err error) {
+	ekPriv, ekPub, err := newDHPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	dh1, err := dh(ourIdentity, theirPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := dh(ekPriv, theirIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := dh(ekPriv, theirPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err = x3dhSecret(dh1, dh2, dh3)
+	return secret, ekPub, err
+}
+
+func x3dhRespond(ourIdentity, ourPrekey, theirIdentity, theirEphemeral []byte) ([]byte, error) {
+	dh1, err := dh(ourPrekey, theirIdentity)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(ourIdentity, theirEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(ourPrekey, theirEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	return x3dhSecret(dh1, dh2, dh3)
+}
+
+type skippedKey struct {
+	DH []byte `json:"dh"`
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+// Ratchet is the Double Ratchet state of one session, as in the Signal spec.
+type Ratchet struct {
+	DHsPriv []byte       `json:"dhs_priv"`
+	DHsPub  []byte       `json:"dhs_pub"`
+	DHr     []byte       `json:"dhr"`
+	RK      []byte       `json:"rk"`
+	CKs     []byte       `json:"cks"`
+	CKr     []byte       `json:"ckr"`
+	Ns      uint32       `json:"ns"`
+	Nr      uint32       `json:"nr"`
+	PN      uint32       `json:"pn"`
+	Skipped []skippedKey `json:"skipped,omitempty"`
+	// AD binds every message to the identity keys of both sides, initiator first
+	AD []byte `json:"ad"`
+}
+
+type ratchetHeader struct {
+	DH []byte
+	PN uint32
+	N  uint32
+}
+
+func (h ratchetHeader) bytes() []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(slices.Clone(h.DH), h.PN), h.N)
+}
+
+func kdfRK(rk, dhOut []byte) (root, chain []byte, err error) {
+	out, err := hkdf.Key(sha256.New, dhOut, rk, rootInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func kdfCK(ck []byte) (chain, mk []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{1})
+	mk = mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte{2})
+	return mac.Sum(nil), mk
+}
+
+func NewInitiatorRatchet(secret, theirPrekey, ad []byte) (*Ratchet, error) {
+	priv, pub, err := newDHPair()
+	if err != nil {
+		return nil, err
+	}
+	dhOut, err := dh(priv, theirPrekey)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := kdfRK(secret, dhOut)
+	if err != nil {
+		return nil, err
+	}
+	return &Ratchet{DHsPriv: priv, DHsPub: pub, DHr: theirPrekey, RK: rk, CKs: cks, AD: ad}, nil
+}
+
+// NewResponderRatchet starts from our signed prekey; it can only send after
+// the first message of the initiator was decrypted.
+func NewResponderRatchet(secret, prekeyPriv, prekeyPub, ad []byte) *Ratchet {
+	return &Ratchet{DHsPriv: prekeyPriv, DHsPub: prekeyPub, RK: secret, AD: ad}
+}
+
+func (r *Ratchet) Encrypt(plaintext []byte) (ratchetHeader, []byte, error) {
+	if r.CKs == nil {
+		return ratchetHeader{}, nil, fmt.Errorf("session has no sending chain yet")
+	}
+	var mk []byte
+	r.CKs, mk = kdfCK(r.CKs)
+	h := ratchetHeader{DH: r.DHsPub, PN: r.PN, N: r.Ns}
+	r.Ns++
+	ct, err := seal(mk, plaintext, append(slices.Clone(r.AD), h.bytes()...))
+	return h, ct, err
+}
+
+// Decrypt leaves the state untouched unless the message authenticates.
+func (r *Ratchet) Decrypt(h ratchetHeader, ciphertext []byte) ([]byte, error) {
+	ad := append(slices.Clone(r.AD), h.bytes()...)
+	for i, sk := range r.Skipped {
+		if sk.N == h.N && bytes.Equal(sk.DH, h.DH) {
+			pt, err := open(sk.MK, ciphertext, ad)
+			if err != nil {
+				return nil, err
+			}
+			r.Skipped = slices.Delete(r.Skipped, i, i+1)
+			return pt, nil
+		}
+	}
+
+	next := *r
+	next.Skipped = slices.Clone(r.Skipped)
+	if !bytes.Equal(h.DH, next.DHr) {
+		if err := next.skip(h.PN); err != nil {
+			return nil, err
+		}
+		if err := next.dhRatchet(h); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skip(h.N); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	next.CKr, mk = kdfCK(next.CKr)
+	next.Nr++
+	pt, err := open(mk, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	*r = next
+	return pt, nil
+}
+
+func (r *Ratchet) skip(until uint32) error {
+	if r.CKr == nil {
+		return nil
+	}
+	if until > r.Nr+maxSkip {
+		return fmt.Errorf("message %d is too far ahead of %d", until, r.Nr)
+	}
+	for r.Nr < until {
+		var mk []byte
+		r.CKr, mk = kdfCK(r.CKr)
+		r.Skipped = append(r.Skipped, skippedKey{DH: r.DHr, N: r.Nr, MK: mk})
+		r.Nr++
+	}
+	if over := len(r.Skipped) - maxSkippedKeys; over > 0 {
+		r.Skipped = r.Skipped[over:]
+	}
+	return nil
+}
+
+func (r *Ratchet) dhRatchet(h ratchetHeader) error {
+	r.PN, r.Ns, r.Nr = r.Ns, 0, 0
+	r.DHr = h.DH
+	dhOut, err := dh(r.DHsPriv, r.DHr)
+	if err != nil {
+		return err
+	}
+	if r.RK, r.CKr, err = kdfRK(r.RK, dhOut); err != nil {
+		return err
+	}
+	if r.DHsPriv, r.DHsPub, err = newDHPair(); err != nil {
+		return err
+	}
+	if dhOut, err = dh(r.DHsPriv, r.DHr); err != nil {
+		return err
+	}
+	r.RK, r.CKs, err = kdfRK(r.RK, dhOut)
+	return err
+}
+
+// messageAEAD expands a message key into a ChaCha20-Poly1305 key and nonce.
+func messageAEAD(mk []byte) (cipher.AEAD, []byte, error) {
+	out, err := hkdf.Key(sha256.New, mk, nil, messageKeyInfo, chacha20poly1305.KeySize+chacha20poly1305.NonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.New(out[:chacha20poly1305.KeySize])
+	return aead, out[chacha20poly1305.KeySize:], err
+}
+
+func seal(mk, plaintext, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func open(mk, ciphertext, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return pt, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"fyne.io/fyne/v2"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// offered in the message actions
+var quickReactions = []string{"👍", "❤️", "😂", "😮", "😢", "🙏"}
+
+// Reaction is the latest add or remove of an emoji by one member.
+type Reaction struct {
+	ChatID    string    `json:"chat_id"`
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Author    string    `json:"author"`
+	Emoji     string    `json:"emoji"`
+	Remove    bool      `json:"remove,omitempty"`
+	Sent      time.Time `json:"sent"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// Reactions of one message by emoji and author. Only the latest event of
+// each member counts, so a resent or repeated one changes nothing.
+type Reactions map[string]map[string]Reaction
+
+// apply reports whether r is newer than what the author did with the emoji before.
+func (rs Reactions) apply(r Reaction) bool {
+	old, ok := rs[r.Emoji][r.Author]
+	if ok && (old.Sent.After(r.Sent) || (old.Sent.Equal(r.Sent) && old.ID >= r.ID)) {
+		return false
+	}
+	if rs[r.Emoji] == nil {
+		rs[r.Emoji] = make(map[string]Reaction)
+	}
+	rs[r.Emoji][r.Author] = r
+	return true
+}
+
+// Counts returns who reacted with each emoji.
+func (rs Reactions) Counts() map[string][]string {
+	counts := make(map[string][]string)
+	for emoji, authors := range rs {
+		for author, r := range authors {
+			if !r.Remove {
+				counts[emoji] = append(counts[emoji], author)
+			}
+		}
+		sort.Strings(counts[emoji])
+	}
+	return counts
+}
+
+func (r *Reaction) ToProto() *pb.Reaction {
+	kind := pb.Reaction_ADD
+	if r.Remove {
+		kind = pb.Reaction_REMOVE
+	}
+	return &pb.Reaction{
+		Kind:       kind,
+		ChatId:     r.ChatID,
+		ReactionId: r.ID,
+		MessageId:  r.MessageID,
+		AuthorId:   r.Author,
+		Emoji:      r.Emoji,
+		Timestamp:  r.Sent.UnixNano(),
+		Signature:  r.Signature,
+	}
+}
+
+func ReactionFromProto(p *pb.Reaction) Reaction {
+	return Reaction{
+		ChatID:    p.ChatId,
+		ID:        p.ReactionId,
+		MessageID: p.MessageId,
+		Author:    p.AuthorId,
+		Emoji:     p.Emoji,
+		Remove:    p.Kind == pb.Reaction_REMOVE,
+		Sent:      time.Unix(0, p.Timestamp),
+		Signature: p.Signature,
+	}
+}
+
+func reactionSignedData(r *Reaction) []byte {
+	data := []byte("mobila reaction")
+	data = appendField(data, []byte(r.ChatID))
+	data = appendField(data, []byte(r.ID))
+	data = appendField(data, []byte(r.MessageID))
+	data = appendField(data, []byte(r.Author))
+	data = appendField(data, []byte(r.Emoji))
+	if r.Remove {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	return binary.BigEndian.AppendUint64(data, uint64(r.Sent.UnixNano()))
+}
+
+func (r *Reaction) Sign(priv crypto.PrivKey) error {
+	sig, err := priv.Sign(reactionSignedData(r))
+	if err != nil {
+		return err
+	}
+	r.Signature = sig
+	return nil
+}
+
+func (r *Reaction) Verify() error {
+	return verifyPeerSignature(r.Author, reactionSignedData(r), r.Signature)
+}
+
+// validEmoji keeps reactions to a short run of symbols.
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= 32 && !strings.ContainsFunc(emoji, unicode.IsSpace)
+}
+
+// React adds our emoji to a message, or takes it back if remove is set.
+func (s *State) React(chatID, msgID, emoji string, remove bool) error {
+	ownID := s.Node.Host.ID().String()
+	if !slices.Contains(s.chatMembers(chatID), ownID) {
+		return fmt.Errorf("not a member of chat %s", chatID)
+	}
+	r := Reaction{
+		ChatID:    chatID,
+		ID:        uuid.NewString(),
+		MessageID: msgID,
+		Author:    ownID,
+		Emoji:     emoji,
+		Remove:    remove,
+		Sent:      time.Now(),
+	}
+	if err := r.Sign(s.Node.Host.Peerstore().PrivKey(s.Node.Host.ID())); err != nil {
+		return err
+	}
+	if err := s.applyReaction(r); err != nil {
+		return err
+	}
+	return s.sendToChat(chatID, &pb.DataPacket{Msg: &pb.DataPacket_Reaction{Reaction: r.ToProto()}})
+}
+
+func (s *State) applyReaction(r Reaction) error {
+	if !validEmoji(r.Emoji) {
+		return fmt.Errorf("bad reaction %q", r.Emoji)
+	}
+	changed, err := s.Store.AddReaction(r)
+	if err != nil || !changed {
+		return err
+	}
+	fyne.Do(func() {
+		s.mu.Lock()
+		selected := s.SelectedChat != nil && s.SelectedChat.ID == r.ChatID
+		if selected {
+			if m := s.SelectedChat.GetMessage(r.MessageID); m != nil {
+				if m.Reactions == nil {
+					m.Reactions = make(Reactions)
+				}
+				m.Reactions.apply(r)
+			}
+		}
+		s.mu.Unlock()
+		if selected && s.OnMessagesUpdated != nil {
+			s.OnMessagesUpdated(r.ChatID)
+		}
+	})
+	return nil
+}
+
+func (s *State) receiveReaction(peerID string, pr *pb.Reaction) error {
+	members := s.chatMembers(pr.ChatId)
+	if !slices.Contains(members, peerID) || !slices.Contains(members, pr.AuthorId) {
+		return fmt.Errorf("reaction in chat %s from non-member", pr.ChatId)
+	}
+	r := ReactionFromProto(pr)
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	return s.applyReaction(r)
+}
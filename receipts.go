@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+// ReceiptStatus is how far a message got with one recipient. It only ever
+// goes up.
+type ReceiptStatus int
+
+const (
+	ReceiptNone ReceiptStatus = iota
+	ReceiptDelivered
+	ReceiptRead
+)
+
+func receiptFromProto(k pb.Receipt_Kind) ReceiptStatus {
+	if k == pb.Receipt_READ {
+		return ReceiptRead
+	}
+	return ReceiptDelivered
+}
+
+// Receipt is the stored status of a message for one recipient.
+type Receipt struct {
+	Status ReceiptStatus `json:"status"`
+	At     time.Time     `json:"at"`
+}
+
+// ReceiptSummary counts the recipients among peers that got and read the
+// message. Read ones count as delivered too.
+func (m *Message) ReceiptSummary(peers []string) (delivered, read, total int) {
+	for _, p := range peers {
+		if p == m.Author {
+			continue
+		}
+		total++
+		switch m.Receipts[p] {
+		case ReceiptRead:
+			read++
+			delivered++
+		case ReceiptDelivered:
+			delivered++
+		}
+	}
+	return delivered, read, total
+}
+
+// sendReceipt tells the author of the messages how far they got with us.
+func (s *State) sendReceipt(authorID string, kind pb.Receipt_Kind, chatID string, msgIDs []string) {
+	packet := &pb.DataPacket{Msg: &pb.DataPacket_Receipt{Receipt: &pb.Receipt{
+		Kind:       kind,
+		ChatId:     chatID,
+		MessageIds: msgIDs,
+		Timestamp:  time.Now().UnixNano(),
+	}}}
+	if err := s.deliver(authorID, packet); err != nil {
+		fmt.Printf("receipt not delivered to %s: %v\n", authorID, err)
+	}
+}
+
+// MarkRead records the messages of the selected chat as read by us and sends
+// read receipts to their authors. Called on the UI thread while the chat is shown.
+func (s *State) MarkRead(chatID string) {
+	ownID := s.Node.Host.ID().String()
+	unread := make(map[string][]string)
+	s.mu.Lock()
+	if s.SelectedChat == nil || s.SelectedChat.ID != chatID {
+		s.mu.Unlock()
+		return
+	}
+	for i := range s.SelectedChat.Messages {
+		m := &s.SelectedChat.Messages[i]
+		if m.Event != nil || m.Author == ownID || m.Unverified || m.Receipts[ownID] == ReceiptRead {
+			continue
+		}
+		if m.Receipts == nil {
+			m.Receipts = make(map[string]ReceiptStatus)
+		}
+		m.Receipts[ownID] = ReceiptRead
+		unread[m.Author] = append(unread[m.Author], m.ID)
+	}
+	s.mu.Unlock()
+	if len(unread) == 0 {
+		return
+	}
+
+	go func() {
+		now := time.Now()
+		for author, ids := range unread {
+			for _, id := range ids {
+				if _, err := s.Store.SetReceipt(chatID, id, ownID, Receipt{Status: ReceiptRead, At: now}); err != nil {
+					fmt.Printf("error recording read message %s: %v\n", id, err)
+				}
+			}
+			s.sendReceipt(author, pb.Receipt_READ, chatID, ids)
+		}
+	}()
+}
+
+func (s *State) receiveReceipt(peerID string, r *pb.Receipt) {
+	if !slices.Contains(s.chatMembers(r.ChatId), peerID) {
+		fmt.Printf("receipt from non-member %s dropped\n", peerID)
+		return
+	}
+	ownID := s.Node.Host.ID().String()
+	rcpt := Receipt{Status: receiptFromProto(r.Kind), At: time.Unix(0, r.Timestamp)}
+	var changed []string
+	for _, id := range r.MessageIds {
+		msg, err := s.Store.GetMessage(r.ChatId, id)
+		if err != nil || msg == nil || msg.Author != ownID {
+			continue
+		}
+		ok, err := s.Store.SetReceipt(r.ChatId, id, peerID, rcpt)
+		if err != nil {
+			fmt.Printf("error recording receipt of %s: %v\n", id, err)
+			continue
+		}
+		if ok {
+			changed = append(changed, id)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	fyne.Do(func() {
+		s.mu.Lock()
+		selected := s.SelectedChat != nil && s.SelectedChat.ID == r.ChatId
+		if selected {
+			for _, id := range changed {
+				m := s.SelectedChat.GetMessage(id)
+				if m == nil || m.Receipts[peerID] >= rcpt.Status {
+					continue
+				}
+				if m.Receipts == nil {
+					m.Receipts = make(map[string]ReceiptStatus)
+				}
+				m.Receipts[peerID] = rcpt.Status
+			}
+		}
+		s.mu.Unlock()
+		if selected && s.OnMessagesUpdated != nil {
+			s.OnMessagesUpdated(r.ChatId)
+		}
+	})
+}
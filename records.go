@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"mobila/pb"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
+)
+
+// Contacts, chats, messages and bootstrap peers are stored as the records
+// of pb/store.proto.
+
+func marshalContact(c Contact) ([]byte, error) {
+	return proto.Marshal(&pb.ContactRecord{
+		Id:        c.ID,
+		Alias:     c.Alias,
+		Addresses: c.Addresses,
+		LastSeen:  c.LastSeen,
+		Mailbox:   c.Mailbox,
+	})
+}
+
+func unmarshalContact(data []byte) (Contact, error) {
+	var r pb.ContactRecord
+	if err := proto.Unmarshal(data, &r); err != nil {
+		return Contact{}, err
+	}
+	return Contact{ID: r.Id, Alias: r.Alias, Addresses: r.Addresses, LastSeen: r.LastSeen, Mailbox: r.Mailbox}, nil
+}
+
+// marshalChat keeps the header of the chat; members and messages have keys
+// of their own.
+func marshalChat(c *Chat) ([]byte, error) {
+	return proto.Marshal(&pb.ChatRecord{
+		Id:      c.ID,
+		Name:    c.Name,
+		Group:   c.Group,
+		Pending: c.Pending,
+		Left:    c.Left,
+	})
+}
+
+// unmarshalChat fills in the header of c.
+func unmarshalChat(data []byte, c *Chat) error {
+	var r pb.ChatRecord
+	if err := proto.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	c.ID, c.Name, c.Group, c.Pending, c.Left = r.Id, r.Name, r.Group, r.Pending, r.Left
+	return nil
+}
+
+func marshalMessage(m *Message) ([]byte, error) {
+	return proto.Marshal(&pb.MessageRecord{
+		Static:     m.ToStatic(),
+		Unverified: m.Unverified,
+		Deleted:    m.Deleted,
+	})
+}
+
+func unmarshalMessage(data []byte) (Message, error) {
+	var r pb.MessageRecord
+	if err := proto.Unmarshal(data, &r); err != nil {
+		return Message{}, err
+	}
+	if r.Static == nil {
+		return Message{}, fmt.Errorf("message record without message")
+	}
+	m, err := MessageFromStatic(r.Static)
+	if err != nil {
+		return m, err
+	}
+	m.Unverified, m.Deleted = r.Unverified, r.Deleted
+	return m, nil
+}
+
+func marshalAddrInfo(info peer.AddrInfo) ([]byte, error) {
+	r := &pb.PeerRecord{Id: info.ID.String()}
+	for _, a := range info.Addrs {
+		r.Addrs = append(r.Addrs, a.Bytes())
+	}
+	return proto.Marshal(r)
+}
+
+func unmarshalAddrInfo(data []byte) (peer.AddrInfo, error) {
+	var r pb.PeerRecord
+	if err := proto.Unmarshal(data, &r); err != nil {
+		return peer.AddrInfo{}, err
+	}
+	id, err := peer.Decode(r.Id)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	info := peer.AddrInfo{ID: id}
+	for _, b := range r.Addrs {
+		a, err := multiaddr.NewMultiaddrBytes(b)
+		if err != nil {
+			return info, err
+		}
+		info.Addrs = append(info.Addrs, a)
+	}
+	return info, nil
+}
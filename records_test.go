@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "store")
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{DB: db, Path: path}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func jsonOf(t testing.TB, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestJSONToRecordsRoundTrip(t *testing.T) {
+	s := newTestStore(t)
+	sent := time.Unix(0, 1740830400123456789)
+	hash := sha256.Sum256([]byte("photo"))
+	bootID, _ := peer.Decode("QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	boot := peer.AddrInfo{ID: bootID, Addrs: []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/192.0.2.1/tcp/4001"),
+		multiaddr.StringCast("/ip6/2001:db8::1/udp/4001/quic-v1"),
+	}}
+	contacts := []Contact{
+		{ID: "12D3KooWAlice", Alias: "Alice", Addresses: []string{"/ip4/192.0.2.10/tcp/4001"}, LastSeen: 1700000000, Mailbox: true},
+		{ID: "12D3KooWBob"},
+	}
+	chats := []Chat{
+		{ID: "direct", Name: "Alice"},
+		{ID: "group", Name: "Weekend", Group: true, Pending: true},
+		{ID: "left", Name: "Old", Group: true, Left: true},
+	}
+	msgs := []Message{
+		{ID: "m1", ChatID: "direct", Author: "12D3KooWAlice", Text: "hello", Sent: sent},
+		{ID: "m2", Prev: "m1", ChatID: "direct", Author: "12D3KooWBob", Text: "привет, café", Sent: sent.Add(time.Second),
+			Merges: []string{"x1", "x2"}, ReplyTo: "m1", Signature: bytes.Repeat([]byte{7}, 64), Unverified: true},
+		{ID: "m3", Prev: "m2", ChatID: "direct", Author: "12D3KooWAlice", Sent: sent.Add(2 * time.Second),
+			Attachment: &Attachment{Hash: hash[:], Size: 123456, Name: "photo.jpg", Mime: "image/jpeg", ChunkSize: blobChunkSize}},
+		{ID: "m4", Prev: "m3", ChatID: "direct", Author: "12D3KooWBob", Sent: sent.Add(3 * time.Second), Deleted: true},
+	}
+
+	err := s.update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte("boot:"+bootID.String()), []byte(jsonOf(t, boot))); err != nil {
+			return err
+		}
+		for _, c := range contacts {
+			if err := txn.Set([]byte("contact:"+c.ID), []byte(jsonOf(t, c))); err != nil {
+				return err
+			}
+		}
+		for _, c := range chats {
+			if err := txn.Set([]byte("chat:"+c.ID), []byte(jsonOf(t, c))); err != nil {
+				return err
+			}
+		}
+		for _, m := range msgs {
+			key := fmt.Sprintf("msg:%s:%020d:%s", m.ChatID, m.Sent.UnixNano(), m.ID)
+			if err := txn.Set([]byte(key), []byte(jsonOf(t, m))); err != nil {
+				return err
+			}
+		}
+		// a value no build could read stays as it is
+		return txn.Set([]byte("msg:direct:00000000000000000001:broken"), []byte("{"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.update(jsonToRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := dumpDB(t, s.DB)
+	info, err := unmarshalAddrInfo(entries["boot:"+bootID.String()])
+	if err != nil || jsonOf(t, info) != jsonOf(t, boot) {
+		t.Errorf("boot: %v, %v; want %v", info, err, boot)
+	}
+	for _, want := range contacts {
+		got, err := unmarshalContact(entries["contact:"+want.ID])
+		if err != nil || got.ID != want.ID || got.Alias != want.Alias || strings.Join(got.Addresses, ",") != strings.Join(want.Addresses, ",") ||
+			got.LastSeen != want.LastSeen || got.Mailbox != want.Mailbox {
+			t.Errorf("contact: %+v, %v; want %+v", got, err, want)
+		}
+	}
+	for _, want := range chats {
+		var got Chat
+		if err := unmarshalChat(entries["chat:"+want.ID], &got); err != nil || jsonOf(t, got) != jsonOf(t, want) {
+			t.Errorf("chat: %+v, %v; want %+v", got, err, want)
+		}
+	}
+	for _, want := range msgs {
+		key := fmt.Sprintf("msg:%s:%020d:%s", want.ChatID, want.Sent.UnixNano(), want.ID)
+		got, err := unmarshalMessage(entries[key])
+		if err != nil || jsonOf(t, got) != jsonOf(t, want) {
+			t.Errorf("message:\n got %s, %v\nwant %s", jsonOf(t, got), err, jsonOf(t, want))
+		}
+	}
+	if got := string(entries["msg:direct:00000000000000000001:broken"]); got != "{" {
+		t.Errorf("undecodable value rewritten to %q", got)
+	}
+}
+
+// largeChat makes n messages like a busy group chat: short and long texts,
+// signatures, replies and now and then a file.
+func largeChat(n int) []Message {
+	r := rand.New(rand.NewPCG(1, 2))
+	words := strings.Fields("ok yes no maybe tomorrow tonight meeting photo coffee the a is are we you they " +
+		"привет ладно завтра café déjà vu 👍 🎉 lunch train late sorry thanks")
+	authors := []string{
+		"12D3KooWAFMojmFhkiVMSav8osBkXS8wuHviPBZcHRVVEpqS1XNF",
+		"12D3KooWAcuQX2kXniEWkChg6kQuUPhcEGVDXQaKRQR3zVfFZABt",
+		"12D3KooWDQadpYNrMwgCEowBr1Y2B9fsJxaJAqC4LxcerCKe6214",
+	}
+	chatID := "0b7d8c5e-6f1a-4c2b-9d3e-5a4f6b7c8d9e"
+	sent := time.Unix(0, 1740830400000000000)
+	msgs := make([]Message, n)
+	prev := ""
+	for i := range msgs {
+		text := make([]string, 1+r.IntN(25))
+		for j := range text {
+			text[j] = words[r.IntN(len(words))]
+		}
+		sig := make([]byte, 64)
+		for j := range sig {
+			sig[j] = byte(r.Uint32())
+		}
+		m := Message{
+			ID:        fmt.Sprintf("%08x-%04x-4%03x-8%03x-%012x", r.Uint32(), r.IntN(1<<16), r.IntN(1<<12), r.IntN(1<<12), r.Int64N(1<<48)),
+			Prev:      prev,
+			ChatID:    chatID,
+			Author:    authors[r.IntN(len(authors))],
+			Text:      strings.Join(text, " "),
+			Sent:      sent.Add(time.Duration(i) * 7 * time.Second),
+			Signature: sig,
+		}
+		if i > 0 && r.IntN(10) == 0 {
+			m.ReplyTo = msgs[r.IntN(i)].ID
+		}
+		if r.IntN(50) == 0 {
+			hash := sha256.Sum256(sig)
+			m.Text = ""
+			m.Attachment = &Attachment{Hash: hash[:], Size: r.Int64N(10 << 20), Name: "IMG_2041.jpg", Mime: "image/jpeg", ChunkSize: blobChunkSize}
+		}
+		msgs[i] = m
+		prev = m.ID
+	}
+	return msgs
+}
+
+// the benchmarks go through a chat this long, B/msg is the stored size
+const benchChatSize = 10000
+
+func benchmarkEncode(b *testing.B, encode func(*Message) ([]byte, error)) {
+	msgs := largeChat(benchChatSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	size := 0
+	for i := 0; i < b.N; i++ {
+		data, err := encode(&msgs[i%len(msgs)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += len(data)
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "B/msg")
+}
+
+func benchmarkDecode(b *testing.B, encode func(*Message) ([]byte, error), decode func([]byte) (Message, error)) {
+	msgs := largeChat(benchChatSize)
+	values := make([][]byte, len(msgs))
+	size := 0
+	for i := range msgs {
+		var err error
+		if values[i], err = encode(&msgs[i]); err != nil {
+			b.Fatal(err)
+		}
+		size += len(values[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decode(values[i%len(values)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size)/float64(len(values)), "B/msg")
+}
+
+func encodeJSON(m *Message) ([]byte, error) { return json.Marshal(m) }
+
+func decodeJSON(data []byte) (Message, error) {
+	var m Message
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
+
+func BenchmarkMessageEncodeJSON(b *testing.B)   { benchmarkEncode(b, encodeJSON) }
+func BenchmarkMessageEncodeRecord(b *testing.B) { benchmarkEncode(b, marshalMessage) }
+
+func BenchmarkMessageDecodeJSON(b *testing.B)   { benchmarkDecode(b, encodeJSON, decodeJSON) }
+func BenchmarkMessageDecodeRecord(b *testing.B) { benchmarkDecode(b, marshalMessage, unmarshalMessage) }
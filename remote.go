@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mobila/pb"
+	"sync"
+
+	"github.com/at-wat/ebml-go/mkvcore"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+const (
+	// chunks waiting for a missing predecessor before the gap is skipped
+	reorderWindow = 32
+	chunkQueue    = 64
+)
+
+// EBML ID of a Cluster element; demuxing may only resume at one
+var clusterID = []byte{0x1F, 0x43, 0xB6, 0x75}
+
+// RemoteStream turns the StreamChunk packets of one peer back into video
+// frames and decoded audio.
+type RemoteStream struct {
+	peerID  string
+	onFrame func(image.Image)
+	onAudio func(pcm []int16)
+
+	chunks    chan *pb.StreamChunk
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewRemoteStream(peerID string, onFrame func(image.Image), onAudio func(pcm []int16)) *RemoteStream {
+	rs := &RemoteStream{
+		peerID:  peerID,
+		onFrame: onFrame,
+		onAudio: onAudio,
+		chunks:  make(chan *pb.StreamChunk, chunkQueue),
+		closed:  make(chan struct{}),
+	}
+	go rs.run()
+	return rs
+}
+
+// Push never blocks the network reader; chunks are dropped when decoding lags.
+func (rs *RemoteStream) Push(chunk *pb.StreamChunk) {
+	select {
+	case rs.chunks <- chunk:
+	case <-rs.closed:
+	default:
+		fmt.Printf("stream of %s lags, chunk %d dropped\n", rs.peerID, chunk.SeqNumber)
+	}
+}
+
+func (rs *RemoteStream) Close() {
+	rs.closeOnce.Do(func() { close(rs.closed) })
+}
+
+// run reassembles chunks by SeqNumber and feeds them to the current demuxer.
+// An IsInit chunk carries the WebM header and starts a new demuxer; after a
+// gap the demuxer is restarted with that header and data is skipped until
+// the next Cluster.
+func (rs *RemoteStream) run() {
+	var (
+		pw       *io.PipeWriter
+		header   []byte
+		next     uint32
+		synced   bool
+		buffered = make(map[uint32][]byte)
+	)
+	defer func() {
+		if pw != nil {
+			pw.Close()
+		}
+	}()
+
+	restart := func() {
+		if pw != nil {
+			pw.Close()
+		}
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		go rs.demux(pr)
+		if _, err := pw.Write(header); err != nil {
+			pw = nil
+		}
+	}
+	feed := func(data []byte) {
+		if pw == nil {
+			return
+		}
+		if !synced {
+			i := bytes.Index(data, clusterID)
+			if i < 0 {
+				return
+			}
+			data, synced = data[i:], true
+		}
+		if _, err := pw.Write(data); err != nil {
+			pw = nil
+		}
+	}
+
+	for {
+		var chunk *pb.StreamChunk
+		select {
+		case chunk = <-rs.chunks:
+		case <-rs.closed:
+			return
+		}
+
+		if chunk.IsInit {
+			header = chunk.Data
+			restart()
+			clear(buffered)
+			next = chunk.SeqNumber + 1
+			// a late joiner gets the header long after the chunks that followed it
+			synced = false
+			continue
+		}
+		if pw == nil || chunk.SeqNumber < next {
+			continue
+		}
+
+		buffered[chunk.SeqNumber] = chunk.Data
+		if len(buffered) > reorderWindow {
+			// the missing chunk is not coming, continue from the oldest one we have
+			oldest := chunk.SeqNumber
+			for seq := range buffered {
+				oldest = min(oldest, seq)
+			}
+			next, synced = oldest, false
+			restart()
+		}
+		for {
+			data, ok := buffered[next]
+			if !ok {
+				break
+			}
+			delete(buffered, next)
+			feed(data)
+			next++
+		}
+	}
+}
+
+func (rs *RemoteStream) demux(pr *io.PipeReader) {
+	tracks, err := mkvcore.NewSimpleBlockReader(pr, mkvcore.WithOnFatalHandler(func(err error) {
+		if !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, io.EOF) {
+			fmt.Printf("error demuxing stream of %s: %v\n", rs.peerID, err)
+		}
+	}))
+	if err != nil {
+		fmt.Printf("error reading stream header of %s: %v\n", rs.peerID, err)
+		pr.Close()
+		return
+	}
+	for _, track := range tracks {
+		entry := track.TrackEntry()
+		switch entry.CodecID {
+		case "V_VP8":
+			go rs.decodeVideo(track)
+		case "A_OPUS":
+			go rs.decodeAudio(track)
+		default:
+			track.Close()
+		}
+	}
+}
+
+// frameReader hands the decoder exactly one encoded frame per Read.
+type frameReader struct {
+	track mkvcore.BlockReader
+}
+
+func (f frameReader) Read(p []byte) (int, error) {
+	b, _, _, err := f.track.Read()
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, b), nil
+}
+
+func (rs *RemoteStream) decodeVideo(track mkvcore.BlockReadCloser) {
+	defer track.Close()
+	// the frame size comes from the VP8 bitstream itself
+	decoder, err := vpx.NewDecoder(frameReader{track: track}, prop.Media{})
+	if err != nil {
+		fmt.Printf("error creating VP8 decoder for %s: %v\n", rs.peerID, err)
+		return
+	}
+	defer decoder.Close()
+	for {
+		img, release, err := decoder.Read()
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			// inter frames before the first key frame do not decode
+			continue
+		}
+		rs.onFrame(img)
+		release()
+	}
+}
+
+func (rs *RemoteStream) decodeAudio(track mkvcore.BlockReadCloser) {
+	defer track.Close()
+	decoder, err := NewOpusDecoder()
+	if err != nil {
+		fmt.Printf("error creating Opus decoder for %s: %v\n", rs.peerID, err)
+		return
+	}
+	defer decoder.Close()
+	for {
+		packet, _, _, err := track.Read()
+		if err != nil {
+			return
+		}
+		pcm, err := decoder.Decode(packet)
+		if err != nil {
+			fmt.Printf("error decoding audio of %s: %v\n", rs.peerID, err)
+			continue
+		}
+		rs.onAudio(pcm)
+	}
+}
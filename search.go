@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The search index maps every word of a message to the message:
+//
+//	idx:<token>:<chat>:<msg>    how often the token occurs, uint32
+//	idxdoc:<chat>:<msg>         the tokens of the message, space separated
+//
+// Tokens are lower case with diacritics removed, so "Ёжик" is found by
+// "ежик" and "café" by "cafe".
+
+const (
+	searchIndexKey = "system:search_index"
+	// 2 leaves out edits by anyone but the author
+	searchIndexVersion = 2
+	maxSearchHits      = 50
+	minTokenRunes      = 2
+	maxTokenBytes      = 64
+)
+
+// normalizeWord folds case and drops combining marks.
+func normalizeWord(word string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(word) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return norm.NFC.String(b.String())
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+}
+
+// tokenize splits text into normalized words and counts them.
+func tokenize(text string) map[string]uint32 {
+	tokens := make(map[string]uint32)
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !isWordRune(r) }) {
+		token := normalizeWord(word)
+		if len([]rune(token)) < minTokenRunes || len(token) > maxTokenBytes {
+			continue
+		}
+		tokens[token]++
+	}
+	return tokens
+}
+
+// queryTokens keeps the order of the query and also the short words, since
+// they may be the beginning of a longer one.
+func queryTokens(query string) []string {
+	var tokens []string
+	for _, word := range strings.FieldsFunc(query, func(r rune) bool { return !isWordRune(r) }) {
+		if token := normalizeWord(word); token != "" && len(token) <= maxTokenBytes {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// searchText is what of a message is indexed.
+func searchText(m *Message) string {
+	if m.Deleted {
+		return ""
+	}
+	if m.Attachment != nil {
+		return m.Attachment.Name
+	}
+	return m.Text
+}
+
+func indexDocKey(chatID, msgID string) []byte {
+	return []byte("idxdoc:" + chatID + ":" + msgID)
+}
+
+func indexKey(token, chatID, msgID string) []byte {
+	return []byte("idx:" + token + ":" + chatID + ":" + msgID)
+}
+
+// indexMessage replaces the indexed words of a message with those of text.
+func indexMessage(txn *badger.Txn, chatID, msgID, text string) error {
+	if item, err := txn.Get(indexDocKey(chatID, msgID)); err == nil {
+		old, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		for _, token := range strings.Fields(string(old)) {
+			if err := txn.Delete(indexKey(token, chatID, msgID)); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return txn.Delete(indexDocKey(chatID, msgID))
+	}
+	words := make([]string, 0, len(tokens))
+	for token, n := range tokens {
+		if err := txn.Set(indexKey(token, chatID, msgID), binary.BigEndian.AppendUint32(nil, n)); err != nil {
+			return err
+		}
+		words = append(words, token)
+	}
+	return txn.Set(indexDocKey(chatID, msgID), []byte(strings.Join(words, " ")))
+}
+
+// latestEditText returns the text of the newest edit of a message by its
+// author, if any. Edits by others are stored but never shown.
+func latestEditText(txn *badger.Txn, chatID, msgID, author string) (string, bool, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	prefix := []byte("edit:" + chatID + ":" + msgID + ":")
+	var latest *MessageEdit
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var e MessageEdit
+		if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+			return "", false, err
+		}
+		if e.Author == author {
+			latest = &e
+		}
+	}
+	if latest == nil {
+		return "", false, nil
+	}
+	return latest.Text, true, nil
+}
+
+// SearchHit is a message matching a search.
+type SearchHit struct {
+	ChatID    string
+	MessageID string
+	Author    string
+	Sent      time.Time
+	Snippet   string
+	Score     int
+}
+
+// Search finds the messages containing every word of the query, the last
+// word also as the beginning of a longer one. Whole word matches rank first,
+// then newer messages.
+func (s *Store) Search(query string) ([]SearchHit, error) {
+	tokens := queryTokens(query)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	type doc struct {
+		chatID, msgID string
+		matched       map[int]bool
+		score         int
+	}
+	docs := make(map[string]*doc)
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for i, token := range tokens {
+			prefix := []byte("idx:" + token)
+			if i < len(tokens)-1 {
+				prefix = append(prefix, ':')
+			}
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				parts := strings.Split(string(it.Item().Key()[len("idx:"):]), ":")
+				if len(parts) != 3 {
+					continue
+				}
+				var n uint32
+				it.Item().Value(func(v []byte) error {
+					if len(v) == 4 {
+						n = binary.BigEndian.Uint32(v)
+					}
+					return nil
+				})
+				key := parts[1] + ":" + parts[2]
+				d := docs[key]
+				if d == nil {
+					d = &doc{chatID: parts[1], msgID: parts[2], matched: make(map[int]bool)}
+					docs[key] = d
+				}
+				d.matched[i] = true
+				if parts[0] == token {
+					d.score += 3 * int(n)
+				} else {
+					d.score += int(n)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []SearchHit
+	for _, d := range docs {
+		if len(d.matched) < len(tokens) {
+			continue
+		}
+		m, err := s.GetMessage(d.chatID, d.msgID)
+		if err != nil || m == nil || m.Deleted {
+			continue
+		}
+		text := searchText(m)
+		if edits, err := s.GetMessageEdits(d.chatID, d.msgID); err == nil {
+			m.applyEdits(edits)
+			text = searchText(m)
+		}
+		hits = append(hits, SearchHit{
+			ChatID:    d.chatID,
+			MessageID: d.msgID,
+			Author:    m.Author,
+			Sent:      m.Sent,
+			Snippet:   snippet(text, tokens),
+			Score:     d.score,
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Sent.After(hits[j].Sent)
+	})
+	if len(hits) > maxSearchHits {
+		hits = hits[:maxSearchHits]
+	}
+	return hits, nil
+}
+
+// snippet cuts the text around the first word matching one of the tokens.
+func snippet(text string, tokens []string) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	anchor := 0
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		word := normalizeWord(string(runes[start:end]))
+		if strings.HasPrefix(word, tokens[len(tokens)-1]) || slices.Contains(tokens, word) {
+			anchor = start
+			break
+		}
+		start = end
+	}
+	from, to := max(anchor-30, 0), min(anchor+70, len(runes))
+	out := string(runes[from:to])
+	if from > 0 {
+		out = "..." + out
+	}
+	if to < len(runes) {
+		out += "..."
+	}
+	return out
+}
+
+func (s *Store) SearchIndexBuilt() bool {
+	var version int
+	found, err := s.getJSON(searchIndexKey, &version)
+	return err == nil && found && version == searchIndexVersion
+}
+
+// RebuildSearchIndex indexes every stored message from scratch.
+func (s *Store) RebuildSearchIndex() (int, error) {
+	if err := s.deletePrefix([]byte("idx:")); err != nil {
+		return 0, err
+	}
+	if err := s.deletePrefix([]byte("idxdoc:")); err != nil {
+		return 0, err
+	}
+	var msgs []Message
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("msg:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			parts := strings.Split(string(it.Item().Key()[len(prefix):]), ":")
+			if len(parts) != 3 {
+				continue
+			}
+			var m Message
+			if err := it.Item().Value(func(v []byte) error {
+				var err error
+				m, err = unmarshalMessage(v)
+				return err
+			}); err != nil {
+				fmt.Printf("error reading message %s: %v\n", it.Item().Key(), err)
+				continue
+			}
+			m.ChatID, m.ID = parts[0], parts[2]
+			msgs = append(msgs, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range msgs {
+		m := &msgs[i]
+		err := s.update(func(txn *badger.Txn) error {
+			text := searchText(m)
+			if edited, ok, err := latestEditText(txn, m.ChatID, m.ID, m.Author); err != nil {
+				return err
+			} else if ok && !m.Deleted {
+				text = edited
+			}
+			return indexMessage(txn, m.ChatID, m.ID, text)
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), s.setJSON(searchIndexKey, searchIndexVersion)
+}
+
+func (s *State) RebuildSearchIndex() error {
+	n, err := s.Store.RebuildSearchIndex()
+	if err != nil {
+		fmt.Printf("error rebuilding search index: %v\n", err)
+		return err
+	}
+	fmt.Printf("search index rebuilt from %d messages\n", n)
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"mobila/pb"
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// sender keys of one peer kept per group; older ones decrypt late messages
+const maxSenderKeysPerPeer = 4
+
+// OwnSenderKey is the chain we encrypt our group messages with. It is
+// replaced whenever the membership of the group changes.
+type OwnSenderKey struct {
+	KeyID     []byte `json:"key_id"`
+	ChainKey  []byte `json:"chain_key"`
+	Iteration uint32 `json:"iteration"`
+	// SigningKey signs our packets, members can read the chain key and
+	// so could forge them otherwise
+	SigningKey ed25519.PrivateKey `json:"signing_key"`
+	// Delivered are the members that got the key over a pairwise session
+	Delivered map[string]bool `json:"delivered"`
+}
+
+type PeerSenderKey struct {
+	ChainKey   []byte            `json:"chain_key"`
+	Iteration  uint32            `json:"iteration"`
+	Skipped    map[uint32][]byte `json:"skipped,omitempty"`
+	SigningKey ed25519.PublicKey `json:"signing_key"`
+}
+
+// PeerSenderKeys are the sender keys of one member of a group, keyed by hex
+// key ID, Order oldest first.
+type PeerSenderKeys struct {
+	Keys  map[string]*PeerSenderKey `json:"keys"`
+	Order []string                  `json:"order"`
+}
+
+func groupAD(chatID, senderID string, keyID []byte, iteration uint32) []byte {
+	data := []byte("mobila group")
+	data = appendField(data, []byte(chatID))
+	data = appendField(data, []byte(senderID))
+	data = appendField(data, keyID)
+	return binary.BigEndian.AppendUint32(data, iteration)
+}
+
+// groupSignedData is what the sender signs: the associated data and the ciphertext.
+func groupSignedData(gs *pb.GroupSealed) []byte {
+	return appendField(groupAD(gs.ChatId, gs.SenderId, gs.KeyId, gs.Iteration), gs.Ciphertext)
+}
+
+// SealGroup encrypts the packet with our sender key of the chat. It returns
+// the key as it was before this message for the members that do not have it yet.
+func (e *E2E) SealGroup(chatID string, packet *pb.DataPacket) (*pb.GroupSealed, *pb.SenderKey, []string, error) {
+	plaintext, err := proto.Marshal(packet)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ownID := e.state.Node.Host.ID().String()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store := e.state.Store
+	key, err := store.LoadOwnSenderKey(chatID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// keys from before packets were signed are replaced
+	if key == nil || key.SigningKey == nil {
+		key = &OwnSenderKey{KeyID: make([]byte, 16), ChainKey: make([]byte, 32), Delivered: make(map[string]bool)}
+		if _, err := rand.Read(key.KeyID); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, err := rand.Read(key.ChainKey); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, key.SigningKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	dist := &pb.SenderKey{ChatId: chatID, KeyId: key.KeyID, ChainKey: key.ChainKey, Iteration: key.Iteration,
+		SigningKey: key.SigningKey.Public().(ed25519.PublicKey)}
+	var undelivered []string
+	for _, p := range e.state.chatMembers(chatID) {
+		if p != ownID && !key.Delivered[p] {
+			undelivered = append(undelivered, p)
+		}
+	}
+
+	var mk []byte
+	iteration := key.Iteration
+	key.ChainKey, mk = kdfCK(key.ChainKey)
+	key.Iteration++
+	ct, err := seal(mk, plaintext, groupAD(chatID, ownID, key.KeyID, iteration))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := store.SaveOwnSenderKey(chatID, key); err != nil {
+		return nil, nil, nil, err
+	}
+	sealed := &pb.GroupSealed{ChatId: chatID, SenderId: ownID, KeyId: key.KeyID, Iteration: iteration, Ciphertext: ct}
+	sealed.Signature = ed25519.Sign(key.SigningKey, groupSignedData(sealed))
+	return sealed, dist, undelivered, nil
+}
+
+// markSenderKeyDelivered records that the peer got the key, unless it was rotated meanwhile.
+func (e *E2E) markSenderKeyDelivered(chatID string, keyID []byte, peerID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key, err := e.state.Store.LoadOwnSenderKey(chatID)
+	if err != nil || key == nil || !bytes.Equal(key.KeyID, keyID) {
+		return err
+	}
+	key.Delivered[peerID] = true
+	return e.state.Store.SaveOwnSenderKey(chatID, key)
+}
+
+// RotateSenderKey drops our sender key so the next message starts a new one
+// that only the members at that time receive.
+func (e *E2E) RotateSenderKey(chatID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state.Store.DeleteOwnSenderKey(chatID)
+}
+
+func (e *E2E) ReceiveSenderKey(peerID string, sk *pb.SenderKey) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(sk.SigningKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("sender key %x of %s has no signing key", sk.KeyId, peerID)
+	}
+	store := e.state.Store
+	keys, err := store.LoadPeerSenderKeys(sk.ChatId, peerID)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(sk.KeyId)
+	if _, ok := keys.Keys[id]; ok {
+		return nil
+	}
+	keys.Keys[id] = &PeerSenderKey{ChainKey: sk.ChainKey, Iteration: sk.Iteration, SigningKey: sk.SigningKey}
+	keys.Order = append(keys.Order, id)
+	for len(keys.Order) > maxSenderKeysPerPeer {
+		delete(keys.Keys, keys.Order[0])
+		keys.Order = keys.Order[1:]
+	}
+	return store.SavePeerSenderKeys(sk.ChatId, peerID, keys)
+}
+
+func (e *E2E) OpenGroup(gs *pb.GroupSealed) (*pb.DataPacket, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store := e.state.Store
+	keys, err := store.LoadPeerSenderKeys(gs.ChatId, gs.SenderId)
+	if err != nil {
+		return nil, err
+	}
+	key := keys.Keys[hex.EncodeToString(gs.KeyId)]
+	if key == nil {
+		return nil, fmt.Errorf("no sender key %x of %s", gs.KeyId, gs.SenderId)
+	}
+	// any member could encrypt under the key, only the sender signs; a
+	// forged packet must not use up the message key of the real one
+	if len(key.SigningKey) != ed25519.PublicKeySize || !ed25519.Verify(key.SigningKey, groupSignedData(gs), gs.Signature) {
+		return nil, fmt.Errorf("group packet %d of %s has a bad signature", gs.Iteration, gs.SenderId)
+	}
+
+	next := PeerSenderKey{ChainKey: key.ChainKey, Iteration: key.Iteration, Skipped: maps.Clone(key.Skipped)}
+	var mk []byte
+	switch {
+	case gs.Iteration < next.Iteration:
+		mk = next.Skipped[gs.Iteration]
+		if mk == nil {
+			return nil, fmt.Errorf("message key %d of %s already used", gs.Iteration, gs.SenderId)
+		}
+		delete(next.Skipped, gs.Iteration)
+	case gs.Iteration > next.Iteration+maxSkip:
+		return nil, fmt.Errorf("group message %d is too far ahead of %d", gs.Iteration, next.Iteration)
+	default:
+		if next.Skipped == nil {
+			next.Skipped = make(map[uint32][]byte)
+		}
+		for next.Iteration < gs.Iteration {
+			next.ChainKey, mk = kdfCK(next.ChainKey)
+			next.Skipped[next.Iteration] = mk
+			next.Iteration++
+		}
+		next.ChainKey, mk = kdfCK(next.ChainKey)
+		next.Iteration++
+		for len(next.Skipped) > maxSkippedKeys {
+			delete(next.Skipped, slices.Min(slices.Collect(maps.Keys(next.Skipped))))
+		}
+	}
+	plaintext, err := open(mk, gs.Ciphertext, groupAD(gs.ChatId, gs.SenderId, gs.KeyId, gs.Iteration))
+	if err != nil {
+		return nil, err
+	}
+	*key = next
+	if err := store.SavePeerSenderKeys(gs.ChatId, gs.SenderId, keys); err != nil {
+		return nil, err
+	}
+
+	var packet pb.DataPacket
+	if err := proto.Unmarshal(plaintext, &packet); err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// sendGroup encrypts the packet once for the whole group. Members our key
+// could not be handed to get the packet pairwise, through the outbox if need be.
+func (s *State) sendGroup(chatID string, packet *pb.DataPacket) error {
+	sealed, dist, undelivered, err := s.E2E.SealGroup(chatID, packet)
+	if err != nil {
+		return err
+	}
+	failed := make(map[string]bool)
+	for _, peerID := range undelivered {
+		err := s.sendSealed(peerID, &pb.DataPacket{Msg: &pb.DataPacket_SenderKey{SenderKey: dist}})
+		if err != nil {
+			failed[peerID] = true
+			continue
+		}
+		if err := s.E2E.markSenderKeyDelivered(chatID, dist.KeyId, peerID); err != nil {
+			fmt.Printf("error recording sender key delivery: %v\n", err)
+		}
+	}
+
+	ownID := s.Node.Host.ID().String()
+	out := &pb.DataPacket{Msg: &pb.DataPacket_GroupSealed{GroupSealed: sealed}}
+	for _, peerID := range s.chatMembers(chatID) {
+		if peerID == ownID {
+			continue
+		}
+		if !failed[peerID] && s.sendToPeer(peerID, out) == nil {
+			continue
+		}
+		if err := s.deliver(peerID, packet); err != nil {
+			fmt.Printf("group packet not delivered to %s: %v\n", peerID, err)
+		}
+	}
+	return nil
+}
+
+func (s *State) receiveGroupSealed(peerID string, gs *pb.GroupSealed) {
+	if !slices.Contains(s.chatMembers(gs.ChatId), gs.SenderId) {
+		fmt.Printf("group packet of non-member %s in chat %s dropped\n", gs.SenderId, gs.ChatId)
+		return
+	}
+	packet, err := s.E2E.OpenGroup(gs)
+	if err != nil {
+		fmt.Printf("error decrypting group packet from %s: %v\n", gs.SenderId, err)
+		return
+	}
+	switch inner := packet.Msg.(type) {
+	case *pb.DataPacket_Static:
+		if inner.Static.ChatId != gs.ChatId {
+			fmt.Printf("group packet of chat %s carried chat %s\n", gs.ChatId, inner.Static.ChatId)
+			return
+		}
+		if err := s.ReceiveMessage(peerID, inner.Static); err != nil {
+			fmt.Printf("error receiving message from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_MessageEdit:
+		if inner.MessageEdit.ChatId != gs.ChatId {
+			fmt.Printf("group packet of chat %s carried chat %s\n", gs.ChatId, inner.MessageEdit.ChatId)
+			return
+		}
+		if err := s.receiveMessageEdit(peerID, inner.MessageEdit); err != nil {
+			fmt.Printf("error receiving edit from %s: %v\n", peerID, err)
+		}
+	case *pb.DataPacket_Reaction:
+		if inner.Reaction.ChatId != gs.ChatId {
+			fmt.Printf("group packet of chat %s carried chat %s\n", gs.ChatId, inner.Reaction.ChatId)
+			return
+		}
+		if err := s.receiveReaction(peerID, inner.Reaction); err != nil {
+			fmt.Printf("error receiving reaction from %s: %v\n", peerID, err)
+		}
+	default:
+		fmt.Printf("unexpected group packet %T from %s\n", inner, gs.SenderId)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	"io"
@@ -13,7 +14,6 @@ import (
 	"fyne.io/fyne/v2"
 	"github.com/google/uuid"
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-msgio/pbio"
 	"github.com/pion/mediadevices/pkg/io/audio"
@@ -23,6 +23,8 @@ import (
 
 const myProtocolID protocol.ID = "/mobila/1.0.0"
 
+var errNoStream = errors.New("no open stream")
+
 var blackImg image.Image = image.NewRGBA(image.Rect(0, 0, 1, 1))
 
 type Libp2pStreamReader struct {
@@ -33,6 +35,14 @@ type Libp2pStreamReader struct {
 type Libp2pStreamWriter struct {
 	mu     sync.Mutex
 	stream pbio.Writer
+	// done is closed when the reader side of the stream exits
+	done chan struct{}
+}
+
+func (w *Libp2pStreamWriter) WriteMsg(msg *pb.DataPacket) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stream.WriteMsg(msg)
 }
 
 type State struct {
@@ -54,20 +64,56 @@ type State struct {
 	SequenceNumber    uint64
 	StreamActive      bool
 	PeerStreamWriters map[string]*Libp2pStreamWriter
-	IncomingStreams   map[string]chan struct{}
+	IncomingStreams   map[string]*RemoteStream
 	OutgoingStreams   map[string]struct{}
+	Mixer             *AudioMixer
+	audioSink         AudioSink
+
+	Call   *Call
+	callMu sync.Mutex
+	// OnCallChanged is called on the UI thread on every call state transition.
+	OnCallChanged func(call Call)
+
+	Syncer   *Syncer
+	E2E      *E2E
+	outboxMu sync.Mutex
+	// indices of the chunks still expected per blob being fetched, by hex hash
+	downloads map[string]map[int]bool
+	blobMu    sync.Mutex
+
+	ctx         context.Context
+	supervisors map[string]context.CancelFunc
+
+	// OnMessagesChanged is called on the UI thread after the selected chat got new messages.
+	OnMessagesChanged func(chatID string)
+	// OnMessagesUpdated is called on the UI thread after messages of the selected
+	// chat changed in place: receipts, edits or deletes.
+	OnMessagesUpdated func(chatID string)
+	// OnBlobChanged is called on the UI thread while a blob is fetched and once it is complete.
+	OnBlobChanged func(hash []byte)
+	// OnChatsChanged is called on the UI thread after the chat list was reloaded.
+	OnChatsChanged func()
 
 	mu sync.RWMutex
 }
 
 func NewState() *State {
 	return &State{
-		Contacts: make(map[string]Contact),
+		Contacts:          make(map[string]Contact),
+		PeerStreamWriters: make(map[string]*Libp2pStreamWriter),
+		IncomingStreams:   make(map[string]*RemoteStream),
+		Mixer:             NewAudioMixer(),
+		OutgoingStreams:   make(map[string]struct{}),
+		supervisors:       make(map[string]context.CancelFunc),
+		downloads:         make(map[string]map[int]bool),
 	}
 }
 func (s *State) Shutdown() {
 	s.mu.Lock()
 	{
+		for _, cancel := range s.supervisors {
+			cancel()
+		}
 		if s.Node != nil {
 			s.Node.Shutdown()
 		}
@@ -91,123 +137,35 @@ func (s *State) ReloadContactsAndChats() (err error) {
 		}
 	}
 	s.mu.Unlock()
-	findList := []string{}
-	s.mu.RLock()
-	{
-		for peerID := range s.Contacts {
-			if _, exist := s.PeerStreamWriters[peerID]; !exist {
-				findList = append(findList, peerID)
-			}
-		}
-	}
-	s.mu.RUnlock()
-	for _, peerIDstr := range findList {
-		go func() {
-			peerID, err := peer.Decode(peerIDstr)
-			if err != nil {
-				fmt.Printf("error trying to decode peer.ID from string %s\n", peerID)
-				return
-			}
-			for {
-				if s.Node.DHT.RoutingTable().Size() > 0 {
-					break
-				}
-				time.Sleep(1 * time.Second) // Короткая пауза, чтобы не нагружать CPU
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-			defer cancel()
-			peerInfo, err := s.Node.DHT.FindPeer(ctx, peerID)
-			if err != nil {
-				if err == context.DeadlineExceeded {
-					fmt.Println("Поиск прекращен: превышено время ожидания (1 минута).")
-				} else {
-					fmt.Printf("Ошибка при поиске пира: %v\n", err)
-				}
-				return
-			}
-			fmt.Printf("Пир найден! Адреса: %v\n", peerInfo.Addrs)
-		}()
-	}
+	s.superviseContacts()
 	return err
 }
 
-func (s *State) Init() (err error) {
+func (s *State) Init(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.ctx = ctx
+	s.Syncer = NewSyncer(s)
+	s.E2E, err = NewE2E(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go s.Syncer.Run()
+	go s.runBlobGC()
+	if !s.Store.SearchIndexBuilt() {
+		go s.RebuildSearchIndex()
+	}
+	if mailboxEnabled() {
+		fmt.Println("holding envelopes for offline contacts")
+		go s.runMailbox()
+	}
 	s.ReloadContactsAndChats()
 	s.mu.Lock()
 	{
 		s.VideoOn = true
-		s.Node.Host.SetStreamHandler(myProtocolID,
-			func(stream network.Stream) {
-				peerID := stream.Conn().RemotePeer().String()
-				s.mu.Lock()
-				{
-					s.PeerStreamWriters[peerID] = &Libp2pStreamWriter{stream: pbio.NewDelimitedWriter(stream)}
-				}
-				s.mu.Unlock()
-				reader := pbio.NewDelimitedReader(stream, 20*1024)
-				defer stream.Close()
-				for {
-					var pbMsg pb.DataPacket
-					if err := reader.ReadMsg(&pbMsg); err != nil {
-						s.mu.Lock()
-						{
-							stream.Reset()
-							delete(s.PeerStreamWriters, peerID)
-						}
-						s.mu.Unlock()
-						return
-					}
-					switch datapacket := pbMsg.Msg.(type) {
-					case *pb.DataPacket_Ping:
-						s.mu.RLock()
-						{
-							if safestream, ok := s.PeerStreamWriters[peerID]; ok {
-								safestream.mu.Lock()
-								safestream.stream.WriteMsg(&pb.DataPacket{Msg: &pb.DataPacket_Pong{Pong: &pb.Pong{}}})
-								safestream.mu.Unlock()
-							}
-						}
-						s.mu.RUnlock()
-					case *pb.DataPacket_Pong:
-						// do nothing
-					case *pb.DataPacket_ResendStatic:
-						rs := datapacket.ResendStatic
-						s.mu.RLock()
-						{
-							for c := range s.Chats {
-								if s.Chats[c].ID == rs.ChatId && slices.Contains(s.Chats[c].Peers, peerID) {
-									msg := s.Chats[c].GetMessage(rs.MessageId)
-									if msg != nil {
-										if safestream, ok := s.PeerStreamWriters[peerID]; ok {
-											safestream.mu.Lock()
-											safestream.stream.WriteMsg(&pb.DataPacket{Msg: &pb.DataPacket_Static{
-												Static: &pb.Static{
-													ChatId:        rs.ChatId,
-													MessageId:     msg.ID,
-													PrevMessageId: msg.Prev,
-													Data:          []byte(msg.Text),
-													AuthorId:      msg.Author,
-													MimeType:      "text/plain",
-												},
-											}})
-											safestream.mu.Unlock()
-										}
-									}
-									break
-								}
-							}
-						}
-						s.mu.RUnlock()
-					case *pb.DataPacket_Static:
-					case *pb.DataPacket_StreamChunk:
-					case *pb.DataPacket_StreamInfo:
-					case *pb.DataPacket_StreamInfoResponse:
-					default:
-						panic(fmt.Sprintf("unexpected pb.isDataPacket_Msg: %#v", datapacket))
-					}
-				}
-
-			})
+		s.Node.Host.SetStreamHandler(myProtocolID, func(stream network.Stream) {
+			s.serveStream(stream, s.registerStream(stream))
+		})
 	}
 	s.mu.Unlock()
 
@@ -246,15 +204,117 @@ func (s *State) Init() (err error) {
 	return
 }
 
+// registerStream makes the stream the current writer for its remote peer.
+func (s *State) registerStream(stream network.Stream) *Libp2pStreamWriter {
+	peerID := stream.Conn().RemotePeer().String()
+	writer := &Libp2pStreamWriter{stream: pbio.NewDelimitedWriter(stream), done: make(chan struct{})}
+	s.mu.Lock()
+	{
+		s.PeerStreamWriters[peerID] = writer
+	}
+	s.mu.Unlock()
+	go func() {
+		// the bundle goes first so the peer can seal anything it sends back
+		s.sendBundle(peerID)
+		s.flushOutbox(peerID)
+		s.SendMembershipLogs(peerID)
+		s.Syncer.SendHeads(peerID)
+		s.resumeDownloads(peerID)
+		if mailboxEnabled() {
+			s.pushMailbox(peerID)
+		}
+	}()
+	return writer
+}
+
+// serveStream reads packets until the stream breaks, then closes writer.done.
+func (s *State) serveStream(stream network.Stream, writer *Libp2pStreamWriter) {
+	peerID := stream.Conn().RemotePeer().String()
+	reader := pbio.NewDelimitedReader(stream, 20*1024)
+	defer stream.Close()
+	for {
+		var pbMsg pb.DataPacket
+		if err := reader.ReadMsg(&pbMsg); err != nil {
+			s.mu.Lock()
+			{
+				stream.Reset()
+				if s.PeerStreamWriters[peerID] == writer {
+					delete(s.PeerStreamWriters, peerID)
+				}
+			}
+			s.mu.Unlock()
+			close(writer.done)
+			return
+		}
+		switch datapacket := pbMsg.Msg.(type) {
+		case *pb.DataPacket_Ping:
+			s.mu.RLock()
+			{
+				if safestream, ok := s.PeerStreamWriters[peerID]; ok {
+					safestream.mu.Lock()
+					safestream.stream.WriteMsg(&pb.DataPacket{Msg: &pb.DataPacket_Pong{Pong: &pb.Pong{}}})
+					safestream.mu.Unlock()
+				}
+			}
+			s.mu.RUnlock()
+		case *pb.DataPacket_Pong:
+			// do nothing
+		case *pb.DataPacket_ResendStatic:
+			s.Syncer.Resend(peerID, datapacket.ResendStatic)
+		case *pb.DataPacket_ChatHeads:
+			s.Syncer.ReceiveHeads(peerID, datapacket.ChatHeads)
+		case *pb.DataPacket_Static:
+			fmt.Printf("unencrypted message from %s dropped\n", peerID)
+		case *pb.DataPacket_PrekeyBundle:
+			if err := s.E2E.ReceiveBundle(peerID, datapacket.PrekeyBundle); err != nil {
+				fmt.Printf("error receiving prekey bundle from %s: %v\n", peerID, err)
+			} else {
+				// whatever waited for the bundle can be sealed now
+				go s.flushOutbox(peerID)
+			}
+		case *pb.DataPacket_Sealed:
+			s.receiveSealed(peerID, datapacket.Sealed)
+		case *pb.DataPacket_GroupSealed:
+			s.receiveGroupSealed(peerID, datapacket.GroupSealed)
+		case *pb.DataPacket_MailboxDeposit:
+			if err := s.receiveDeposit(peerID, datapacket.MailboxDeposit); err != nil {
+				fmt.Printf("deposit from %s refused: %v\n", peerID, err)
+			}
+		case *pb.DataPacket_MailboxDelivery:
+			s.receiveDelivery(peerID, datapacket.MailboxDelivery)
+		case *pb.DataPacket_MailboxAck:
+			s.receiveMailboxAck(peerID, datapacket.MailboxAck)
+		case *pb.DataPacket_MailboxAccepted:
+			s.receiveMailboxAccepted(peerID, datapacket.MailboxAccepted)
+		case *pb.DataPacket_StreamChunk:
+			s.receiveChunk(peerID, datapacket.StreamChunk)
+		case *pb.DataPacket_StreamInfo:
+			s.receiveStreamInfo(peerID, datapacket.StreamInfo)
+		case *pb.DataPacket_StreamInfoResponse:
+			s.receiveStreamResponse(peerID, datapacket.StreamInfoResponse)
+		case *pb.DataPacket_CallSignal:
+			s.receiveCallSignal(peerID, datapacket.CallSignal)
+		default:
+			fmt.Printf("unexpected packet %T from %s\n", datapacket, peerID)
+		}
+	}
+}
+
 func (s *State) AddContact(c Contact) {
 	exist := false
-	s.mu.RLock()
+	s.mu.Lock()
 	{
-		if _, exist = s.Contacts[c.ID]; exist {
+		var old Contact
+		if old, exist = s.Contacts[c.ID]; exist {
 			fmt.Printf("contact already exists: %s\n", c.Alias)
+			if old.Mailbox != c.Mailbox {
+				old.Mailbox = c.Mailbox
+				s.Contacts[c.ID] = old
+				s.Store.AddContact(old)
+			}
 		}
 	}
-	s.mu.RUnlock()
+	s.mu.Unlock()
 	if exist {
 		return
 	}
@@ -268,11 +328,198 @@ func (s *State) AddContact(c Contact) {
 		}
 		s.Contacts[c.ID] = c
 		s.Store.AddContact(c)
-		s.Store.CreateNewChat(Chat{ID: uuid.NewString(), Name: c.Alias, Peers: []string{c.ID, s.Node.Host.ID().String()}})
+		ownID := s.Node.Host.ID().String()
+		s.Store.CreateNewChat(Chat{ID: DirectChatID(c.ID, ownID), Name: c.Alias, Peers: []string{c.ID, ownID}})
 	}
 	s.mu.Unlock()
 }
 
+func (s *State) findChat(chatID string) *Chat {
+	for i := range s.Chats {
+		if s.Chats[i].ID == chatID {
+			return &s.Chats[i]
+		}
+	}
+	return nil
+}
+
+// sendToPeer must not be called with s.mu held.
+func (s *State) sendToPeer(peerID string, packet *pb.DataPacket) error {
+	s.mu.RLock()
+	safeStream, ok := s.PeerStreamWriters[peerID]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w to %s", errNoStream, peerID)
+	}
+	return safeStream.WriteMsg(packet)
+}
+
+func (s *State) SendMessage(chatID string, text string) error {
+	return s.postMessage(Message{ChatID: chatID, Text: text})
+}
+
+func (s *State) SendReply(chatID, replyTo, text string) error {
+	return s.postMessage(Message{ChatID: chatID, Text: text, ReplyTo: replyTo})
+}
+
+// postMessage fills in the ID, author, time and parents of msg, signs it and
+// sends it to the members of its chat.
+func (s *State) postMessage(msg Message) error {
+	chatID := msg.ChatID
+	ownID := s.Node.Host.ID().String()
+	if !slices.Contains(s.chatMembers(chatID), ownID) {
+		return fmt.Errorf("not a member of chat %s", chatID)
+	}
+
+	msg.ID = uuid.NewString()
+	msg.Author = ownID
+	msg.Sent = time.Now()
+	heads, err := s.Store.GetChatHeads(chatID)
+	if err != nil {
+		return err
+	}
+	for i, head := range heads {
+		if i == 0 {
+			msg.Prev = head.ID
+		} else {
+			msg.Merges = append(msg.Merges, head.ID)
+		}
+	}
+	st := msg.ToStatic()
+	if err := SignStatic(st, s.Node.Host.Peerstore().PrivKey(s.Node.Host.ID())); err != nil {
+		return err
+	}
+	msg.Signature = st.Signature
+	if err := s.Store.AddMessage(msg); err != nil {
+		return err
+	}
+	s.messageArrived(msg)
+	return s.sendToChat(chatID, &pb.DataPacket{Msg: &pb.DataPacket_Static{Static: st}})
+}
+
+// sendToChat hands the packet to every other member of the chat, once
+// encrypted for the whole group or sealed for each peer of a direct chat.
+func (s *State) sendToChat(chatID string, packet *pb.DataPacket) error {
+	ownID := s.Node.Host.ID().String()
+	s.mu.RLock()
+	var peers []string
+	chat := s.findChat(chatID)
+	group := false
+	if chat != nil {
+		peers = append(peers, chat.Peers...)
+		group = chat.Group
+	}
+	s.mu.RUnlock()
+	if chat == nil {
+		return fmt.Errorf("unknown chat %s", chatID)
+	}
+	if group {
+		return s.sendGroup(chatID, packet)
+	}
+	for _, peerID := range peers {
+		if peerID == ownID {
+			continue
+		}
+		if err := s.deliver(peerID, packet); err != nil {
+			fmt.Printf("packet for chat %s not delivered to %s: %v\n", chatID, peerID, err)
+		}
+	}
+	return nil
+}
+
+func (s *State) ReceiveMessage(peerID string, st *pb.Static) error {
+	ownID := s.Node.Host.ID().String()
+
+	s.mu.RLock()
+	chat := s.findChat(st.ChatId)
+	var peers []string
+	if chat != nil {
+		peers = chat.Peers
+	}
+	_, isContact := s.Contacts[peerID]
+	s.mu.RUnlock()
+
+	if chat == nil {
+		// the other side of a direct chat may write before we opened it ourselves
+		if !isContact || st.ChatId != DirectChatID(peerID, ownID) {
+			return fmt.Errorf("unknown chat %s", st.ChatId)
+		}
+		peers = []string{peerID, ownID}
+		s.mu.RLock()
+		alias := s.Contacts[peerID].Alias
+		s.mu.RUnlock()
+		if err := s.Store.CreateNewChat(Chat{ID: st.ChatId, Name: alias, Peers: peers}); err != nil {
+			return err
+		}
+		s.ReloadContactsAndChats()
+		fyne.Do(func() {
+			if s.OnChatsChanged != nil {
+				s.OnChatsChanged()
+			}
+		})
+	}
+	if !slices.Contains(peers, peerID) {
+		return fmt.Errorf("%s is not a member of chat %s", peerID, st.ChatId)
+	}
+	if !slices.Contains(peers, st.AuthorId) {
+		return fmt.Errorf("author %s is not a member of chat %s", st.AuthorId, st.ChatId)
+	}
+
+	msg, err := MessageFromStatic(st)
+	if err != nil {
+		return err
+	}
+	if err := VerifyStatic(st); err != nil {
+		fmt.Printf("unverified message from %s: %v\n", peerID, err)
+		msg.Unverified = true
+	}
+	// deleted before it reached us, by its author or else by nobody
+	if tomb, err := s.Store.GetTombstone(msg.ChatID, msg.ID); err == nil && tomb != nil {
+		if tomb.Author == msg.Author {
+			msg = msg.tombstone()
+		} else if !msg.Unverified {
+			fmt.Printf("delete of %s by %s dropped, %s wrote it\n", msg.ID, tomb.Author, msg.Author)
+			if err := s.Store.DeleteTombstone(msg.ChatID, msg.ID); err != nil {
+				return err
+			}
+		}
+	}
+	// a forged copy must not keep the genuine message out
+	if old, err := s.Store.GetMessage(msg.ChatID, msg.ID); err == nil && old != nil && (msg.Unverified || !old.Unverified) {
+		return nil
+	}
+	if err := s.Store.AddMessage(msg); err != nil {
+		return err
+	}
+	s.messageArrived(msg)
+	s.Syncer.Arrived(msg, peerID)
+	if !msg.Unverified && msg.Author != ownID {
+		go s.sendReceipt(msg.Author, pb.Receipt_DELIVERED, msg.ChatID, []string{msg.ID})
+	}
+	if msg.Attachment != nil && !msg.Unverified {
+		go s.fetchAttachment(msg, peerID)
+	}
+	return nil
+}
+
+func (s *State) messageArrived(msg Message) {
+	fyne.Do(func() {
+		s.mu.Lock()
+		selected := s.SelectedChat != nil && s.SelectedChat.ID == msg.ChatID
+		if selected && msg.Author == s.Node.Host.ID().String() && s.SelectedChat.HasNewer {
+			// what we send shows at the end of the history
+			s.Store.LoadLatest(s.SelectedChat)
+		} else if selected {
+			selected = s.SelectedChat.InsertMessage(msg)
+			s.SelectedChat.DropOldest()
+		}
+		s.mu.Unlock()
+		if selected && s.OnMessagesChanged != nil {
+			s.OnMessagesChanged(msg.ChatID)
+		}
+	})
+}
+
 func (s *State) JoinVideoChat() fyne.CanvasObject {
 	fmt.Println("jvc")
 	var videoPad fyne.CanvasObject
@@ -290,6 +537,18 @@ func (s *State) JoinVideoChat() fyne.CanvasObject {
 				} else {
 					vw.label.SetText(peerID)
 				}
+				if peerID != s.Node.Host.ID().String() {
+					vw.EnableVolume(func(volume float64) {
+						s.Mixer.SetVolume(peerID, float32(volume))
+					})
+				}
+			}
+			if s.audioSink == nil {
+				s.audioSink = NewAudioSink()
+				if err := s.audioSink.Start(s.Mixer); err != nil {
+					fmt.Printf("error starting audio playback: %v\n", err)
+					s.audioSink = nil
+				}
 			}
 		}
 		s.mu.Unlock()
@@ -335,8 +594,15 @@ func (s *State) StartStream(preview *VideoWidget) {
 
 		{
 			packetProducer, pw := io.Pipe()
+			s.mu.Lock()
+			s.InitChunk = nil
+			s.SequenceNumber = 0
+			s.mu.Unlock()
 			go func() {
-				buf := make([]byte, 1024*50)
+				// chunks must stay below the 20 KiB limit of the receiving pbio reader
+				buf := make([]byte, 1024*16)
+				// peers that already got the init chunk
+				primed := make(map[string]bool)
 				for {
 					n, err := packetProducer.Read(buf)
 					thisIsInit := false
@@ -349,22 +615,30 @@ func (s *State) StartStream(preview *VideoWidget) {
 						if s.InitChunk == nil {
 							thisIsInit = true
 							s.InitChunk = append(s.InitChunk, buf[:n]...)
+						} else {
+							s.SequenceNumber++
 						}
 					}
 					s.mu.Unlock()
 					s.mu.RLock()
 					{
+						for peerID := range primed {
+							if _, ok := s.OutgoingStreams[peerID]; !ok {
+								delete(primed, peerID)
+							}
+						}
 						for peerID := range s.OutgoingStreams {
 							if safeStream, ok := s.PeerStreamWriters[peerID]; ok {
-								safeStream.mu.Lock()
-								{
-									err := safeStream.stream.WriteMsg(&pb.DataPacket{
+								if !primed[peerID] && !thisIsInit {
+									err := safeStream.WriteMsg(&pb.DataPacket{
 										Msg: &pb.DataPacket_StreamChunk{
 											StreamChunk: &pb.StreamChunk{
-												IsInit:    thisIsInit,
-												ChatId:    s.SelectedChat.ID,
-												SeqNumber: uint32(s.SequenceNumber),
-												Data:      buf[:n],
+												IsInit: true,
+												ChatId: s.SelectedChat.ID,
+												// the receiver expects the chunk after it next,
+												// which is the one sent right below
+												SeqNumber: uint32(s.SequenceNumber - 1),
+												Data:      s.InitChunk,
 											},
 										},
 									})
@@ -372,7 +646,20 @@ func (s *State) StartStream(preview *VideoWidget) {
 										fmt.Printf("error marshalling or sending STREAM CHUNK [%v]\n", err)
 									}
 								}
-								safeStream.mu.Unlock()
+								primed[peerID] = true
+								err := safeStream.WriteMsg(&pb.DataPacket{
+									Msg: &pb.DataPacket_StreamChunk{
+										StreamChunk: &pb.StreamChunk{
+											IsInit:    thisIsInit,
+											ChatId:    s.SelectedChat.ID,
+											SeqNumber: uint32(s.SequenceNumber),
+											Data:      buf[:n],
+										},
+									},
+								})
+								if err != nil {
+									fmt.Printf("error marshalling or sending STREAM CHUNK [%v]\n", err)
+								}
 							}
 						}
 					}
@@ -522,9 +809,38 @@ func (s *State) StartStream(preview *VideoWidget) {
 	}
 }
 
+// receiveChunk routes a chunk to the decoder of the peer's tile in the running call.
+func (s *State) receiveChunk(peerID string, chunk *pb.StreamChunk) {
+	s.mu.Lock()
+	if s.SelectedChat == nil || s.SelectedChat.ID != chunk.ChatId {
+		s.mu.Unlock()
+		return
+	}
+	vw, inCall := s.Videos[peerID]
+	rs, ok := s.IncomingStreams[peerID]
+	if inCall && !ok {
+		rs = NewRemoteStream(peerID, func(img image.Image) {
+			fyne.Do(func() {
+				vw.UpdateFrame(img)
+			})
+		}, func(pcm []int16) {
+			s.Mixer.Push(peerID, pcm)
+		})
+		s.IncomingStreams[peerID] = rs
+	}
+	s.mu.Unlock()
+	if inCall {
+		rs.Push(chunk)
+	}
+}
+
 func (s *State) LeaveVideoChat() {
 	s.mu.RLock()
-	sc, peers := s.SelectedChat, s.SelectedChat.Peers
+	sc := s.SelectedChat
+	var peers []string
+	if sc != nil {
+		peers = sc.Peers
+	}
 	s.mu.RUnlock()
 	if sc != nil {
 		s.EndOwnStream()
@@ -534,6 +850,12 @@ func (s *State) LeaveVideoChat() {
 			}
 		}
 	}
+	s.mu.Lock()
+	if s.audioSink != nil {
+		s.audioSink.Close()
+		s.audioSink = nil
+	}
+	s.mu.Unlock()
 }
 
 func (s *State) LeaveStream(peerID string) {
@@ -561,8 +883,11 @@ func (s *State) LeaveStream(peerID string) {
 	// sendMessageToPeer(peerID, LEAVE)
 	s.mu.Lock()
 	{
-		close(s.IncomingStreams[peerID])
-		delete(s.IncomingStreams, peerID)
+		if rs, ok := s.IncomingStreams[peerID]; ok {
+			rs.Close()
+			delete(s.IncomingStreams, peerID)
+		}
+		s.Mixer.Remove(peerID)
 	}
 	s.mu.Unlock()
 }
@@ -596,14 +921,14 @@ func (s *State) EndOwnStream() {
 					}
 					safeStream.mu.Unlock()
 				}
-				s.mu.Lock()
-				{
-					delete(s.OutgoingStreams, peerID)
-				}
-				s.mu.Unlock()
 				// sendMessageToPeer(peerID, STOP)
 			}
 		}
 	}
 	s.mu.RUnlock()
+	s.mu.Lock()
+	{
+		clear(s.OutgoingStreams)
+	}
+	s.mu.Unlock()
 }
@@ -2,22 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"golang.org/x/crypto/argon2"
 )
 
 type Store struct {
-	DB   *badger.DB
-	Salt []byte
+	DB     *badger.DB
+	Salt   []byte
+	Path   string
+	Header *StoreHeader
+
+	// held exclusively while DB is swapped for a re-encrypted copy
+	mu sync.RWMutex
+	// keeps PutBlob from writing chunks CollectBlobs is deleting
+	blobMu sync.Mutex
 }
 
 var appName = "mobila"
@@ -36,32 +45,78 @@ func NewStore(password string) (*Store, error) {
 		}
 	}
 
-	fmt.Printf("storage at %s \n", fullPath+"/store")
-	opts := badger.DefaultOptions(fullPath + "/store")
-	salt := []byte("constant_salt_for_app")
-
-	if password != "" {
+	dbPath := filepath.Join(fullPath, "store")
+	headerPath := dbPath + ".header"
+	fmt.Printf("storage at %s \n", dbPath)
+	if err := recoverPasswordChange(dbPath); err != nil {
+		return nil, err
+	}
 
-		key := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
-		opts.EncryptionKey = key
-		opts.IndexCacheSize = 100 << 20
+	header, err := readStoreHeader(headerPath)
+	if os.IsNotExist(err) {
+		if storeExists(dbPath) {
+			header, err = migrateLegacyStore(dbPath, headerPath, password)
+		} else {
+			header, err = NewStoreHeader(password != "")
+			if err == nil {
+				err = writeStoreHeader(headerPath, header)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header.Encrypted != (password != "") {
+		return nil, ErrWrongPassword
 	}
 
-	db, err := badger.Open(opts)
+	db, err := openBadger(dbPath, header, password)
 	if err != nil {
 		return nil, err
 	}
-	return &Store{DB: db, Salt: salt}, nil
+	s := &Store{DB: db, Salt: header.Salt, Path: dbPath, Header: header}
+	if err := s.migrate(password); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func openBadger(dbPath string, header *StoreHeader, password string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(dbPath)
+	if header.Encrypted {
+		opts.EncryptionKey = header.DeriveKey(password)
+		opts.IndexCacheSize = 100 << 20
+	}
+	db, err := badger.Open(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return nil, ErrWrongPassword
+	}
+	return db, err
 }
 
 func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.DB.Close()
 }
 
+func (s *Store) view(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.DB.View(fn)
+}
+
+func (s *Store) update(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.DB.Update(fn)
+}
+
 func (s *Store) SaveBootstrapPeer(info peer.AddrInfo) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		key := []byte("boot:" + info.ID.String())
-		val, err := json.Marshal(info)
+		val, err := marshalAddrInfo(info)
 		if err != nil {
 			return err
 		}
@@ -71,15 +126,15 @@ func (s *Store) SaveBootstrapPeer(info peer.AddrInfo) error {
 
 func (s *Store) LoadBootstrapPeers() ([]peer.AddrInfo, error) {
 	var peers []peer.AddrInfo
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
 		prefix := []byte("boot:")
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			err := it.Item().Value(func(v []byte) error {
-				var info peer.AddrInfo
-				if err := json.Unmarshal(v, &info); err != nil {
+				info, err := unmarshalAddrInfo(v)
+				if err != nil {
 					return err
 				}
 				peers = append(peers, info)
@@ -97,7 +152,7 @@ func (s *Store) LoadBootstrapPeers() ([]peer.AddrInfo, error) {
 const nodeKeyPath = "system:node_key"
 
 func (s *Store) SavePrivateKey(priv crypto.PrivKey) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		data, err := crypto.MarshalPrivateKey(priv)
 		if err != nil {
 			return err
@@ -108,7 +163,7 @@ func (s *Store) SavePrivateKey(priv crypto.PrivKey) error {
 
 func (s *Store) LoadPrivateKey() (crypto.PrivKey, error) {
 	var priv crypto.PrivKey
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(nodeKeyPath))
 		if err != nil {
 			return err
@@ -127,12 +182,14 @@ type Contact struct {
 	Alias     string   `json:"alias"`
 	Addresses []string `json:"addresses"`
 	LastSeen  int64    `json:"last_seen"`
+	// Mailbox contacts are always-on nodes that hold envelopes while we are offline
+	Mailbox bool `json:"mailbox,omitempty"`
 }
 
 func (s *Store) AddContact(c Contact) error {
-	err := s.DB.Update(func(txn *badger.Txn) error {
+	err := s.update(func(txn *badger.Txn) error {
 		key := []byte("contact:" + c.ID)
-		val, err := json.Marshal(c)
+		val, err := marshalContact(c)
 		if err != nil {
 			return err
 		}
@@ -147,7 +204,7 @@ func (s *Store) AddContact(c Contact) error {
 
 func (s *Store) GetAllContacts() (map[string]Contact, error) {
 	contacts := make(map[string]Contact)
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
@@ -155,8 +212,8 @@ func (s *Store) GetAllContacts() (map[string]Contact, error) {
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			err := item.Value(func(v []byte) error {
-				var c Contact
-				if err := json.Unmarshal(v, &c); err != nil {
+				c, err := unmarshalContact(v)
+				if err != nil {
 					return err
 				}
 				contacts[c.ID] = c
@@ -173,15 +230,17 @@ func (s *Store) GetAllContacts() (map[string]Contact, error) {
 
 func (s *Store) GetChatList() ([]Chat, error) {
 	var chats []Chat
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		prefix := []byte("chat:")
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			var c Chat
 			_ = it.Item().Value(func(v []byte) error {
-				return json.Unmarshal(v, &c)
+				return unmarshalChat(v, &c)
 			})
+			c.Peers, _ = s.getChatMemberIDs(txn, c.ID)
+			c.Roles, _ = s.getChatRoles(txn, c.ID)
 			chats = append(chats, c)
 		}
 		return nil
@@ -190,6 +249,12 @@ func (s *Store) GetChatList() ([]Chat, error) {
 }
 
 func (s *Store) getChatMemberIDs(txn *badger.Txn, chatID string) ([]string, error) {
+	return chatMemberIDs(txn, chatID), nil
+}
+
+// chatMemberIDs lists the peers of the chat. Peers invited to a group are
+// not members until they join, they only show up in getChatRoles.
+func chatMemberIDs(txn *badger.Txn, chatID string) []string {
 	var peerIDs []string
 	prefix := []byte("member:" + chatID + ":")
 
@@ -201,11 +266,40 @@ func (s *Store) getChatMemberIDs(txn *badger.Txn, chatID string) ([]string, erro
 
 	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 		key := it.Item().Key()
+		invited := false
+		_ = it.Item().Value(func(v []byte) error {
+			invited = ParseRole(string(v)) == RoleInvited
+			return nil
+		})
+		if invited {
+			continue
+		}
 		peerID := string(key[len(prefix):])
 		peerIDs = append(peerIDs, peerID)
 	}
 
-	return peerIDs, nil
+	return peerIDs
+}
+
+// getChatRoles reads the roles of group members; direct chats have none.
+func (s *Store) getChatRoles(txn *badger.Txn, chatID string) (map[string]Role, error) {
+	roles := make(map[string]Role)
+	prefix := []byte("member:" + chatID + ":")
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		peerID := string(it.Item().Key()[len(prefix):])
+		err := it.Item().Value(func(v []byte) error {
+			if role := ParseRole(string(v)); role != RoleNone {
+				roles[peerID] = role
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
 }
 
 func (s *Store) getMessagesForChat(txn *badger.Txn, chatID string) ([]Message, error) {
@@ -216,50 +310,102 @@ func (s *Store) getMessagesForChat(txn *badger.Txn, chatID string) ([]Message, e
 	defer it.Close()
 
 	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-		item := it.Item()
-
-		var m Message
-		err := item.Value(func(v []byte) error {
-			return json.Unmarshal(v, &m)
-		})
+		m, err := decodeMessage(it.Item(), prefix, chatID)
 		if err != nil {
 			fmt.Printf("error seeking messages: %v", err)
 			continue
 		}
-
-		m.ChatID = chatID
-
-		key := item.Key()
-		keysuf := strings.Split(string(key[len(prefix):]), ":")
-		m.ID = keysuf[1]
-		nsec, err := strconv.Atoi(keysuf[0])
-		if err != nil {
-			fmt.Printf("unable to convert key timestamp to nanoseconds: %v", err)
-		} else {
-			m.Sent = time.Unix(0, int64(nsec))
-		}
-
 		msgs = append(msgs, m)
 	}
 
 	return msgs, nil
 }
 
+// decodeMessage reads a msg:<chat>:<ts>:<id> entry; the ID and send time
+// come from the key.
+func decodeMessage(item *badger.Item, prefix []byte, chatID string) (Message, error) {
+	var m Message
+	err := item.Value(func(v []byte) error {
+		var err error
+		m, err = unmarshalMessage(v)
+		return err
+	})
+	if err != nil {
+		return m, err
+	}
+
+	m.ChatID = chatID
+
+	key := item.Key()
+	keysuf := strings.Split(string(key[len(prefix):]), ":")
+	m.ID = keysuf[1]
+	nsec, err := strconv.Atoi(keysuf[0])
+	if err != nil {
+		fmt.Printf("unable to convert key timestamp to nanoseconds: %v", err)
+	} else {
+		m.Sent = time.Unix(0, int64(nsec))
+	}
+	return m, nil
+}
+
 func (s *Store) createChatHeader(c Chat) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		key := []byte("chat:" + c.ID)
-		data, _ := json.Marshal(c)
+		data, _ := marshalChat(&c)
 		return txn.Set(key, data)
 	})
 }
 
 func (s *Store) AddChatMember(chatID string, peerID string) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		key := fmt.Appendf(nil, "member:%s:%s", chatID, peerID)
 		return txn.Set(key, []byte{})
 	})
 }
 
+func (s *Store) SetChatMemberRole(chatID string, peerID string, role Role) error {
+	return s.update(func(txn *badger.Txn) error {
+		key := fmt.Appendf(nil, "member:%s:%s", chatID, peerID)
+		return txn.Set(key, []byte(role.String()))
+	})
+}
+
+func (s *Store) RemoveChatMember(chatID string, peerID string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete(fmt.Appendf(nil, "member:%s:%s", chatID, peerID))
+	})
+}
+
+func (s *Store) AddMembershipChange(c MembershipChange) error {
+	return s.update(func(txn *badger.Txn) error {
+		key := fmt.Appendf(nil, "memberop:%s:%020d:%s", c.ChatID, c.Sent.UnixNano(), c.ID)
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, data)
+	})
+}
+
+// GetMembershipChanges returns the membership log of a chat in log order.
+func (s *Store) GetMembershipChanges(chatID string) ([]MembershipChange, error) {
+	var changes []MembershipChange
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("memberop:" + chatID + ":")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var c MembershipChange
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &c) }); err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+		return nil
+	})
+	return changes, err
+}
+
 func (s *Store) CreateNewChat(c Chat) error {
 	err := s.createChatHeader(c)
 	if err != nil {
@@ -272,24 +418,571 @@ func (s *Store) CreateNewChat(c Chat) error {
 	return nil
 }
 
+// GetFullChat loads the header and members of the chat and its latest page
+// of messages; older ones come with LoadOlder.
 func (s *Store) GetFullChat(chat *Chat, allContacts map[string]Contact) error {
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		item, _ := txn.Get([]byte("chat:" + chat.ID))
-		item.Value(func(v []byte) error { return json.Unmarshal(v, chat) })
+		item.Value(func(v []byte) error { return unmarshalChat(v, chat) })
 		chat.Peers, _ = s.getChatMemberIDs(txn, chat.ID)
-		chat.Messages, _ = s.getMessagesForChat(txn, chat.ID)
-
+		chat.Roles, _ = s.getChatRoles(txn, chat.ID)
 		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return s.LoadLatest(chat)
 }
 
 func (s *Store) AddMessage(m Message) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		ts := m.Sent.UnixNano()
 		key := fmt.Appendf(nil, "msg:%s:%020d:%s", m.ChatID, ts, m.ID)
 
-		data, _ := json.Marshal(m)
+		data, err := marshalMessage(&m)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(key, data); err != nil {
+			return err
+		}
+		if m.Attachment != nil {
+			if err := txn.Set(blobRefKey(m.Attachment.Hash, m.ChatID, m.ID), nil); err != nil {
+				return err
+			}
+		}
+		// edits may have come before the message
+		text := searchText(&m)
+		if edited, ok, err := latestEditText(txn, m.ChatID, m.ID, m.Author); err != nil {
+			return err
+		} else if ok && !m.Deleted {
+			text = edited
+		}
+		if err := indexMessage(txn, m.ChatID, m.ID, text); err != nil {
+			return err
+		}
+		if err := indexHead(txn, &m, key); err != nil {
+			return err
+		}
+		// a replaced copy may have been stored under another timestamp
+		if item, err := txn.Get(messageIndexKey(m.ChatID, m.ID)); err == nil {
+			oldKey, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if string(oldKey) != string(key) {
+				if err := txn.Delete(oldKey); err != nil {
+					return err
+				}
+			}
+		}
+		return txn.Set(messageIndexKey(m.ChatID, m.ID), key)
+	})
+}
+
+// msgid:<chat>:<id> points at the msg: key so messages can be found by ID
+func messageIndexKey(chatID, msgID string) []byte {
+	return []byte("msgid:" + chatID + ":" + msgID)
+}
+
+// head:<chat>:<id> points at the msg: key of a message nobody follows yet
+func headKey(chatID, msgID string) []byte {
+	return []byte("head:" + chatID + ":" + msgID)
+}
+
+// followed:<chat>:<id> marks a message another one follows, also while it
+// has not arrived itself
+func followedKey(chatID, msgID string) []byte {
+	return []byte("followed:" + chatID + ":" + msgID)
+}
+
+// indexHead makes m, stored under key, a head of its chat unless a message
+// follows it, and its parents heads no more. A message whose signature did
+// not match could claim to follow anything, it is left out.
+func indexHead(txn *badger.Txn, m *Message, key []byte) error {
+	if m.Unverified {
+		return nil
+	}
+	for _, p := range m.Parents() {
+		if err := txn.Set(followedKey(m.ChatID, p), nil); err != nil {
+			return err
+		}
+		if err := txn.Delete(headKey(m.ChatID, p)); err != nil {
+			return err
+		}
+	}
+	if _, err := txn.Get(followedKey(m.ChatID, m.ID)); err == nil {
+		return nil
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.Set(headKey(m.ChatID, m.ID), key)
+}
+
+func (s *Store) GetMessage(chatID, msgID string) (*Message, error) {
+	var found *Message
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		found, err = getMessage(txn, chatID, msgID)
+		return err
+	})
+	return found, err
+}
+
+// getMessage returns nil if the message is not stored.
+func getMessage(txn *badger.Txn, chatID, msgID string) (*Message, error) {
+	item, err := txn.Get(messageIndexKey(chatID, msgID))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	item, err = txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var m Message
+	err = item.Value(func(v []byte) error {
+		m, err = unmarshalMessage(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// HasMessage also holds for deleted messages we never got, so they are not fetched.
+func (s *Store) HasMessage(chatID, msgID string) bool {
+	if tomb, err := s.GetTombstone(chatID, msgID); err == nil && tomb != nil {
+		return true
+	}
+	m, err := s.GetMessage(chatID, msgID)
+	return err == nil && m != nil
+}
+
+// GetChatHeads returns the messages nobody follows yet, newest first, as
+// Heads would but from the head: keys instead of the whole history.
+func (s *Store) GetChatHeads(chatID string) ([]Message, error) {
+	var heads []Message
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := headKey(chatID, "")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			m, err := decodeMessage(item, messagePrefix(chatID), chatID)
+			if err != nil {
+				return err
+			}
+			heads = append(heads, m)
+		}
+		return nil
+	})
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].Sent.After(heads[j].Sent)
+	})
+	return heads, err
+}
+
+func (s *Store) setJSON(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	})
+}
+
+// getJSON reports false when the key does not exist.
+func (s *Store) getJSON(key string, v any) (bool, error) {
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(data []byte) error { return json.Unmarshal(data, v) })
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+const e2eIdentityPath = "system:e2e_identity"
+
+func (s *Store) SaveE2EIdentity(id *E2EIdentity) error {
+	return s.setJSON(e2eIdentityPath, id)
+}
+
+func (s *Store) LoadE2EIdentity() (*E2EIdentity, error) {
+	var id E2EIdentity
+	ok, err := s.getJSON(e2eIdentityPath, &id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (s *Store) SavePeerBundle(peerID string, b *PeerBundle) error {
+	return s.setJSON("e2e:bundle:"+peerID, b)
+}
+
+// LoadPeerBundle returns nil if the peer never sent its bundle.
+func (s *Store) LoadPeerBundle(peerID string) (*PeerBundle, error) {
+	var b PeerBundle
+	ok, err := s.getJSON("e2e:bundle:"+peerID, &b)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *Store) SaveSessions(peerID string, ps *PeerSessions) error {
+	return s.setJSON("e2e:session:"+peerID, ps)
+}
+
+func (s *Store) SaveOwnSenderKey(chatID string, key *OwnSenderKey) error {
+	return s.setJSON("skey:own:"+chatID, key)
+}
+
+// LoadOwnSenderKey returns nil if there is no key for the chat yet.
+func (s *Store) LoadOwnSenderKey(chatID string) (*OwnSenderKey, error) {
+	var key OwnSenderKey
+	ok, err := s.getJSON("skey:own:"+chatID, &key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *Store) DeleteOwnSenderKey(chatID string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("skey:own:" + chatID))
+	})
+}
+
+func (s *Store) SavePeerSenderKeys(chatID, peerID string, keys *PeerSenderKeys) error {
+	return s.setJSON("skey:peer:"+chatID+":"+peerID, keys)
+}
+
+func (s *Store) LoadPeerSenderKeys(chatID, peerID string) (*PeerSenderKeys, error) {
+	keys := &PeerSenderKeys{Keys: make(map[string]*PeerSenderKey)}
+	_, err := s.getJSON("skey:peer:"+chatID+":"+peerID, keys)
+	return keys, err
+}
+
+func (s *Store) LoadSessions(peerID string) (*PeerSessions, error) {
+	ps := &PeerSessions{Sessions: make(map[string]*Session)}
+	_, err := s.getJSON("e2e:session:"+peerID, ps)
+	return ps, err
+}
+
+func outboxKey(e OutboxEntry) []byte {
+	return fmt.Appendf(nil, "outbox:%s:%020d:%s", e.PeerID, e.Queued.UnixNano(), e.ID)
+}
+
+func (s *Store) AddOutboxEntry(e OutboxEntry) error {
+	return s.setJSON(string(outboxKey(e)), e)
+}
+
+// GetOutboxEntries returns the queue of a peer, oldest first.
+func (s *Store) GetOutboxEntries(peerID string) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("outbox:" + peerID + ":")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var e OutboxEntry
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *Store) DeleteOutboxEntry(e OutboxEntry) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete(outboxKey(e))
+	})
+}
+
+func (s *Store) AddMailboxEntry(e MailboxEntry) error {
+	return s.setJSON("mailbox:"+e.Recipient+":"+e.ID, e)
+}
+
+func (s *Store) GetMailboxEntries(recipient string) ([]MailboxEntry, error) {
+	return s.getMailboxEntries("mailbox:"+recipient+":", func(MailboxEntry) bool { return true })
+}
+
+// GetMailboxEntriesFrom returns what the mailbox holds from sender, for any recipient.
+func (s *Store) GetMailboxEntriesFrom(sender string) ([]MailboxEntry, error) {
+	return s.getMailboxEntries("mailbox:", func(e MailboxEntry) bool { return e.Sender == sender })
+}
+
+func (s *Store) getMailboxEntries(prefix string, keep func(MailboxEntry) bool) ([]MailboxEntry, error) {
+	var entries []MailboxEntry
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			var e MailboxEntry
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+				return err
+			}
+			if keep(e) {
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *Store) DeleteMailboxEntry(recipient, id string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("mailbox:" + recipient + ":" + id))
+	})
+}
+
+func (s *Store) DeleteExpiredMailboxEntries(now time.Time) (int, error) {
+	var expired [][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("mailbox:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var e MailboxEntry
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+				return err
+			}
+			if now.After(e.Expires) {
+				expired = append(expired, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), s.update(func(txn *badger.Txn) error {
+		for _, key := range expired {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rcpt:<chat>:<msg>:<peer> holds the receipt of a peer for a message
+func receiptKey(chatID, msgID, peerID string) []byte {
+	return []byte("rcpt:" + chatID + ":" + msgID + ":" + peerID)
+}
+
+// SetReceipt stores the receipt unless the peer already got further. It
+// reports whether anything changed.
+func (s *Store) SetReceipt(chatID, msgID, peerID string, r Receipt) (bool, error) {
+	changed := false
+	err := s.update(func(txn *badger.Txn) error {
+		key := receiptKey(chatID, msgID, peerID)
+		if item, err := txn.Get(key); err == nil {
+			var old Receipt
+			if err := item.Value(func(v []byte) error { return json.Unmarshal(v, &old) }); err != nil {
+				return err
+			}
+			if old.Status >= r.Status {
+				return nil
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		changed = true
 		return txn.Set(key, data)
 	})
+	return changed, err
+}
+
+// getReceipts returns the receipt status of a message per peer.
+func (s *Store) getReceipts(txn *badger.Txn, chatID, msgID string) (map[string]ReceiptStatus, error) {
+	var receipts map[string]ReceiptStatus
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	prefix := []byte("rcpt:" + chatID + ":" + msgID + ":")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var r Receipt
+		if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &r) }); err != nil {
+			return nil, err
+		}
+		if receipts == nil {
+			receipts = make(map[string]ReceiptStatus)
+		}
+		receipts[string(it.Item().Key()[len(prefix):])] = r.Status
+	}
+	return receipts, nil
+}
+
+func (s *Store) deletePrefix(prefix []byte) error {
+	var keys [][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func messageEditKey(e MessageEdit) []byte {
+	return fmt.Appendf(nil, "edit:%s:%s:%020d:%s", e.ChatID, e.MessageID, e.Sent.UnixNano(), e.ID)
+}
+
+// tomb:<chat>:<msg> holds the delete of a message
+func tombstoneKey(chatID, msgID string) []byte {
+	return []byte("tomb:" + chatID + ":" + msgID)
+}
+
+func (s *Store) AddMessageEdit(e MessageEdit) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		if e.Delete {
+			return txn.Set(tombstoneKey(e.ChatID, e.MessageID), data)
+		}
+		if err := txn.Set(messageEditKey(e), data); err != nil {
+			return err
+		}
+		// only the author's edits count, an edit that came before its
+		// message is indexed by AddMessage
+		target, err := getMessage(txn, e.ChatID, e.MessageID)
+		if err != nil || target == nil || target.Deleted || target.Author != e.Author {
+			return err
+		}
+		text, _, err := latestEditText(txn, e.ChatID, e.MessageID, target.Author)
+		if err != nil {
+			return err
+		}
+		return indexMessage(txn, e.ChatID, e.MessageID, text)
+	})
+}
+
+// DeleteTombstone drops the delete of a message, one its author did not make.
+func (s *Store) DeleteTombstone(chatID, msgID string) error {
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete(tombstoneKey(chatID, msgID))
+	})
+}
+
+func (s *Store) GetTombstone(chatID, msgID string) (*MessageEdit, error) {
+	var e MessageEdit
+	found, err := s.getJSON(string(tombstoneKey(chatID, msgID)), &e)
+	if !found {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetMessageEdits returns the edits of a message, oldest first.
+func (s *Store) GetMessageEdits(chatID, msgID string) ([]MessageEdit, error) {
+	var edits []MessageEdit
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		edits, err = s.getEdits(txn, chatID, msgID)
+		return err
+	})
+	return edits, err
+}
+
+func (s *Store) getEdits(txn *badger.Txn, chatID, msgID string) ([]MessageEdit, error) {
+	var edits []MessageEdit
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	prefix := []byte("edit:" + chatID + ":" + msgID + ":")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var e MessageEdit
+		if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, nil
+}
+
+// react:<chat>:<msg> holds the Reactions of a message
+func reactionsKey(chatID, msgID string) []byte {
+	return []byte("react:" + chatID + ":" + msgID)
+}
+
+// AddReaction merges r into the reactions of its message and reports
+// whether it changed anything.
+func (s *Store) AddReaction(r Reaction) (bool, error) {
+	changed := false
+	err := s.update(func(txn *badger.Txn) error {
+		key := reactionsKey(r.ChatID, r.MessageID)
+		rs := make(Reactions)
+		if item, err := txn.Get(key); err == nil {
+			if err := item.Value(func(v []byte) error { return json.Unmarshal(v, &rs) }); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if !rs.apply(r) {
+			return nil
+		}
+		data, err := json.Marshal(rs)
+		if err != nil {
+			return err
+		}
+		changed = true
+		return txn.Set(key, data)
+	})
+	return changed, err
+}
+
+func (s *Store) getReactions(txn *badger.Txn, chatID, msgID string) (Reactions, error) {
+	item, err := txn.Get(reactionsKey(chatID, msgID))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rs := make(Reactions)
+	return rs, item.Value(func(v []byte) error { return json.Unmarshal(v, &rs) })
 }
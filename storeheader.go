@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+	"golang.org/x/crypto/argon2"
+)
+
+const storeHeaderVersion = 1
+
+var ErrWrongPassword = errors.New("wrong password")
+
+// every store created before the header existed used this salt
+var legacySalt = []byte("constant_salt_for_app")
+
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	KeyLen  uint32 `json:"key_len"`
+}
+
+var defaultKDF = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32}
+
+// check keeps parameters read before anything is authenticated from
+// crashing argon2 or eating all memory.
+func (p KDFParams) check() error {
+	if p.Time < 1 || p.Time > 16 || p.Threads < 1 || p.Threads > 16 || p.Memory < 8*uint32(p.Threads) || p.Memory > 1<<20 {
+		return fmt.Errorf("unsupported key derivation parameters %+v", p)
+	}
+	return nil
+}
+
+// StoreHeader lives unencrypted next to the store and holds what is needed
+// to turn the password into the Badger encryption key.
+type StoreHeader struct {
+	Version   int       `json:"version"`
+	Salt      []byte    `json:"salt"`
+	KDF       KDFParams `json:"kdf"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+func NewStoreHeader(encrypted bool) (*StoreHeader, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &StoreHeader{Version: storeHeaderVersion, Salt: salt, KDF: defaultKDF, Encrypted: encrypted}, nil
+}
+
+func (h *StoreHeader) DeriveKey(password string) []byte {
+	return argon2.IDKey([]byte(password), h.Salt, h.KDF.Time, h.KDF.Memory, h.KDF.Threads, h.KDF.KeyLen)
+}
+
+func readStoreHeader(path string) (*StoreHeader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var h StoreHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("corrupt store header %s: %w", path, err)
+	}
+	if h.Version > storeHeaderVersion {
+		return nil, fmt.Errorf("store header version %d is newer than this build", h.Version)
+	}
+	if err := h.KDF.check(); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// writeStoreHeader replaces the header atomically.
+func writeStoreHeader(path string, h *StoreHeader) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func storeExists(dbPath string) bool {
+	_, err := os.Stat(filepath.Join(dbPath, badger.KeyRegistryFileName))
+	return err == nil
+}
+
+// checkStoreKey tells whether key opens the key registry of the store.
+func checkStoreKey(dbPath string, key []byte) error {
+	kr, err := badger.OpenKeyRegistry(badger.KeyRegistryOptions{
+		Dir:           dbPath,
+		ReadOnly:      true,
+		EncryptionKey: key,
+	})
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return ErrWrongPassword
+	} else if err != nil {
+		return err
+	}
+	return kr.Close()
+}
+
+// rotateStoreKey re-encrypts the data keys of a closed store with newKey.
+// An empty newKey stores them in plain text.
+func rotateStoreKey(dbPath string, oldKey, newKey []byte) error {
+	opts := badger.KeyRegistryOptions{
+		Dir:           dbPath,
+		ReadOnly:      true,
+		EncryptionKey: oldKey,
+		// must match badger.DefaultOptions, the registry stores it
+		EncryptionKeyRotationDuration: badger.DefaultOptions(dbPath).EncryptionKeyRotationDuration,
+	}
+	kr, err := badger.OpenKeyRegistry(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return ErrWrongPassword
+	} else if err != nil {
+		return err
+	}
+	defer kr.Close()
+	opts.EncryptionKey = newKey
+	return badger.WriteKeyRegistry(kr, opts)
+}
+
+// migrateLegacyStore gives a store opened with the constant salt its own
+// random salt. The new header is kept as .pending until the key registry is
+// rewritten, so an interrupted migration can be finished on the next start.
+func migrateLegacyStore(dbPath, headerPath, password string) (*StoreHeader, error) {
+	pendingPath := headerPath + ".pending"
+	if pending, err := readStoreHeader(pendingPath); err == nil {
+		var key []byte
+		if pending.Encrypted {
+			key = pending.DeriveKey(password)
+		}
+		if checkStoreKey(dbPath, key) == nil {
+			fmt.Println("finishing interrupted store migration")
+			return pending, os.Rename(pendingPath, headerPath)
+		}
+	}
+
+	legacy := &StoreHeader{Salt: legacySalt, KDF: defaultKDF, Encrypted: password != ""}
+	var oldKey []byte
+	if legacy.Encrypted {
+		oldKey = legacy.DeriveKey(password)
+	}
+	if err := checkStoreKey(dbPath, oldKey); err != nil {
+		return nil, err
+	}
+
+	header, err := NewStoreHeader(legacy.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Encrypted {
+		return header, writeStoreHeader(headerPath, header)
+	}
+	if err := writeStoreHeader(pendingPath, header); err != nil {
+		return nil, err
+	}
+	fmt.Println("migrating store to a per-installation salt")
+	if err := rotateStoreKey(dbPath, oldKey, header.DeriveKey(password)); err != nil {
+		os.Remove(pendingPath)
+		return nil, err
+	}
+	return header, os.Rename(pendingPath, headerPath)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"mobila/pb"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a resend request may stay unanswered before another member is asked
+	resendTimeout = 15 * time.Second
+	syncTick      = 5 * time.Second
+)
+
+// pendingFetch is a message we know exists but have not received yet.
+type pendingFetch struct {
+	chatID  string
+	msgID   string
+	asked   []string
+	askedAt time.Time
+}
+
+// Syncer walks chat histories backwards through Prev and Merges links and
+// fetches whatever is missing locally from any online chat member.
+type Syncer struct {
+	state   *State
+	mu      sync.Mutex
+	pending map[string]*pendingFetch
+}
+
+func NewSyncer(s *State) *Syncer {
+	return &Syncer{state: s, pending: make(map[string]*pendingFetch)}
+}
+
+func (sy *Syncer) Run() {
+	for {
+		select {
+		case <-sy.state.ctx.Done():
+			return
+		case <-time.After(syncTick):
+		}
+		sy.retry()
+	}
+}
+
+// Want requests the messages that are not in the store yet, asking from first.
+func (sy *Syncer) Want(chatID string, msgIDs []string, from string) {
+	for _, msgID := range msgIDs {
+		if msgID == "" || sy.state.Store.HasMessage(chatID, msgID) {
+			continue
+		}
+		key := chatID + ":" + msgID
+		sy.mu.Lock()
+		_, already := sy.pending[key]
+		if !already {
+			sy.pending[key] = &pendingFetch{chatID: chatID, msgID: msgID}
+		}
+		p := sy.pending[key]
+		ask := !slices.Contains(p.asked, from)
+		if ask {
+			p.asked = append(p.asked, from)
+			p.askedAt = time.Now()
+		}
+		sy.mu.Unlock()
+		if ask {
+			sy.ask(p.chatID, p.msgID, from)
+		}
+	}
+}
+
+// Fetch asks an online member of the chat for a message we do not have.
+// It reports false when nobody is online to ask.
+func (sy *Syncer) Fetch(chatID, msgID string) bool {
+	online := sy.state.onlinePeers()
+	ownID := sy.state.Node.Host.ID().String()
+	for _, member := range sy.state.chatMembers(chatID) {
+		if member != ownID && online[member] {
+			sy.Want(chatID, []string{msgID}, member)
+			return true
+		}
+	}
+	return false
+}
+
+// Arrived follows the parents of a freshly stored message.
+func (sy *Syncer) Arrived(msg Message, from string) {
+	sy.mu.Lock()
+	delete(sy.pending, msg.ChatID+":"+msg.ID)
+	sy.mu.Unlock()
+	sy.Want(msg.ChatID, msg.Parents(), from)
+}
+
+func (sy *Syncer) ask(chatID, msgID, peerID string) {
+	err := sy.state.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_ResendStatic{
+		ResendStatic: &pb.StaticResendRequest{ChatId: chatID, MessageId: msgID},
+	}})
+	if err != nil {
+		fmt.Printf("error requesting message %s from %s: %v\n", msgID, peerID, err)
+	}
+}
+
+// retry re-asks stale requests from members that have not been asked yet.
+// When everyone was asked the request is dropped; the next heads exchange
+// brings it back.
+func (sy *Syncer) retry() {
+	online := sy.state.onlinePeers()
+	sy.mu.Lock()
+	var asks []pendingFetch
+	for key, p := range sy.pending {
+		if time.Since(p.askedAt) < resendTimeout {
+			continue
+		}
+		next := ""
+		for _, member := range sy.state.chatMembers(p.chatID) {
+			if online[member] && !slices.Contains(p.asked, member) {
+				next = member
+				break
+			}
+		}
+		if next == "" {
+			delete(sy.pending, key)
+			continue
+		}
+		p.asked = append(p.asked, next)
+		p.askedAt = time.Now()
+		asks = append(asks, pendingFetch{chatID: p.chatID, msgID: p.msgID, asked: []string{next}})
+	}
+	sy.mu.Unlock()
+	for _, a := range asks {
+		sy.ask(a.chatID, a.msgID, a.asked[0])
+	}
+}
+
+// SendHeads tells the peer the latest messages of every chat we share.
+func (sy *Syncer) SendHeads(peerID string) {
+	s := sy.state
+	s.mu.RLock()
+	var chatIDs []string
+	for _, c := range s.Chats {
+		if slices.Contains(c.Peers, peerID) {
+			chatIDs = append(chatIDs, c.ID)
+		}
+	}
+	s.mu.RUnlock()
+	for _, chatID := range chatIDs {
+		heads, err := s.Store.GetChatHeads(chatID)
+		if err != nil {
+			fmt.Printf("error collecting heads of chat %s: %v\n", chatID, err)
+			continue
+		}
+		if len(heads) == 0 {
+			continue
+		}
+		ids := make([]string, len(heads))
+		for i := range heads {
+			ids[i] = heads[i].ID
+		}
+		err = s.sendToPeer(peerID, &pb.DataPacket{Msg: &pb.DataPacket_ChatHeads{
+			ChatHeads: &pb.ChatHeads{ChatId: chatID, MessageIds: ids},
+		}})
+		if err != nil {
+			fmt.Printf("error sending heads of chat %s to %s: %v\n", chatID, peerID, err)
+		}
+	}
+}
+
+func (sy *Syncer) ReceiveHeads(peerID string, heads *pb.ChatHeads) {
+	if !slices.Contains(sy.state.chatMembers(heads.ChatId), peerID) {
+		fmt.Printf("heads of chat %s from non-member %s ignored\n", heads.ChatId, peerID)
+		return
+	}
+	sy.Want(heads.ChatId, heads.MessageIds, peerID)
+}
+
+// Resend answers a StaticResendRequest from the store.
+func (sy *Syncer) Resend(peerID string, rs *pb.StaticResendRequest) {
+	if !slices.Contains(sy.state.chatMembers(rs.ChatId), peerID) {
+		return
+	}
+	msg, err := sy.state.Store.GetMessage(rs.ChatId, rs.MessageId)
+	if err != nil || msg == nil {
+		return
+	}
+	// a deleted message is answered with its delete, if its author made it
+	if tomb, err := sy.state.Store.GetTombstone(rs.ChatId, rs.MessageId); err == nil && tomb != nil && tomb.Author == msg.Author {
+		err = sy.state.sendSealed(peerID, &pb.DataPacket{Msg: &pb.DataPacket_MessageEdit{MessageEdit: tomb.ToProto()}})
+		if err != nil {
+			fmt.Printf("error resending delete of %s to %s: %v\n", rs.MessageId, peerID, err)
+		}
+		return
+	}
+	st := msg.ToStatic()
+	if msg.Unverified || VerifyStatic(st) != nil {
+		// the requester checks signatures anyway, do not spread forgeries
+		return
+	}
+	err = sy.state.sendSealed(peerID, &pb.DataPacket{Msg: &pb.DataPacket_Static{Static: st}})
+	if err != nil {
+		fmt.Printf("error resending message %s to %s: %v\n", msg.ID, peerID, err)
+	}
+}
+
+func (s *State) chatMembers(chatID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if chat := s.findChat(chatID); chat != nil {
+		return append([]string{}, chat.Peers...)
+	}
+	return nil
+}
+
+func (s *State) onlinePeers() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	online := make(map[string]bool, len(s.PeerStreamWriters))
+	for peerID := range s.PeerStreamWriters {
+		online[peerID] = true
+	}
+	return online
+}
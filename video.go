@@ -10,7 +10,9 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
+	"github.com/at-wat/ebml-go/mkvcore"
 	"github.com/at-wat/ebml-go/webm"
 	"github.com/pion/mediadevices"
 	"github.com/pion/mediadevices/pkg/codec/opus"
@@ -53,6 +55,17 @@ func (vw *VideoWidget) Tapped(_ *fyne.PointEvent) { vw.OnTapped(vw.id) }
 
 func (vw *VideoWidget) SetCaption(caption string) { vw.label.SetText(caption) }
 
+// EnableVolume puts a volume slider under the caption of a remote participant.
+func (vw *VideoWidget) EnableVolume(onChanged func(float64)) {
+	volume := widget.NewSlider(0, 2)
+	volume.Step = 0.05
+	volume.SetValue(1)
+	volume.OnChanged = onChanged
+	vw.content.Objects = []fyne.CanvasObject{vw.raster, container.NewVBox(vw.label, volume)}
+	vw.content.Layout = layout.NewBorderLayout(nil, vw.content.Objects[1], nil, nil)
+	vw.content.Refresh()
+}
+
 func (vw *VideoWidget) UpdateFrame(img image.Image) {
 	vw.mu.Lock()
 	defer vw.mu.Unlock()
@@ -114,6 +127,8 @@ func CreateVideoPad(peers []string) (fyne.CanvasObject, map[string]*VideoWidget)
 func GetCameraTracks() (videoTrack *mediadevices.VideoTrack, audioTrack *mediadevices.AudioTrack) {
 	vpxParams, _ := vpx.NewVP8Params()
 	vpxParams.BitRate = 500_000
+	// late joiners can only start decoding at a key frame
+	vpxParams.KeyFrameInterval = 60
 	opusParams, _ := opus.NewParams()
 	opusParams.BitRate = 48_000
 
@@ -150,6 +165,9 @@ func CreateEncoder(pw *io.PipeWriter) (videoConsumer, audioConsumer webm.BlockWr
 			Video: &webm.Video{PixelWidth: 640, PixelHeight: 480}},
 		{Name: "Audio", TrackNumber: 2, CodecID: "A_OPUS", TrackType: 2,
 			Audio: &webm.Audio{SamplingFrequency: 48000.0, Channels: 2}},
-	})
+	},
+		// start a new cluster on the first key frame after ~2s so receivers can resync
+		mkvcore.WithMaxKeyframeInterval(1, 0x7FFF-2000),
+	)
 	return ws[0], ws[1]
 }